@@ -5,25 +5,144 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"os"
 
+	"github.com/L11R/escobar/internal/configs"
 	"github.com/L11R/escobar/internal/daemon"
+	"github.com/jessevdk/go-flags"
 	"github.com/kardianos/service"
 )
 
+// Exit codes, status codes follow LSB init script conventions
+const (
+	exitOK           = 0
+	exitError        = 1
+	exitUsage        = 2
+	exitStopped      = 3
+	exitNotInstalled = 4
+)
+
 func main() {
-	d := daemon.New()
+	os.Exit(run())
+}
 
-	svc, err := service.New(d, &service.Config{
-		Name:        "escobar",
-		DisplayName: "Escobar Proxy",
-		Description: "Local forward proxy server that helps to remove authentication. It's a Kerberos alternative to cntlm utility.",
-	})
+func run() int {
+	// Parse command line arguments, environment variables or from config file
+	config, err := configs.Parse()
+	if err != nil {
+		if err, ok := err.(*flags.Error); ok {
+			fmt.Println(err)
+			if err.Type == flags.ErrHelp {
+				return exitOK
+			}
+
+			return exitUsage
+		}
+
+		fmt.Printf("Invalid args: %v\n", err)
+		return exitError
+	}
+
+	d := daemon.New(config)
+
+	svc, err := service.New(d, serviceConfig(config))
 	if err != nil {
-		log.Fatalln(err)
+		fmt.Printf("Cannot create service: %v\n", err)
+		return exitError
+	}
+
+	switch config.Command {
+	case configs.RunCommand:
+		if err := svc.Run(); err != nil {
+			fmt.Printf("Error while running proxy: %v\n", err)
+			return exitError
+		}
+	case configs.InstallCommand:
+		if err := config.Save(config.Install.ConfigPath); err != nil {
+			fmt.Printf("Error while trying to save config: %v\n", err)
+			return exitError
+		}
+
+		if err := svc.Install(); err != nil {
+			fmt.Printf("Error while trying to install service: %v\n", err)
+			return exitError
+		}
+
+		fmt.Println("Service installed")
+	case configs.UninstallCommand, configs.StartCommand, configs.StopCommand, configs.RestartCommand:
+		if err := service.Control(svc, config.Command); err != nil {
+			if errors.Is(err, service.ErrNotInstalled) {
+				fmt.Println("Service is not installed")
+				return exitNotInstalled
+			}
+
+			fmt.Printf("Cannot %s service: %v\n", config.Command, err)
+			return exitError
+		}
+
+		fmt.Printf("Service %s completed\n", config.Command)
+	case configs.StatusCommand:
+		status, err := svc.Status()
+		if err != nil {
+			if errors.Is(err, service.ErrNotInstalled) {
+				fmt.Println("Service is not installed")
+				return exitNotInstalled
+			}
+
+			fmt.Printf("Cannot get service status: %v\n", err)
+			return exitError
+		}
+
+		switch status {
+		case service.StatusRunning:
+			fmt.Println("Service is running")
+		case service.StatusStopped:
+			fmt.Println("Service is stopped")
+			return exitStopped
+		default:
+			fmt.Println("Service status is unknown")
+			return exitError
+		}
+	case configs.CheckCommand:
+		ok, err := d.Check(svc)
+		if err != nil {
+			fmt.Printf("Cannot check downstream proxy: %v\n", err)
+			return exitError
+		}
+		if !ok {
+			fmt.Println("Provided credentials for downstream proxy are invalid")
+			return exitError
+		}
+
+		fmt.Println("Provided credentials for downstream proxy are valid")
+	case configs.DoctorCommand:
+		ok, err := d.Doctor(svc, os.Stdout)
+		if err != nil {
+			fmt.Printf("Cannot run diagnostics: %v\n", err)
+			return exitError
+		}
+		if !ok {
+			return exitError
+		}
 	}
 
-	if err := svc.Run(); err != nil {
-		log.Fatalln(err)
+	return exitOK
+}
+
+// serviceConfig returns service configuration, installed service runs with the same config path.
+func serviceConfig(config *configs.Config) *service.Config {
+	args := []string{configs.RunCommand}
+	if config.Install.ConfigPath != "" {
+		args = append(args, "--config", config.Install.ConfigPath)
+	}
+
+	return &service.Config{
+		Name:        "escobar",
+		DisplayName: "Escobar Proxy",
+		Description: "Local forward proxy server that helps to remove authentication. It's a Kerberos alternative to cntlm utility.",
+		UserName:    config.Install.User,
+		Arguments:   args,
 	}
 }
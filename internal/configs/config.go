@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/L11R/escobar/internal/logging"
 	"github.com/L11R/escobar/internal/proxy"
 	"github.com/L11R/escobar/internal/static"
 	"github.com/L11R/escobar/internal/version"
@@ -21,16 +22,48 @@ import (
 	"github.com/jessevdk/go-flags"
 )
 
+const (
+	RunCommand       = "run"
+	InstallCommand   = "install"
+	UninstallCommand = "uninstall"
+	StartCommand     = "start"
+	StopCommand      = "stop"
+	RestartCommand   = "restart"
+	StatusCommand    = "status"
+	CheckCommand     = "check"
+	DoctorCommand    = "doctor"
+)
+
+const settingsFile = "settings.json"
+
 type Config struct {
-	Proxy  *proxy.Config  `group:"Proxy args" namespace:"proxy" env-namespace:"ESCOBAR_PROXY" json:"proxy"`
-	Static *static.Config `group:"Static args" namespace:"static" env-namespace:"ESCOBAR_STATIC" json:"static"`
+	Proxy  *proxy.Config   `group:"Proxy args" namespace:"proxy" env-namespace:"ESCOBAR_PROXY" json:"proxy"`
+	Static *static.Config  `group:"Static args" namespace:"static" env-namespace:"ESCOBAR_STATIC" json:"static"`
+	Log    *logging.Config `group:"Log args" namespace:"log" env-namespace:"ESCOBAR_LOG" json:"log"`
 
-	UseSystemLogger bool `short:"l" long:"syslog" description:"Enable system logger (syslog or Windows Event Log)" json:"useSystemLogger"`
-	Install         bool `long:"install" description:"Install service" json:"-"`
-	Uninstall       bool `long:"uninstall" description:"Uninstall service" json:"-"`
+	UseSystemLogger bool   `short:"l" long:"syslog" description:"Enable system logger (syslog or Windows Event Log)" json:"useSystemLogger"`
+	ConfigFile      string `short:"c" long:"config" env:"ESCOBAR_CONFIG" description:"Path to settings.json" json:"-"`
 
 	Verbose []bool `short:"v" long:"verbose" env:"ESCOBAR_VERBOSE" description:"Verbose logs" json:"verbose"`
 	Version func() `short:"V" long:"version" description:"Escobar version" json:"-"`
+
+	Run       struct{} `command:"run" description:"Run proxy (default command)" json:"-"`
+	Install   Install  `command:"install" description:"Install service" json:"-"`
+	Uninstall struct{} `command:"uninstall" description:"Uninstall service" json:"-"`
+	Start     struct{} `command:"start" description:"Start service" json:"-"`
+	Stop      struct{} `command:"stop" description:"Stop service" json:"-"`
+	Restart   struct{} `command:"restart" description:"Restart service" json:"-"`
+	Status    struct{} `command:"status" description:"Print service status" json:"-"`
+	Check     struct{} `command:"check" description:"Check credentials against ping URL once" json:"-"`
+	Doctor    struct{} `command:"doctor" description:"Diagnose config, downstream proxy and Kerberos setup" json:"-"`
+
+	// Command is the name of the command to execute
+	Command string `no-flag:"yes" json:"-"`
+}
+
+type Install struct {
+	User       string `long:"user" description:"User to run service as" json:"-"`
+	ConfigPath string `long:"config-path" description:"Path to save settings.json, system config folder by default" json:"-"`
 }
 
 // Parse returns *Config parsed from command line arguments.
@@ -47,7 +80,8 @@ func Parse() (*Config, error) {
 	}
 
 	p := flags.NewParser(&config, flags.HelpFlag|flags.PassDoubleDash)
-	if _, err = p.Parse(); err != nil {
+	p.SubcommandsOptional = true
+	if err := checkArgs(p.Parse()); err != nil {
 		err, ok := err.(*flags.Error)
 		if !ok {
 			return nil, err
@@ -58,6 +92,25 @@ func Parse() (*Config, error) {
 		}
 	}
 
+	config.Command = RunCommand
+	if p.Active != nil {
+		config.Command = p.Active.Name
+	}
+
+	// Installed service should find config regardless of working directory
+	if config.Install.ConfigPath != "" {
+		config.Install.ConfigPath, err = filepath.Abs(config.Install.ConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get absolute config path: %w", err)
+		}
+	}
+
+	// Service control commands do not need proxy options at all
+	switch config.Command {
+	case UninstallCommand, StartCommand, StopCommand, RestartCommand, StatusCommand:
+		return &config, nil
+	}
+
 	// Various modes require various options
 	user := p.FindOptionByLongName("proxy.downstream-proxy-auth.user")
 	password := p.FindOptionByLongName("proxy.downstream-proxy-auth.password")
@@ -71,29 +124,45 @@ func Parse() (*Config, error) {
 		user.Required = true
 		kdc.Required = true
 		realm.Required = true
+	case proxy.GatewayMode:
+		kdc.Required = true
+		realm.Required = true
 	case proxy.BasicMode:
 		user.Required = true
 		password.Required = true
 	}
 
 	// Try to read config, otherwise try to parse again
-	configDirs := configdir.New("Escobar", "Escobar")
-	configDirs.LocalPath, _ = filepath.Abs(".")
-	folder := configDirs.QueryFolderContainsFile("settings.json")
-	if folder != nil && len(os.Args) == 1 {
-		data, _ := folder.ReadFile("settings.json")
+	data, err := readSettings(config.ConfigFile, p.FindOptionByLongName("proxy.downstream-proxy-url").IsSet())
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
 		if err := json.Unmarshal(data, &config); err != nil {
-			fmt.Printf("Invalid config file: %v\n", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("invalid config file: %w", err)
 		}
-	} else if _, err := p.Parse(); err != nil {
+	} else if err := checkArgs(p.Parse()); err != nil {
 		return nil, err
 	}
 
-	// Parse address as *net.TCPAddr
-	config.Proxy.Addr, err = net.ResolveTCPAddr("tcp", config.Proxy.AddrString)
-	if err != nil {
-		return nil, fmt.Errorf("cannot resolve proxy address: %w", err)
+	// Parse address as *net.TCPAddr, proxy could listen on unix socket only
+	if config.Proxy.AddrString != "" {
+		config.Proxy.Addr, err = net.ResolveTCPAddr("tcp", config.Proxy.AddrString)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve proxy address: %w", err)
+		}
+	}
+	if err := config.Proxy.ResolveListeners(); err != nil {
+		return nil, err
+	}
+	if err := config.Proxy.TLS.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot set up TLS listener: %w", err)
+	}
+	if config.Proxy.Addr == nil && len(config.Proxy.Listeners) == 0 && config.Proxy.TLS.Addr == nil && config.Proxy.Unix.Path == "" {
+		return nil, fmt.Errorf("proxy address or unix socket path is required")
+	}
+	if err := config.Proxy.Unix.Resolve(); err != nil {
+		return nil, err
 	}
 
 	// Parse Downstream Proxy URL as *url.URL
@@ -105,13 +174,62 @@ func Parse() (*Config, error) {
 	if config.Proxy.DownstreamProxyURL.Hostname() == "" {
 		return nil, fmt.Errorf("incorrect URL format, you are probably passing it without http://")
 	}
+	switch config.Proxy.DownstreamProxyURL.Scheme {
+	case "http", "https":
+	case "socks5", "socks5h":
+		// SOCKS5 supports username and password authentication only
+		if config.Proxy.Mode == proxy.ManualMode || config.Proxy.Mode == proxy.GatewayMode {
+			return nil, fmt.Errorf("%s mode is not supported with SOCKS5 downstream proxy", config.Proxy.Mode)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported downstream proxy scheme %q", config.Proxy.DownstreamProxyURL.Scheme)
+	}
+	if err := config.Proxy.DownstreamProxyTLS.Resolve(config.Proxy.DownstreamProxyURL.Hostname()); err != nil {
+		return nil, fmt.Errorf("cannot set up TLS with downstream proxy: %w", err)
+	}
+	if err := config.Proxy.ResolveChain(); err != nil {
+		return nil, err
+	}
+	if len(config.Proxy.Chain) != 0 && config.Proxy.IsSOCKS() {
+		return nil, fmt.Errorf("proxy chain is not supported with SOCKS5 downstream proxy")
+	}
+	if err := config.Proxy.ResolveRouting(); err != nil {
+		return nil, fmt.Errorf("cannot set up routing: %w", err)
+	}
+	if err := config.Proxy.MITM.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot set up TLS interception: %w", err)
+	}
+	if err := config.Proxy.Headers.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot set up header rules: %w", err)
+	}
 
 	// Windows has different right management model
 	if err := config.CheckCredentials(); err != nil {
 		return nil, err
 	}
 
-	if config.Proxy.Mode == proxy.ManualMode {
+	// Resolve password and keytab references
+	if err := config.Proxy.DownstreamProxyAuth.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot resolve downstream proxy credentials: %w", err)
+	}
+	if err := config.Proxy.ACL.Resolve(); err != nil {
+		return nil, err
+	}
+	if err := config.Proxy.Bandwidth.Resolve(); err != nil {
+		return nil, err
+	}
+	if err := config.Proxy.Cache.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot set up cache: %w", err)
+	}
+	// Shared cache would serve responses to users downstream proxy doesn't allow them for
+	if config.Proxy.Cache.Dir != "" && config.Proxy.Mode == proxy.GatewayMode {
+		return nil, fmt.Errorf("cache is not supported in %s mode", config.Proxy.Mode)
+	}
+	if err := config.Proxy.ClientAuth.Resolve(); err != nil {
+		return nil, fmt.Errorf("cannot set up client authentication: %w", err)
+	}
+
+	if config.Proxy.Mode == proxy.ManualMode || config.Proxy.Mode == proxy.GatewayMode {
 		config.Proxy.Kerberos.KDC, err = net.ResolveTCPAddr("tcp", config.Proxy.Kerberos.KDCString)
 		if err != nil {
 			return nil, fmt.Errorf("cannot resolve KDC address: %w", err)
@@ -131,3 +249,67 @@ func Parse() (*Config, error) {
 
 	return &config, nil
 }
+
+// checkArgs returns an error if there are positional arguments left, commands are optional, so parser ignores them.
+func checkArgs(args []string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 0 {
+		return &flags.Error{Type: flags.ErrUnknownCommand, Message: fmt.Sprintf("unknown command `%s'", args[0])}
+	}
+
+	return nil
+}
+
+// readSettings reads explicitly passed config file. Otherwise, it looks for settings.json in the system and current
+// folders, but only if downstream proxy is not passed with arguments or environment.
+func readSettings(path string, passed bool) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read config file: %w", err)
+		}
+
+		return data, nil
+	}
+
+	if passed {
+		return nil, nil
+	}
+
+	configDirs := configdir.New("Escobar", "Escobar")
+	configDirs.LocalPath, _ = filepath.Abs(".")
+	folder := configDirs.QueryFolderContainsFile(settingsFile)
+	if folder == nil {
+		return nil, nil
+	}
+
+	data, err := folder.ReadFile(settingsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	return data, nil
+}
+
+// Save saves config into path, or into the system config folder if path is empty.
+func (c *Config) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal config: %w", err)
+	}
+
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("cannot create config folder: %w", err)
+		}
+
+		return os.WriteFile(path, b, 0600)
+	}
+
+	configDirs := configdir.New("Escobar", "Escobar")
+	folders := configDirs.QueryFolders(configdir.System)
+	return folders[0].WriteFile(settingsFile, b)
+}
@@ -113,5 +113,277 @@ func TestParse(t *testing.T) {
 			assert.Equal(t, "https://www.google.com/", config.Proxy.PingURL.String())
 			assert.Equal(t, proxy.ManualMode, config.Proxy.Mode)
 		})
+
+		t.Run("socks5 downstream proxy", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "socks5h://10.0.0.1:1080",
+				"-m", "basic",
+				"-u", "ivanovii",
+				"-p", "Qwerty123",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			assert.True(t, config.Proxy.IsSOCKS())
+			assert.Equal(t, "10.0.0.1:1080", config.Proxy.DownstreamProxyAddr())
+		})
+
+		t.Run("routing", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.routing.upstream", "github=http://gw.evil.corp:8080;user=ivanovii;password=Qwerty123",
+				"--proxy.routing.rule", "domain=*.github.com;action=github",
+				"--proxy.routing.rule", "cidr=10.0.0.0/8;action=DIRECT",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			require.Len(t, config.Proxy.Routing.Rules, 2)
+			assert.Equal(t, "gw.evil.corp:8080", config.Proxy.Routing.Rules[0].Upstream.Addr())
+			assert.Equal(t, proxy.DirectAction, config.Proxy.Routing.Rules[1].Action)
+		})
+
+		t.Run("header rules", func(t *testing.T) {
+			// Values could contain spaces, so rules are newline-separated
+			t.Setenv("ESCOBAR_PROXY_HEADERS_RULES", "domain=*.evil.corp;action=set;header=user-agent;value=Mozilla/5.0 (X11; Linux x86_64)\naction=remove;header=X-Forwarded-For")
+
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			require.Len(t, config.Proxy.Headers.Rules, 2)
+			assert.Equal(t, "User-Agent", config.Proxy.Headers.Rules[0].Header)
+			assert.Equal(t, "Mozilla/5.0 (X11; Linux x86_64)", config.Proxy.Headers.Rules[0].Value)
+			assert.Equal(t, proxy.RemoveHeader, config.Proxy.Headers.Rules[1].Action)
+		})
+
+		t.Run("proxy chain", func(t *testing.T) {
+			t.Setenv("ESCOBAR_TEST_PARTNER_PASSWORD", "Partner123")
+
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.chain", "http://partner.corp:8080;user=partner;password=env:ESCOBAR_TEST_PARTNER_PASSWORD",
+				"--proxy.chain", "http://10.0.0.3",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			require.Len(t, config.Proxy.Chain, 2)
+			assert.Equal(t, proxy.BasicMode, config.Proxy.Chain[0].Mode)
+			assert.Equal(t, "partner", config.Proxy.Chain[0].User)
+			assert.Equal(t, "Partner123", config.Proxy.Chain[0].Password)
+			assert.Equal(t, proxy.AutoMode, config.Proxy.Chain[1].Mode)
+			assert.Equal(t, "10.0.0.3:80", config.Proxy.Chain[1].Addr())
+		})
+
+		t.Run("password reference", func(t *testing.T) {
+			t.Setenv("ESCOBAR_TEST_PASSWORD", "Qwerty123")
+
+			os.Args = []string{
+				"./escobar",
+				"--proxy.downstream-proxy-url", "http://10.0.0.1:9090",
+				"--proxy.downstream-proxy-auth.user", "ivanovii",
+				"--proxy.downstream-proxy-auth.password", "env:ESCOBAR_TEST_PASSWORD",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			assert.Equal(t, "env:ESCOBAR_TEST_PASSWORD", config.Proxy.DownstreamProxyAuth.PasswordString)
+			assert.Equal(t, "Qwerty123", config.Proxy.DownstreamProxyAuth.Password)
+		})
+
+		t.Run("default command", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"--proxy.downstream-proxy-url", "http://10.0.0.1:9090",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			assert.Equal(t, RunCommand, config.Command)
+		})
+
+		t.Run("install command", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"install",
+				"--user", "escobar",
+				"--config-path", "/etc/escobar/settings.json",
+				"--proxy.downstream-proxy-url", "http://10.0.0.1:9090",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			assert.Equal(t, InstallCommand, config.Command)
+			assert.Equal(t, "escobar", config.Install.User)
+			assert.Equal(t, "/etc/escobar/settings.json", config.Install.ConfigPath)
+			assert.Equal(t, "http://10.0.0.1:9090", config.Proxy.DownstreamProxyURL.String())
+		})
+
+		t.Run("status command does not require proxy args", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"status",
+			}
+
+			config, err := Parse()
+			require.NoError(t, err)
+
+			assert.Equal(t, StatusCommand, config.Command)
+		})
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		t.Run("unknown command", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"unknown",
+			}
+
+			_, err := Parse()
+			assert.Error(t, err)
+		})
+
+		t.Run("run command requires downstream proxy", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"run",
+			}
+
+			_, err := Parse()
+			assert.Error(t, err)
+		})
+
+		t.Run("unsupported downstream proxy scheme", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "ftp://10.0.0.1:9090",
+			}
+
+			_, err := Parse()
+			assert.Error(t, err)
+		})
+
+		t.Run("socks5 downstream proxy does not support kerberos", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "socks5h://10.0.0.1:1080",
+				"-m", "manual",
+				"-u", "ivanovii",
+				"-p", "Qwerty123",
+				"--proxy.kerberos.realm", "EVIL.CORP",
+				"--proxy.kerberos.kdc", "10.0.0.1:88",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "manual mode is not supported with SOCKS5 downstream proxy")
+		})
+
+		t.Run("proxy chain hop in another kerberos mode", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.chain", "http://partner.corp:8080;mode=manual",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "chain proxy partner.corp:8080: manual mode requires escobar to run in the same mode")
+		})
+
+		t.Run("routing rule with unknown upstream", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.routing.rule", "domain=*.github.com;action=github",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, `cannot set up routing: rule "domain=*.github.com;action=github" refers to unknown upstream github`)
+		})
+
+		t.Run("header rule rewriting proxy authorization", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.headers.rule", "action=remove;header=proxy-authorization",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "cannot set up header rules: header Proxy-Authorization cannot be rewritten")
+		})
+
+		t.Run("cache in gateway mode", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"-m", "gateway",
+				"--proxy.kerberos.realm", "EVIL.CORP",
+				"--proxy.kerberos.kdc", "10.0.0.1:88",
+				"--proxy.cache.dir", t.TempDir(),
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "cache is not supported in gateway mode")
+		})
+
+		t.Run("proxy chain with socks5 downstream proxy", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "socks5h://10.0.0.1:1080",
+				"--proxy.chain", "http://partner.corp:8080",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "proxy chain is not supported with SOCKS5 downstream proxy")
+		})
+
+		t.Run("TLS listener without private key", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.tls.addr", "localhost:3130",
+				"--proxy.tls.cert", "/etc/escobar/proxy.pem",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "cannot set up TLS listener: both server certificate and private key are required")
+		})
+
+		t.Run("TLS interception without CA private key", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.mitm.domain", "jira.evil.corp",
+				"--proxy.mitm.ca-cert", "/etc/escobar/mitm-ca.pem",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "cannot set up TLS interception: both root CA certificate and private key are required")
+		})
+
+		t.Run("cache without size", func(t *testing.T) {
+			os.Args = []string{
+				"./escobar",
+				"-d", "http://10.0.0.1:9090",
+				"--proxy.cache.dir", t.TempDir(),
+				"--proxy.cache.size", "0",
+			}
+
+			_, err := Parse()
+			assert.EqualError(t, err, "cannot set up cache: cache size must be positive")
+		})
 	})
 }
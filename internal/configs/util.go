@@ -7,14 +7,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/L11R/escobar/internal/proxy"
+	"github.com/L11R/escobar/internal/secrets"
 )
 
 func (c *Config) CheckCredentials() error {
 	// Check keytab directory and file rights, it MUST NOT be too permissive
-	if c.Proxy.DownstreamProxyAuth.Keytab != "" {
-		dirInfo, err := os.Stat(filepath.Dir(c.Proxy.DownstreamProxyAuth.Keytab))
+	if path := keytabPath(c.Proxy.DownstreamProxyAuth.KeytabString); path != "" {
+		dirInfo, err := os.Stat(filepath.Dir(path))
 		if err != nil {
 			return fmt.Errorf("cannot get dir stats: %w", err)
 		}
@@ -23,7 +25,7 @@ func (c *Config) CheckCredentials() error {
 			return fmt.Errorf("keytab directory rights are too permissive")
 		}
 
-		fileInfo, err := os.Stat(c.Proxy.DownstreamProxyAuth.Keytab)
+		fileInfo, err := os.Stat(path)
 		if err != nil {
 			return fmt.Errorf("cannot get file stats: %w", err)
 		}
@@ -37,9 +39,21 @@ func (c *Config) CheckCredentials() error {
 		return nil
 	}
 
-	if c.Proxy.DownstreamProxyAuth.Password != "" || c.Proxy.DownstreamProxyAuth.Keytab != "" {
+	if c.Proxy.DownstreamProxyAuth.PasswordString != "" || c.Proxy.DownstreamProxyAuth.KeytabString != "" {
 		return nil
 	}
 
 	return fmt.Errorf("you should pass path keytab-file or at least password")
 }
+
+// keytabPath returns path to keytab-file if it's passed as plain path or file reference.
+func keytabPath(keytab string) string {
+	if strings.HasPrefix(keytab, secrets.FilePrefix) {
+		return strings.TrimPrefix(keytab, secrets.FilePrefix)
+	}
+	if secrets.IsReference(keytab) {
+		return ""
+	}
+
+	return keytab
+}
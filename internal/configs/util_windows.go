@@ -14,7 +14,7 @@ func (c *Config) CheckCredentials() error {
 		return nil
 	}
 
-	if c.Proxy.DownstreamProxyAuth.Password != "" || c.Proxy.DownstreamProxyAuth.Keytab != "" {
+	if c.Proxy.DownstreamProxyAuth.PasswordString != "" || c.Proxy.DownstreamProxyAuth.KeytabString != "" {
 		return nil
 	}
 
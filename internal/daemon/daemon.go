@@ -5,139 +5,166 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/L11R/escobar/internal/configs"
+	"github.com/L11R/escobar/internal/doctor"
+	"github.com/L11R/escobar/internal/logging"
 	"github.com/L11R/escobar/internal/proxy"
+	"github.com/L11R/escobar/internal/sockets"
 	"github.com/L11R/escobar/internal/static"
 	"github.com/jcmturner/gokrb5/v8/client"
 	krb5config "github.com/jcmturner/gokrb5/v8/config"
-	"github.com/jcmturner/gokrb5/v8/keytab"
-	"github.com/jessevdk/go-flags"
 	"github.com/kardianos/service"
-	"github.com/shibukawa/configdir"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// Names of listeners passed to new process on upgrade
+const (
+	proxyListener     = "proxy"
+	proxyUnixListener = "proxy-unix"
+	staticListener    = "static"
+	proxyTLSListener  = "proxy-tls"
+)
+
 type Daemon struct {
 	SystemLogger service.Logger
 
 	logger *zap.Logger
-	config *configs.Config
+	// closeLog stops log file rotation and closes the file
+	closeLog func() error
+	config   *configs.Config
 
 	proxy  *proxy.Proxy
 	static *static.Static
+
+	// listeners are passed to new process on upgrade
+	listeners map[string]net.Listener
+	// upgraded is true if listeners were inherited from previous process
+	upgraded bool
+	// handedOff is set once listeners are passed to new process, which is tracked by service manager from now on
+	handedOff int32
 }
 
-func New() *Daemon {
-	return &Daemon{}
+func New(config *configs.Config) *Daemon {
+	return &Daemon{
+		config:    config,
+		listeners: make(map[string]net.Listener),
+	}
 }
 
 func (d *Daemon) Start(svc service.Service) error {
-	go d.run(svc)
+	if err := d.init(svc); err != nil {
+		return err
+	}
+
+	go d.run()
 	return nil
 }
 
-func (d *Daemon) run(svc service.Service) {
-	// Parse command line arguments, environment variables or from config file
-	config, err := configs.Parse()
-	if err != nil {
-		if err, ok := err.(*flags.Error); ok {
-			fmt.Println(err)
-			os.Exit(0)
-		}
-
-		fmt.Printf("Invalid args: %v\n", err)
-		os.Exit(1)
-	}
-	d.config = config
-
-	// Init loggers
-	enabler := zapcore.ErrorLevel
-	if len(config.Verbose) != 0 && config.Verbose[0] {
-		enabler = zapcore.DebugLevel
-	}
-	loggers := []zapcore.Core{
-		zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(os.Stdout), enabler),
-	}
+// init creates loggers, proxy and static servers.
+func (d *Daemon) init(svc service.Service) error {
+	config := d.config
 
 	// Attach system logger if enabled
+	var syslog zapcore.WriteSyncer
 	syslogErrChan := make(chan error, 1)
 	if config.UseSystemLogger {
 		sysLogger, err := svc.SystemLogger(syslogErrChan)
 		if err != nil {
-			log.Fatalln(err)
+			return fmt.Errorf("cannot create system logger: %w", err)
 		}
 		d.SystemLogger = sysLogger
-
-		loggers = append(
-			loggers,
-			zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(d), enabler),
-		)
+		syslog = zapcore.AddSync(d)
 	} else {
 		close(syslogErrChan)
 	}
-	logger := zap.New(zapcore.NewTee(loggers...))
-	d.logger = logger
+
+	// Init loggers, the previous log file is closed if service is started again
+	logger, closeLog, err := logging.New(config.Log, len(config.Verbose) != 0 && config.Verbose[0], syslog)
+	if err != nil {
+		return fmt.Errorf("cannot create logger: %w", err)
+	}
+	d.closeLogFile()
+	d.logger, d.closeLog = logger.Named(logging.DaemonSubsystem), closeLog
 	go func() {
 		for err := range syslogErrChan {
-			logger.Error("Error from system logger received", zap.Error(err))
+			d.logger.Error("Error from system logger received", zap.Error(err))
 		}
 	}()
 
 	var krb5cl *client.Client
 	if config.Proxy.Mode == proxy.ManualMode {
-		krb5cl, err = d.initKrb5()
+		krb5cl, err = d.initKrb5(config.Proxy.DownstreamProxyAuth)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 	}
 
-	p := proxy.NewProxy(logger, config.Proxy, krb5cl)
-	d.proxy = p
-	s := static.NewStatic(logger, config.Static, config.Proxy)
-	d.static = s
+	d.proxy = proxy.NewProxy(logger.Named(logging.ProxySubsystem), config.Proxy, krb5cl)
+	if err := d.proxy.LoadPolicy(); err != nil {
+		return err
+	}
+	d.static = static.NewStatic(logger.Named(logging.StaticSubsystem), config.Static, config.Proxy, d.proxy)
 
-	if config.Install {
-		b, _ := json.MarshalIndent(config, "", "\t")
+	return nil
+}
 
-		configDirs := configdir.New("Escobar", "Escobar")
-		folders := configDirs.QueryFolders(configdir.System)
-		if err := folders[0].WriteFile("settings.json", b); err != nil {
-			logger.Error("Error while trying to save config!", zap.Error(err))
-		}
+func (d *Daemon) run() {
+	config := d.config
+	logger := d.logger
+	p := d.proxy
+	s := d.static
 
-		if err := svc.Install(); err != nil {
-			logger.Error("Error while trying to install service!", zap.Error(err))
-		}
-		return
+	activated, err := sockets.Activated(d.listenerNames()...)
+	if err != nil {
+		logger.Fatal("Cannot use socket activated listeners!", zap.Error(err))
 	}
-	if config.Uninstall {
-		if err := svc.Uninstall(); err != nil {
-			logger.Error("Error while trying to uninstall service!", zap.Error(err))
-		}
-		return
+
+	listeners, err := d.listenProxy(activated)
+	if err != nil {
+		logger.Fatal("Cannot listen socket!", zap.Error(err))
 	}
 
-	l, err := p.Listen()
+	sl, err := d.listen(staticListener, activated[staticListener], s.Listen)
 	if err != nil {
 		logger.Fatal("Cannot listen socket!", zap.Error(err))
 	}
 
 	errChan := make(chan error, 1)
 
-	go func() {
-		errChan <- p.Serve(l)
-	}()
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errChan <- p.Serve(l)
+		}(l)
+	}
 
 	go func() {
-		errChan <- s.ListenAndServe()
+		errChan <- s.Serve(sl)
 	}()
 
+	// Service manager should track us before previous process exits
+	if d.upgraded {
+		d.notify("MAINPID=" + strconv.Itoa(os.Getpid()))
+	}
+	// Previous process could stop now if we were started by upgrade
+	if err := sockets.Ready(); err != nil {
+		logger.Error("Cannot notify previous process!", zap.Error(err))
+	}
+
 	go func() {
+		// Every user has own credentials in gateway mode
+		if config.Proxy.Mode == proxy.GatewayMode {
+			d.notifyReady("Serving in gateway mode")
+			return
+		}
+
 		// Check auth against out real server
 		ok, err := p.CheckAuth()
 		if err != nil {
@@ -147,15 +174,25 @@ func (d *Daemon) run(svc service.Service) {
 				zap.Error(err),
 			)
 
+			d.notify("STATUS=Cannot check downstream proxy: " + err.Error())
 			errChan <- err
 			return
 		}
 
 		if !ok {
+			d.notify("STATUS=Provided credentials for downstream proxy are invalid")
 			errChan <- errors.New("provided credentials for downstream proxy are invalid")
+			return
 		}
+
+		d.notifyReady("Credentials are valid, serving")
 	}()
 
+	// Resolve secrets again on demand
+	d.watchReload()
+	// Pass listeners to new binary on demand
+	d.watchUpgrade()
+
 	go func() {
 		if err := <-errChan; err != nil {
 			logger.Error("Error while running proxy!", zap.Error(err))
@@ -166,12 +203,205 @@ func (d *Daemon) run(svc service.Service) {
 	}()
 }
 
+// listenProxy returns proxy listeners on TCP address, unix socket or both.
+func (d *Daemon) listenProxy(activated map[string]net.Listener) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if d.config.Proxy.Addr != nil {
+		l, err := d.listen(proxyListener, activated[proxyListener], d.proxy.Listen)
+		if err != nil {
+			return nil, err
+		}
+		// Passed listener could have another address, it's used by credentials check and PAC
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			d.config.Proxy.Addr = addr
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	for i := range d.config.Proxy.Listeners {
+		listener := &d.config.Proxy.Listeners[i]
+
+		name := additionalListener(i)
+		l, err := d.listen(name, activated[name], func() (net.Listener, error) {
+			return d.proxy.ListenTCP(listener.Addr)
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Listener ACL and PAC are looked up by actual address
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			listener.Addr = addr
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if d.config.Proxy.TLS.Addr != nil {
+		l, err := d.listen(proxyTLSListener, activated[proxyTLSListener], d.proxy.ListenTLS)
+		if err != nil {
+			return nil, err
+		}
+		// TLS is served on listener by its actual address
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			d.config.Proxy.TLS.Addr = addr
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if d.config.Proxy.Unix.Path != "" {
+		l, err := d.listen(proxyUnixListener, activated[proxyUnixListener], d.proxy.ListenUnix)
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// listenerNames returns names of all listeners in order, unnamed socket activated ones are assigned by it.
+func (d *Daemon) listenerNames() []string {
+	names := []string{proxyListener}
+	for i := range d.config.Proxy.Listeners {
+		names = append(names, additionalListener(i))
+	}
+
+	// TLS listener goes last, so names of socket activated ones stay the same
+	return append(names, proxyUnixListener, staticListener, proxyTLSListener)
+}
+
+// additionalListener returns name of additional proxy listener, e.g. proxy-1.
+func additionalListener(i int) string {
+	return proxyListener + "-" + strconv.Itoa(i+1)
+}
+
+// listen returns listener inherited from previous process, socket activated or a new one.
+func (d *Daemon) listen(name string, activated net.Listener, listen func() (net.Listener, error)) (net.Listener, error) {
+	l, err := sockets.Inherited(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case l != nil:
+		d.logger.Info("Using inherited listener", zap.String("name", name), zap.String("address", l.Addr().String()))
+		d.upgraded = true
+	case activated != nil:
+		d.logger.Info("Using socket activated listener", zap.String("name", name), zap.String("address", activated.Addr().String()))
+		l = activated
+	default:
+		l, err = listen()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.listeners[name] = l
+	return l, nil
+}
+
+// notify sends state to service manager, e.g. systemd with Type=notify.
+func (d *Daemon) notify(state string) {
+	if err := sockets.Notify(state); err != nil {
+		d.logger.Error("Cannot notify service manager!", zap.Error(err))
+	}
+}
+
+// notifyReady reports readiness to service manager and starts pinging its watchdog.
+func (d *Daemon) notifyReady(status string) {
+	d.notify("READY=1\nSTATUS=" + status)
+
+	interval, err := sockets.WatchdogInterval()
+	if err != nil {
+		d.logger.Error("Cannot get watchdog interval!", zap.Error(err))
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			d.notify("WATCHDOG=1")
+		}
+	}()
+}
+
+// Check starts proxy, checks credentials against ping URL once and stops it.
+func (d *Daemon) Check(svc service.Service) (bool, error) {
+	if err := d.init(svc); err != nil {
+		return false, err
+	}
+
+	return d.check()
+}
+
+// Doctor runs diagnostic steps and prints pass/fail report into w.
+func (d *Daemon) Doctor(svc service.Service, w io.Writer) (bool, error) {
+	if err := d.init(svc); err != nil {
+		return false, err
+	}
+
+	newKrb5 := func() (*client.Client, error) {
+		return d.initKrb5(d.config.Proxy.DownstreamProxyAuth)
+	}
+
+	return doctor.New(w, d.config.Proxy, newKrb5, d.check).Run(), nil
+}
+
+func (d *Daemon) check() (bool, error) {
+	listeners, err := d.listenProxy(nil)
+	if err != nil {
+		return false, fmt.Errorf("cannot listen socket: %w", err)
+	}
+
+	errChan := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errChan <- d.proxy.Serve(l)
+		}(l)
+	}
+
+	ok, err := d.proxy.CheckAuth()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := d.proxy.Shutdown(ctx); err != nil {
+		return false, fmt.Errorf("error while shutting down the proxy server: %w", err)
+	}
+	for range listeners {
+		if err := <-errChan; err != nil {
+			return false, err
+		}
+	}
+
+	return ok, err
+}
+
 // Stop shutdowns proxy and static server
 func (d *Daemon) Stop(_ service.Service) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	// Nothing to stop, daemon failed to start
+	if d.proxy == nil || d.static == nil {
+		return nil
+	}
+
+	// Tunnels have own grace period to finish
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute+d.config.Proxy.Timeouts.Server.DrainTimeout)
 	defer cancel()
 
 	d.logger.Info("Stopping proxy...")
+	// Service is still running in new process after upgrade
+	if atomic.LoadInt32(&d.handedOff) == 0 {
+		d.notify("STOPPING=1")
+	}
 
 	// Close static server first, it shouldn't have many open connections
 	if err := d.static.Shutdown(ctx); err != nil {
@@ -183,9 +413,24 @@ func (d *Daemon) Stop(_ service.Service) error {
 	}
 
 	d.logger.Info("Proxy stopped")
+	d.closeLogFile()
 	return nil
 }
 
+// closeLogFile flushes logger and closes its file if there is one.
+func (d *Daemon) closeLogFile() {
+	if d.closeLog == nil {
+		return
+	}
+
+	// nolint:errcheck
+	d.logger.Sync()
+	if err := d.closeLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot close log file: %v\n", err)
+	}
+	d.closeLog = nil
+}
+
 // Write implements io.Writer to create zap encoder
 func (d *Daemon) Write(b []byte) (int, error) {
 	var entry struct {
@@ -207,8 +452,33 @@ func (d *Daemon) Write(b []byte) (int, error) {
 	}
 }
 
+// reload resolves downstream proxy credentials again and passes them to the proxy.
+func (d *Daemon) reload() error {
+	d.logger.Info("Reloading credentials...")
+
+	// Copy credentials, the proxy still uses current ones
+	auth := d.config.Proxy.DownstreamProxyAuth
+	if err := auth.Resolve(); err != nil {
+		return fmt.Errorf("cannot resolve downstream proxy credentials: %w", err)
+	}
+
+	var krb5cl *client.Client
+	if d.config.Proxy.Mode == proxy.ManualMode {
+		var err error
+		krb5cl, err = d.initKrb5(auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.proxy.SetCredentials(auth, krb5cl)
+
+	d.logger.Info("Credentials reloaded")
+	return nil
+}
+
 // initKrb5 creates Kerberos client with user credentials if we are using Linux, macOS or something else.
-func (d *Daemon) initKrb5() (*client.Client, error) {
+func (d *Daemon) initKrb5(auth proxy.DownstreamProxyAuth) (*client.Client, error) {
 	// Create Kerberos configuration for client
 	r, err := d.config.Proxy.Kerberos.Reader()
 	if err != nil {
@@ -220,25 +490,20 @@ func (d *Daemon) initKrb5() (*client.Client, error) {
 		return nil, fmt.Errorf("cannot read Kerberos config: %w", err)
 	}
 
-	if d.config.Proxy.DownstreamProxyAuth.Keytab != "" {
-		kt, err := keytab.Load(d.config.Proxy.DownstreamProxyAuth.Keytab)
-		if err != nil {
-			return nil, fmt.Errorf("cannot read Keytab-file: %w", err)
-		}
-
+	if auth.Keytab != nil {
 		return client.NewWithKeytab(
-			d.config.Proxy.DownstreamProxyAuth.User,
+			auth.User,
 			d.config.Proxy.Kerberos.Realm,
-			kt,
+			auth.Keytab,
 			kbr5conf,
 			client.DisablePAFXFAST(true),
 		), nil
 	}
 
 	return client.NewWithPassword(
-		d.config.Proxy.DownstreamProxyAuth.User,
+		auth.User,
 		d.config.Proxy.Kerberos.Realm,
-		d.config.Proxy.DownstreamProxyAuth.Password,
+		auth.Password,
 		kbr5conf,
 		client.DisablePAFXFAST(true),
 	), nil
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// watchReload reloads credentials on SIGHUP.
+func (d *Daemon) watchReload() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			if err := d.reload(); err != nil {
+				d.logger.Error("Error while reloading credentials!", zap.Error(err))
+			}
+		}
+	}()
+}
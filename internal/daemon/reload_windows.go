@@ -0,0 +1,7 @@
+//go:build windows
+// +build windows
+
+package daemon
+
+// watchReload does nothing, Windows has no SIGHUP; restart the service to resolve secrets again.
+func (d *Daemon) watchReload() {}
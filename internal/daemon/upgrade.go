@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/L11R/escobar/internal/sockets"
+	"go.uber.org/zap"
+)
+
+const (
+	// upgradeTimeout is how long new process is given to start serving
+	upgradeTimeout = time.Minute
+	// handoffDelay is how long connections accepted before listeners were closed are given to send request,
+	// http.Server drops the ones without request on shutdown
+	handoffDelay = time.Second
+)
+
+// watchUpgrade starts new binary on SIGUSR2 passing listening sockets to it, then stops as usual draining tunnels.
+func (d *Daemon) watchUpgrade() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+
+	go func() {
+		for range sigChan {
+			if err := d.upgrade(); err != nil {
+				d.logger.Error("Error while upgrading!", zap.Error(err))
+				continue
+			}
+
+			signal.Stop(sigChan)
+			// Service runner stops daemon on SIGTERM
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				d.logger.Error("Cannot stop after upgrade!", zap.Error(err))
+			}
+			return
+		}
+	}()
+}
+
+func (d *Daemon) upgrade() error {
+	d.logger.Info("Upgrading...")
+
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot get executable path: %w", err)
+	}
+
+	process, err := sockets.Spawn(path, os.Args[1:], d.listeners, upgradeTimeout)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Info("New process is serving, draining tunnels", zap.Int("pid", process.Pid))
+	atomic.StoreInt32(&d.handedOff, 1)
+
+	// Stop accepting, sockets stay open in new process which gets all connections from now on
+	for name, l := range d.listeners {
+		// Socket file is used by new process
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		if err := l.Close(); err != nil {
+			d.logger.Error("Cannot close listener", zap.String("name", name), zap.Error(err))
+		}
+	}
+	time.Sleep(handoffDelay)
+
+	return process.Release()
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package daemon
+
+// watchUpgrade does nothing, listeners handoff is supported on Linux only.
+func (d *Daemon) watchUpgrade() {}
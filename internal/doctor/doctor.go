@@ -0,0 +1,445 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/L11R/escobar/internal/proxy"
+	gospnego "github.com/L11R/go-spnego"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusFail Status = "FAIL"
+	StatusSkip Status = "SKIP"
+)
+
+// Doctor diagnoses config, downstream proxy and Kerberos setup step by step.
+type Doctor struct {
+	w         io.Writer
+	config    *proxy.Config
+	newKrb5   func() (*client.Client, error)
+	checkAuth func() (bool, error)
+
+	// State shared between steps
+	proxyReachable bool
+	krb5cl         *client.Client
+	failed         bool
+}
+
+type step struct {
+	name string
+	run  func() (Status, []string, error)
+}
+
+// New returns Doctor instance. newKrb5 creates Kerberos client in manual mode,
+// checkAuth checks credentials against ping URL through the local proxy.
+func New(w io.Writer, config *proxy.Config, newKrb5 func() (*client.Client, error), checkAuth func() (bool, error)) *Doctor {
+	return &Doctor{
+		w:         w,
+		config:    config,
+		newKrb5:   newKrb5,
+		checkAuth: checkAuth,
+	}
+}
+
+// Run runs all steps, prints the report and returns true if none of the steps failed.
+func (d *Doctor) Run() bool {
+	steps := []step{
+		{name: "Validate config", run: d.validateConfig},
+		{name: "Resolve and dial downstream proxy", run: d.dialProxy},
+		{name: "Fetch offered authentication schemes", run: d.authSchemes},
+		{name: "Check KDC reachability", run: d.dialKDC},
+		{name: "Load keytab", run: d.loadKeytab},
+		{name: "Attempt AS exchange", run: d.asExchange},
+		{name: "Obtain service ticket", run: d.serviceTicket},
+		{name: "Check credentials against ping URL", run: d.pingURL},
+	}
+
+	for i, s := range steps {
+		status, details, err := s.run()
+		d.report(i+1, s.name, status, details, err)
+	}
+
+	if d.krb5cl != nil {
+		d.krb5cl.Destroy()
+	}
+
+	return !d.failed
+}
+
+func (d *Doctor) report(n int, name string, status Status, details []string, err error) {
+	if status == StatusFail {
+		d.failed = true
+	}
+
+	line := fmt.Sprintf("[%s] %d. %s", status, n, name)
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	fmt.Fprintln(d.w, line)
+
+	for _, detail := range details {
+		fmt.Fprintln(d.w, "       "+detail)
+	}
+}
+
+func (d *Doctor) validateConfig() (Status, []string, error) {
+	c := d.config
+	details := []string{
+		"mode: " + string(c.Mode),
+		"downstream proxy: " + c.DownstreamProxyURL.Redacted(),
+		"ping URL: " + c.PingURL.String(),
+	}
+	if c.TLS.Addr != nil {
+		tlsListener := "TLS listener: " + c.TLS.Addr.String()
+		if c.TLS.HTTP2 {
+			tlsListener += " (HTTP/2)"
+		}
+		if c.TLS.CertString == "" {
+			tlsListener += " (self-signed)"
+		}
+		if c.TLS.ClientCAString != "" {
+			tlsListener += " (client certificates)"
+		}
+		details = append(details, tlsListener)
+	}
+	for _, hop := range c.Chain {
+		details = append(details, "chain proxy: "+hop.URL.Redacted()+" ("+string(hop.Mode)+")")
+	}
+	names := make([]string, 0, len(c.Routing.Upstreams))
+	for name := range c.Routing.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		upstream := c.Routing.Upstreams[name]
+		details = append(details, "upstream "+name+": "+upstream.URL.Redacted()+" ("+string(upstream.Mode)+")")
+	}
+	if len(c.Routing.Rules) != 0 {
+		details = append(details, fmt.Sprintf("routing rules: %d", len(c.Routing.Rules)))
+	}
+	if len(c.Headers.Rules) != 0 {
+		details = append(details, fmt.Sprintf("header rules: %d", len(c.Headers.Rules)))
+	}
+	if c.Cache.Dir != "" {
+		details = append(details, fmt.Sprintf("cache: %s, %d MB", c.Cache.Dir, c.Cache.Size))
+	}
+	if c.MITM.CA != nil {
+		details = append(details, "TLS interception: "+strings.Join(c.MITM.DomainStrings, ", "))
+	}
+
+	switch c.DownstreamProxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return StatusFail, details, fmt.Errorf("unsupported downstream proxy scheme %q", c.DownstreamProxyURL.Scheme)
+	}
+	if c.PingURL.Scheme != "http" && c.PingURL.Scheme != "https" {
+		return StatusFail, details, fmt.Errorf("unsupported ping URL scheme %q", c.PingURL.Scheme)
+	}
+
+	switch c.Mode {
+	case proxy.AutoMode:
+	case proxy.ManualMode:
+		details = append(details, "principal: "+c.DownstreamProxyAuth.User+"@"+c.Kerberos.Realm)
+		if c.DownstreamProxyAuth.User == "" || c.Kerberos.Realm == "" || c.Kerberos.KDC == nil {
+			return StatusFail, details, errors.New("manual mode requires user, realm and KDC")
+		}
+		if c.DownstreamProxyAuth.Password == "" && c.DownstreamProxyAuth.Keytab == nil {
+			return StatusFail, details, errors.New("manual mode requires keytab-file or password")
+		}
+	case proxy.GatewayMode:
+		if c.Kerberos.Realm == "" || c.Kerberos.KDC == nil {
+			return StatusFail, details, errors.New("gateway mode requires realm and KDC")
+		}
+	case proxy.BasicMode:
+		if c.DownstreamProxyAuth.User == "" || c.DownstreamProxyAuth.Password == "" {
+			return StatusFail, details, errors.New("basic mode requires user and password")
+		}
+	default:
+		return StatusFail, details, fmt.Errorf("unknown mode %q", c.Mode)
+	}
+
+	return StatusPass, details, nil
+}
+
+func (d *Doctor) dialProxy() (Status, []string, error) {
+	addrs, err := net.LookupHost(d.config.DownstreamProxyURL.Hostname())
+	if err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot resolve: %w", err)
+	}
+	details := []string{"resolved: " + strings.Join(addrs, ", ")}
+
+	conn, err := d.dialDownstreamProxy()
+	if err != nil {
+		return StatusFail, details, err
+	}
+	//noinspection ALL
+	defer conn.Close()
+
+	d.proxyReachable = true
+
+	details = append(details, "connected: "+conn.RemoteAddr().String())
+	if tconn, ok := conn.(*tls.Conn); ok {
+		state := tconn.ConnectionState()
+		details = append(details, "TLS: "+tls.VersionName(state.Version)+", certificate: "+state.PeerCertificates[0].Subject.String())
+	}
+
+	return StatusPass, details, nil
+}
+
+// dialDownstreamProxy connects to downstream proxy, TLS session is established with https:// one.
+func (d *Doctor) dialDownstreamProxy() (net.Conn, error) {
+	timeout := d.config.Timeouts.DownstreamProxy.DialTimeout
+
+	conn, err := net.DialTimeout("tcp", d.config.DownstreamProxyAddr(), timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial: %w", err)
+	}
+	if d.config.DownstreamProxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tconn, err := d.config.DownstreamProxyTLS.Client(ctx, conn)
+	if err != nil {
+		//noinspection ALL
+		conn.Close()
+		return nil, err
+	}
+
+	return tconn, nil
+}
+
+func (d *Doctor) authSchemes() (Status, []string, error) {
+	if !d.proxyReachable {
+		return StatusSkip, nil, errors.New("downstream proxy is unreachable")
+	}
+	if d.config.IsSOCKS() {
+		return StatusSkip, []string{"SOCKS5 proxy authenticates with username and password"}, nil
+	}
+
+	conn, err := d.dialDownstreamProxy()
+	if err != nil {
+		return StatusFail, nil, err
+	}
+	//noinspection ALL
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(time.Minute)); err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot set deadline: %w", err)
+	}
+
+	// Send request without credentials to get 407: plain HTTP ping URL is requested in absolute form, CONNECT is
+	// sent otherwise
+	req, err := http.NewRequest(http.MethodGet, d.config.PingURL.String(), nil)
+	if err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot create request: %w", err)
+	}
+	if d.config.PingURL.Scheme != "http" {
+		host := d.config.PingURL.Host
+		if d.config.PingURL.Port() == "" {
+			host = net.JoinHostPort(d.config.PingURL.Hostname(), "443")
+		}
+		req, err = http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		if err != nil {
+			return StatusFail, nil, fmt.Errorf("cannot create request: %w", err)
+		}
+		req.Host = host
+	}
+
+	write := req.WriteProxy
+	if req.Method == http.MethodConnect {
+		write = req.Write
+	}
+	if err := write(conn); err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot write request: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot read response: %w", err)
+	}
+	//noinspection ALL
+	resp.Body.Close()
+
+	details := []string{"response: " + resp.Status}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return StatusPass, append(details, "downstream proxy does not require authentication"), nil
+	case http.StatusProxyAuthRequired:
+	default:
+		return StatusFail, details, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	schemes := make(map[string]bool)
+	for _, v := range resp.Header.Values("Proxy-Authenticate") {
+		scheme := strings.Fields(v)
+		if len(scheme) == 0 {
+			continue
+		}
+
+		schemes[strings.ToLower(scheme[0])] = true
+		details = append(details, "offered: "+scheme[0])
+	}
+
+	required := "negotiate"
+	if d.config.Mode == proxy.BasicMode {
+		required = "basic"
+	}
+	if !schemes[required] {
+		return StatusFail, details, fmt.Errorf("%s scheme required by %s mode is not offered", required, d.config.Mode)
+	}
+
+	return StatusPass, details, nil
+}
+
+func (d *Doctor) dialKDC() (Status, []string, error) {
+	if d.config.Mode != proxy.ManualMode && d.config.Mode != proxy.GatewayMode {
+		return StatusSkip, []string{fmt.Sprintf("KDC is not used directly in %s mode", d.config.Mode)}, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", d.config.Kerberos.KDC.String(), d.config.Timeouts.DownstreamProxy.DialTimeout)
+	if err != nil {
+		return StatusFail, nil, fmt.Errorf("cannot dial: %w", err)
+	}
+	//noinspection ALL
+	defer conn.Close()
+
+	return StatusPass, []string{"connected: " + conn.RemoteAddr().String()}, nil
+}
+
+func (d *Doctor) loadKeytab() (Status, []string, error) {
+	kt := d.config.DownstreamProxyAuth.Keytab
+	if kt == nil {
+		return StatusSkip, []string{"keytab is not used"}, nil
+	}
+
+	if len(kt.Entries) == 0 {
+		return StatusFail, nil, errors.New("keytab is empty")
+	}
+
+	principal := d.config.DownstreamProxyAuth.User + "@" + d.config.Kerberos.Realm
+
+	var (
+		details []string
+		found   bool
+	)
+	for _, e := range kt.Entries {
+		name := e.Principal.String()
+		if name == principal {
+			found = true
+		}
+
+		details = append(details, fmt.Sprintf("%s kvno %d enctype %s", name, e.KVNO, etypeName(e.Key.KeyType)))
+	}
+
+	if d.config.Mode == proxy.ManualMode && !found {
+		return StatusFail, details, fmt.Errorf("keytab has no entries for %s", principal)
+	}
+
+	return StatusPass, details, nil
+}
+
+func (d *Doctor) asExchange() (Status, []string, error) {
+	if d.config.Mode != proxy.ManualMode {
+		return StatusSkip, []string{fmt.Sprintf("AS exchange is not done by escobar in %s mode", d.config.Mode)}, nil
+	}
+
+	cl, err := d.newKrb5()
+	if err != nil {
+		return StatusFail, nil, err
+	}
+
+	if err := cl.Login(); err != nil {
+		cl.Destroy()
+		return StatusFail, nil, err
+	}
+	d.krb5cl = cl
+
+	return StatusPass, []string{"TGT obtained for " + cl.Credentials.UserName() + "@" + cl.Credentials.Domain()}, nil
+}
+
+func (d *Doctor) serviceTicket() (Status, []string, error) {
+	spn := "HTTP/" + d.config.DownstreamProxyURL.Hostname()
+
+	switch d.config.Mode {
+	case proxy.AutoMode:
+		if _, err := gospnego.New().GetSPNEGOHeader(d.config.DownstreamProxyURL.Hostname()); err != nil {
+			return StatusFail, nil, err
+		}
+
+		return StatusPass, []string{"SPNEGO token for " + spn + " obtained from system credentials"}, nil
+	case proxy.ManualMode:
+		if d.krb5cl == nil {
+			return StatusSkip, nil, errors.New("AS exchange failed")
+		}
+
+		tkt, key, err := d.krb5cl.GetServiceTicket(spn)
+		if err != nil {
+			return StatusFail, nil, err
+		}
+
+		return StatusPass, []string{fmt.Sprintf("%s kvno %d enctype %s", spn, tkt.EncPart.KVNO, etypeName(key.KeyType))}, nil
+	}
+
+	return StatusSkip, []string{fmt.Sprintf("service ticket is not used in %s mode", d.config.Mode)}, nil
+}
+
+func (d *Doctor) pingURL() (Status, []string, error) {
+	if d.config.Mode == proxy.GatewayMode {
+		return StatusSkip, []string{"every user has own credentials in gateway mode"}, nil
+	}
+
+	ok, err := d.checkAuth()
+	if err != nil {
+		return StatusFail, nil, err
+	}
+	if !ok {
+		return StatusFail, nil, errors.New("provided credentials for downstream proxy are invalid")
+	}
+
+	return StatusPass, []string{d.config.PingURL.String() + " is reachable"}, nil
+}
+
+// etypeName returns the longest (the most descriptive) name of encryption type.
+func etypeName(id int32) string {
+	var names []string
+	for name, v := range etypeID.ETypesByName {
+		if v == id {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%d", id)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	return names[0]
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package doctor
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/L11R/escobar/internal/proxy"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConfig(t *testing.T, downstreamProxyURL string) *proxy.Config {
+	u, err := url.Parse(downstreamProxyURL)
+	require.NoError(t, err)
+	pingURL, _ := url.Parse("https://www.google.com/")
+
+	return &proxy.Config{
+		DownstreamProxyURL: u,
+		DownstreamProxyAuth: proxy.DownstreamProxyAuth{
+			User:     "ivanovii",
+			Password: "Qwerty123",
+		},
+		Kerberos: proxy.Kerberos{
+			Realm: "EVIL.CORP",
+		},
+		Timeouts: proxy.Timeouts{
+			DownstreamProxy: proxy.DownstreamProxyTimeouts{
+				DialTimeout: 10 * time.Second,
+			},
+		},
+		PingURL: pingURL,
+		Mode:    proxy.BasicMode,
+	}
+}
+
+func TestDoctor_authSchemes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Proxy-Authenticate", "Negotiate")
+		w.Header().Add("Proxy-Authenticate", `Basic realm="EVIL.CORP"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer srv.Close()
+
+	d := New(nil, newConfig(t, srv.URL), nil, nil)
+	d.proxyReachable = true
+
+	status, details, err := d.authSchemes()
+	require.NoError(t, err)
+	assert.Equal(t, StatusPass, status)
+	assert.Contains(t, details, "offered: Negotiate")
+	assert.Contains(t, details, "offered: Basic")
+}
+
+func TestDoctor_authSchemes_httpPingURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Plain HTTP ping URL is requested as is, not tunneled to port 443
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "http://www.google.com/", r.RequestURI)
+		w.Header().Add("Proxy-Authenticate", `Basic realm="EVIL.CORP"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer srv.Close()
+
+	config := newConfig(t, srv.URL)
+	config.PingURL, _ = url.Parse("http://www.google.com/")
+
+	d := New(nil, config, nil, nil)
+	d.proxyReachable = true
+
+	status, details, err := d.authSchemes()
+	require.NoError(t, err)
+	assert.Equal(t, StatusPass, status)
+	assert.Contains(t, details, "offered: Basic")
+}
+
+func TestDoctor_authSchemes_https(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Proxy-Authenticate", `Basic realm="EVIL.CORP"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer srv.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	config := newConfig(t, srv.URL)
+	config.DownstreamProxyTLS.CAString = caPath
+	require.NoError(t, config.DownstreamProxyTLS.Resolve(config.DownstreamProxyURL.Hostname()))
+
+	d := New(nil, config, nil, nil)
+
+	status, details, err := d.dialProxy()
+	require.NoError(t, err)
+	assert.Equal(t, StatusPass, status)
+	assert.Contains(t, details, "TLS: TLS 1.3, certificate: O=Acme Co")
+
+	status, details, err = d.authSchemes()
+	require.NoError(t, err)
+	assert.Equal(t, StatusPass, status)
+	assert.Contains(t, details, "offered: Basic")
+
+	// SOCKS5 proxy has no HTTP authentication schemes
+	d = New(nil, newConfig(t, "socks5://127.0.0.1:1080"), nil, nil)
+	d.proxyReachable = true
+
+	status, _, err = d.authSchemes()
+	require.NoError(t, err)
+	assert.Equal(t, StatusSkip, status)
+}
+
+func TestDoctor_loadKeytab(t *testing.T) {
+	d := New(nil, newConfig(t, "http://proxy.evil.corp:9090"), nil, nil)
+	d.config.Mode = proxy.ManualMode
+
+	t.Run("not used", func(t *testing.T) {
+		status, _, err := d.loadKeytab()
+		require.NoError(t, err)
+		assert.Equal(t, StatusSkip, status)
+	})
+
+	kt := keytab.New()
+	require.NoError(t, kt.AddEntry("ivanovii", "EVIL.CORP", "Qwerty123", time.Now(), 2, etypeID.AES256_CTS_HMAC_SHA1_96))
+	d.config.DownstreamProxyAuth.Keytab = kt
+
+	t.Run("found", func(t *testing.T) {
+		status, details, err := d.loadKeytab()
+		require.NoError(t, err)
+		assert.Equal(t, StatusPass, status)
+		assert.Equal(t, []string{"ivanovii@EVIL.CORP kvno 2 enctype aes256-cts-hmac-sha1-96"}, details)
+	})
+
+	d.config.DownstreamProxyAuth.User = "petrovpp"
+
+	t.Run("wrong principal", func(t *testing.T) {
+		status, _, err := d.loadKeytab()
+		assert.Error(t, err)
+		assert.Equal(t, StatusFail, status)
+	})
+}
+
+func TestDoctor_Run(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	w := bytes.NewBuffer(nil)
+	checkAuth := func() (bool, error) {
+		return true, nil
+	}
+
+	d := New(w, newConfig(t, "http://"+addr), nil, checkAuth)
+	assert.False(t, d.Run())
+
+	assert.Contains(t, w.String(), "[PASS] 1. Validate config")
+	assert.Contains(t, w.String(), "[FAIL] 2. Resolve and dial downstream proxy")
+	assert.Contains(t, w.String(), "[SKIP] 3. Fetch offered authentication schemes")
+	assert.Contains(t, w.String(), "[PASS] 8. Check credentials against ping URL")
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package logging
+
+import "time"
+
+type Format string
+
+const (
+	JSONFormat    Format = "json"
+	ConsoleFormat Format = "console"
+)
+
+// Subsystems which levels could be overridden
+const (
+	DaemonSubsystem = "daemon"
+	ProxySubsystem  = "proxy"
+	AuthSubsystem   = "auth"
+	StaticSubsystem = "static"
+)
+
+type Config struct {
+	Level  string            `long:"level" env:"LEVEL" description:"Log level" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"error" json:"level"`
+	Format Format            `long:"format" env:"FORMAT" description:"Log format" choice:"json" choice:"console" default:"json" json:"format"`
+	Levels map[string]string `long:"levels" env:"LEVELS" env-delim:"," description:"Per-subsystem log level (proxy, auth, static, daemon)" value-name:"proxy:debug" json:"levels"`
+
+	File FileConfig `group:"Log file" namespace:"file" env-namespace:"FILE" json:"file"`
+}
+
+type FileConfig struct {
+	Path           string        `long:"path" env:"PATH" description:"Log file path, logs are written to stdout if empty" json:"path"`
+	MaxSize        int           `long:"max-size" env:"MAX_SIZE" description:"Maximum log file size in megabytes before rotation" default:"100" json:"maxSize"`
+	MaxAge         int           `long:"max-age" env:"MAX_AGE" description:"Maximum number of days to retain rotated log files, 0 to retain all" default:"28" json:"maxAge"`
+	MaxBackups     int           `long:"max-backups" env:"MAX_BACKUPS" description:"Maximum number of rotated log files to retain, 0 to retain all" default:"7" json:"maxBackups"`
+	RotateInterval time.Duration `long:"rotate-interval" env:"ROTATE_INTERVAL" description:"Rotate log file periodically regardless of its size, 0 to disable" default:"24h" json:"rotateInterval"`
+	Compress       bool          `long:"compress" env:"COMPRESS" description:"Compress rotated log files" json:"compress"`
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// New returns logger writing into stdout or log file with rotation and function closing the file. If syslog is not
+// nil, entries are also written into it as JSON. Verbose forces debug level.
+func New(config *Config, verbose bool, syslog zapcore.WriteSyncer) (*zap.Logger, func() error, error) {
+	level, err := zapcore.ParseLevel(config.Level)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	if verbose {
+		level = zapcore.DebugLevel
+	}
+
+	levels := make(map[string]zapcore.Level, len(config.Levels))
+	for subsystem, l := range config.Levels {
+		levels[subsystem], err = zapcore.ParseLevel(l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s log level: %w", subsystem, err)
+		}
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+
+	var encoder zapcore.Encoder
+	switch config.Format {
+	case ConsoleFormat:
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+
+	out, closeOutput := output(&config.File)
+	cores := []zapcore.Core{
+		zapcore.NewCore(encoder, out, zapcore.DebugLevel),
+	}
+	// System logger parses level from JSON, so it always gets JSON
+	if syslog != nil {
+		cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), syslog, zapcore.DebugLevel))
+	}
+
+	return zap.New(newLevelCore(zapcore.NewTee(cores...), level, levels)), closeOutput, nil
+}
+
+// output returns stdout or log file rotated by size, age and interval, along with function which stops rotation and
+// closes the file.
+func output(config *FileConfig) (zapcore.WriteSyncer, func() error) {
+	if config.Path == "" {
+		return zapcore.AddSync(os.Stdout), func() error { return nil }
+	}
+
+	lj := &lumberjack.Logger{
+		Filename:   config.Path,
+		MaxSize:    config.MaxSize,
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+		LocalTime:  true,
+	}
+
+	done := make(chan struct{})
+	if config.RotateInterval > 0 {
+		ticker := time.NewTicker(config.RotateInterval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := lj.Rotate(); err != nil {
+						fmt.Fprintf(os.Stderr, "cannot rotate log file: %v\n", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var once sync.Once
+	return zapcore.AddSync(lj), func() error {
+		once.Do(func() {
+			close(done)
+		})
+		return lj.Close()
+	}
+}
+
+// levelCore filters entries by level of subsystem, which is taken from logger name (e.g. "proxy.auth").
+type levelCore struct {
+	zapcore.Core
+
+	level  zapcore.Level
+	levels map[string]zapcore.Level
+	min    zapcore.Level
+}
+
+func newLevelCore(core zapcore.Core, level zapcore.Level, levels map[string]zapcore.Level) *levelCore {
+	min := level
+	for _, l := range levels {
+		if l < min {
+			min = l
+		}
+	}
+
+	return &levelCore{
+		Core:   core,
+		level:  level,
+		levels: levels,
+		min:    min,
+	}
+}
+
+// Enabled returns true if any of subsystems has level enabled, the final decision is made by Check.
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return l >= c.min
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{
+		Core:   c.Core.With(fields),
+		level:  c.level,
+		levels: c.levels,
+		min:    c.min,
+	}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if e.Level < c.levelOf(e.LoggerName) {
+		return ce
+	}
+
+	return c.Core.Check(e, ce)
+}
+
+// levelOf returns level of the most specific subsystem mentioned in logger name.
+func (c *levelCore) levelOf(name string) zapcore.Level {
+	subsystems := strings.Split(name, ".")
+	for i := len(subsystems) - 1; i >= 0; i-- {
+		if l, ok := c.levels[subsystems[i]]; ok {
+			return l
+		}
+	}
+
+	return c.level
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLevelCore(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newLevelCore(core, zapcore.ErrorLevel, map[string]zapcore.Level{
+		ProxySubsystem: zapcore.InfoLevel,
+		AuthSubsystem:  zapcore.DebugLevel,
+	}))
+
+	logger.Named(DaemonSubsystem).Info("daemon info")
+	logger.Named(DaemonSubsystem).Error("daemon error")
+	logger.Named(ProxySubsystem).Debug("proxy debug")
+	logger.Named(ProxySubsystem).Info("proxy info")
+	logger.Named(ProxySubsystem).With(zap.String("uri", "www.google.com:443")).Info("proxy info with fields")
+	logger.Named(ProxySubsystem).Named(AuthSubsystem).Debug("auth debug")
+
+	var actual []string
+	for _, entry := range logs.All() {
+		actual = append(actual, entry.Message)
+	}
+
+	assert.Equal(t, []string{"daemon error", "proxy info", "proxy info with fields", "auth debug"}, actual)
+}
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "escobar.log")
+
+	logger, closeLog, err := New(&Config{
+		Level:  "info",
+		Format: ConsoleFormat,
+		Levels: map[string]string{StaticSubsystem: "error"},
+		File: FileConfig{
+			Path:           path,
+			MaxSize:        1,
+			RotateInterval: time.Hour,
+		},
+	}, false, nil)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, closeLog())
+	}()
+
+	logger.Named(ProxySubsystem).Info("Serving HTTP requests")
+	logger.Named(StaticSubsystem).Info("Listening and serving HTTP requests")
+	require.NoError(t, logger.Sync())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "Serving HTTP requests")
+	assert.NotContains(t, string(b), "Listening and serving HTTP requests")
+
+	_, _, err = New(&Config{Level: "info", Levels: map[string]string{ProxySubsystem: "verbose"}}, false, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// aclListener closes accepted connections which are not allowed by ACL before any request is parsed.
+type aclListener struct {
+	net.Listener
+
+	logger *zap.Logger
+	acl    *ACL
+}
+
+func newACLListener(l net.Listener, logger *zap.Logger, acl *ACL) net.Listener {
+	return &aclListener{
+		Listener: l,
+		logger:   logger,
+		acl:      acl,
+	}
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// ACL restricts only IP clients
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || l.acl.Allowed(addr.IP) {
+			return conn, nil
+		}
+
+		l.logger.Warn("Connection denied by ACL", zap.String("client_addr", addr.String()))
+		if err := conn.Close(); err != nil {
+			l.logger.Error("Cannot close connection", zap.Error(err))
+		}
+	}
+}
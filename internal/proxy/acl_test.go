@@ -0,0 +1,64 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestACL_Allowed(t *testing.T) {
+	acl := ACL{
+		AllowStrings: []string{"172.17.0.0/16", "::1"},
+		DenyStrings:  []string{"172.17.0.1"},
+	}
+	require.NoError(t, acl.Resolve())
+
+	assert.True(t, acl.Allowed(net.ParseIP("172.17.0.2")))
+	assert.True(t, acl.Allowed(net.ParseIP("::1")))
+	assert.False(t, acl.Allowed(net.ParseIP("172.17.0.1")))
+	assert.False(t, acl.Allowed(net.ParseIP("10.0.0.1")))
+
+	empty := ACL{}
+	require.NoError(t, empty.Resolve())
+	assert.True(t, empty.Empty())
+	assert.True(t, empty.Allowed(net.ParseIP("10.0.0.1")))
+
+	invalid := ACL{AllowStrings: []string{"172.17.0.0/33"}}
+	assert.Error(t, invalid.Resolve())
+}
+
+func Test_aclListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	acl := &ACL{DenyStrings: []string{"127.0.0.0/8"}}
+	require.NoError(t, acl.Resolve())
+
+	l = newACLListener(l, zap.NewNop(), acl)
+	defer l.Close()
+
+	go func() {
+		// Blocks forever, all connections are denied
+		// nolint:errcheck
+		l.Accept()
+	}()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+
+	// Connection should be closed by proxy
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -9,35 +9,90 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/L11R/escobar/internal/logging"
 	gospnego "github.com/L11R/go-spnego"
+	"github.com/jcmturner/gokrb5/v8/client"
 	"github.com/jcmturner/gokrb5/v8/spnego"
+	"go.uber.org/zap"
 )
 
 func (p *Proxy) setProxyAuthorizationHeader(r *http.Request) error {
-	switch p.config.Mode {
+	return p.setHopAuthorizationHeader(r, nil)
+}
+
+// setHopAuthorizationHeader sets Proxy-Authorization header for proxy in chain with its own mode and credentials,
+// downstream proxy is used if hop is nil.
+func (p *Proxy) setHopAuthorizationHeader(r *http.Request, hop *Hop) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	proxyURL, mode := p.config.DownstreamProxyURL, p.config.Mode
+	user, password := p.config.DownstreamProxyAuth.User, p.config.DownstreamProxyAuth.Password
+	if hop != nil {
+		proxyURL, mode = hop.URL, hop.Mode
+		user, password = hop.User, hop.Password
+	}
+
+	switch mode {
 	case AutoMode:
 		provider := gospnego.New()
-		header, err := provider.GetSPNEGOHeader(p.config.DownstreamProxyURL.Hostname())
+		header, err := provider.GetSPNEGOHeader(proxyURL.Hostname())
 		if err != nil {
 			return fmt.Errorf("cannot get SPNEGO header: %w", err)
 		}
 
 		r.Header.Set(HeaderProxyAuthorization, header)
 	case ManualMode:
-		if err := spnego.SetSPNEGOHeader(p.krb5cl, r, "HTTP/"+p.config.DownstreamProxyURL.Hostname()); err != nil {
-			return fmt.Errorf("cannot set SPNEGO header: %w", err)
+		if err := p.setSPNEGOHeader(p.krb5cl, r, proxyURL.Hostname()); err != nil {
+			return err
+		}
+	case GatewayMode:
+		krb5cl, ok := r.Context().Value(gatewayClientCtx).(*client.Client)
+		if !ok {
+			user, _ := r.Context().Value(clientUserCtx).(string)
+			return fmt.Errorf("user %s is not authenticated", user)
 		}
 
-		r.Header.Set(HeaderProxyAuthorization, r.Header.Get(spnego.HTTPHeaderAuthRequest))
-		r.Header.Del(spnego.HTTPHeaderAuthRequest)
+		if err := p.setSPNEGOHeader(krb5cl, r, proxyURL.Hostname()); err != nil {
+			return err
+		}
 	case BasicMode:
 		r.Header.Set(
 			HeaderProxyAuthorization,
-			"Basic "+base64.StdEncoding.EncodeToString(
-				[]byte(p.config.DownstreamProxyAuth.User+":"+p.config.DownstreamProxyAuth.Password),
-			),
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)),
 		)
 	}
 
+	p.logger.Named(logging.AuthSubsystem).Debug(
+		"Proxy-Authorization header set",
+		zap.String("mode", string(mode)),
+		zap.String("downstream_proxy", proxyURL.Host),
+	)
+
+	return nil
+}
+
+// setSPNEGOHeader sets Proxy-Authorization header with Kerberos token, it's bound to TLS session with downstream proxy
+// if there is one.
+func (p *Proxy) setSPNEGOHeader(krb5cl *client.Client, r *http.Request, host string) error {
+	spn := "HTTP/" + host
+
+	if bindings, ok := r.Context().Value(channelBindingsCtx).([]byte); ok {
+		header, err := negotiateHeader(krb5cl, spn, bindings)
+		if err != nil {
+			return fmt.Errorf("cannot get SPNEGO header: %w", err)
+		}
+
+		r.Header.Set(HeaderProxyAuthorization, header)
+		return nil
+	}
+
+	if err := spnego.SetSPNEGOHeader(krb5cl, r, spn); err != nil {
+		return fmt.Errorf("cannot set SPNEGO header: %w", err)
+	}
+
+	r.Header.Set(HeaderProxyAuthorization, r.Header.Get(spnego.HTTPHeaderAuthRequest))
+	r.Header.Del(spnego.HTTPHeaderAuthRequest)
+
 	return nil
 }
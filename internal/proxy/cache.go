@@ -0,0 +1,905 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	megabyte = 1024 * kilobyte
+	// maxHeuristicFreshness caps freshness of responses without explicit one, it's 10% of their age otherwise
+	maxHeuristicFreshness = 24 * time.Hour
+
+	// Stored response head carries its metadata in these headers, they are never served
+	cacheURLHeader          = "Escobar-Cache-Url"
+	cacheRequestTimeHeader  = "Escobar-Cache-Request-Time"
+	cacheResponseTimeHeader = "Escobar-Cache-Response-Time"
+)
+
+// cacheMetrics are published with expvar, counters of cache lookups and gauge of stored bytes
+var cacheMetrics = expvar.NewMap("cache")
+
+// heuristicStatuses could be cached without explicit freshness, RFC 9111 section 4.2.2
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheHopHeaders are not stored with response, they belong to connection it came over.
+var cacheHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Cache configures disk cache of plain HTTP and intercepted responses.
+type Cache struct {
+	Dir  string `long:"dir" env:"DIR" description:"Directory to store cached responses in, cache is disabled if empty" value-name:"/var/cache/escobar" json:"dir"`
+	Size int    `long:"size" env:"SIZE" description:"Cache size limit in MB, least recently used responses are evicted" default:"1024" json:"size"`
+
+	DomainStrings []string            `long:"domain" env:"DOMAINS" env-delim:"," description:"Domain to cache responses of, its subdomains are cached as well, every domain is cached if empty" value-name:"deb.debian.org" json:"domains"`
+	Domains       map[string]struct{} `no-flag:"yes" json:"-"`
+}
+
+// Resolve creates cache directory and parses domains.
+func (c *Cache) Resolve() error {
+	c.Domains = nil
+	if c.Dir == "" {
+		return nil
+	}
+	if c.Size <= 0 {
+		return fmt.Errorf("cache size must be positive")
+	}
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return fmt.Errorf("cannot create cache directory: %w", err)
+	}
+
+	c.Domains = make(map[string]struct{}, len(c.DomainStrings))
+	for _, domain := range c.DomainStrings {
+		c.Domains[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")] = struct{}{}
+	}
+
+	return nil
+}
+
+// cache is shared HTTP cache following RFC 9111, responses are stored on disk and evicted in LRU order.
+type cache struct {
+	logger *zap.Logger
+	config *Cache
+
+	mu sync.Mutex
+	// lru holds entries, the front one is the most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+	urls    map[string]*cachedURL
+	size    int64
+}
+
+// cacheEntry is stored response, key names its files.
+type cacheEntry struct {
+	key  string
+	url  string
+	size int64
+}
+
+// cachedURL holds stored variants of URL, they are selected by request headers listed in Vary.
+type cachedURL struct {
+	vary     []string
+	variants map[string]struct{}
+}
+
+func newCache(logger *zap.Logger, config *Cache) *cache {
+	c := &cache{
+		logger:  logger,
+		config:  config,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		urls:    make(map[string]*cachedURL),
+	}
+	if err := c.load(); err != nil {
+		logger.Error("Cannot load cached responses", zap.Error(err))
+	}
+
+	return c
+}
+
+// load indexes responses stored by previous process, the least recently modified ones are evicted first.
+func (c *cache) load() error {
+	paths, err := filepath.Glob(filepath.Join(c.config.Dir, "*"))
+	if err != nil {
+		return err
+	}
+
+	type stored struct {
+		entry   *cacheEntry
+		vary    []string
+		modTime time.Time
+	}
+	var found []stored
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if strings.HasSuffix(name, ".tmp") {
+			// Response was being stored when previous process stopped
+			// nolint:errcheck
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(name, ".header") {
+			continue
+		}
+
+		key := strings.TrimSuffix(name, ".header")
+		resp, size, err := c.open(key, nil)
+		if err != nil {
+			c.logger.Warn("Cannot load cached response, removing it", zap.String("key", key), zap.Error(err))
+			c.removeFiles(key)
+			continue
+		}
+		resp.Body.Close()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		found = append(found, stored{
+			entry:   &cacheEntry{key: key, url: resp.Header.Get(cacheURLHeader), size: size},
+			vary:    varyHeaders(resp.Header),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range found {
+		c.add(s.entry, s.vary)
+	}
+
+	return nil
+}
+
+// transport returns round tripper serving responses from cache and storing them, requests of other domains go to
+// next one untouched.
+func (c *cache) transport(next http.RoundTripper) http.RoundTripper {
+	return &cacheTransport{cache: c, next: next}
+}
+
+// match returns true if responses of host are cached.
+func (c *cache) match(host string) bool {
+	if len(c.config.Domains) == 0 {
+		return true
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for domain := host; domain != ""; {
+		if _, ok := c.config.Domains[domain]; ok {
+			return true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	return false
+}
+
+// lookup opens stored variant matching request, it's marked as used. Files are opened with mu held, so head and body
+// belong to the same response even if it's replaced while being served.
+func (c *cache) lookup(req *http.Request) (*http.Response, bool) {
+	url := cacheURL(req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.urls[url]
+	if !ok {
+		return nil, false
+	}
+	key := variantKey(url, u.vary, req)
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	resp, _, err := c.open(key, req)
+	if err != nil {
+		c.logger.Warn("Cannot open cached response, removing it", zap.String("key", key), zap.Error(err))
+		c.remove(key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+
+	return resp, true
+}
+
+// add indexes stored entry and evicts the least recently used ones over size limit, must be called with mu held.
+func (c *cache) add(entry *cacheEntry, vary []string) {
+	u, ok := c.urls[entry.url]
+	if !ok {
+		u = &cachedURL{variants: make(map[string]struct{})}
+		c.urls[entry.url] = u
+	}
+	// Variants selected by other headers can't be matched anymore
+	if !equalStrings(u.vary, vary) {
+		for key := range u.variants {
+			if key != entry.key {
+				c.remove(key)
+			}
+		}
+		u.vary = vary
+	}
+	u.variants[entry.key] = struct{}{}
+	// URL is forgotten once its last variant is removed
+	c.urls[entry.url] = u
+
+	if el, ok := c.entries[entry.key]; ok {
+		old := el.Value.(*cacheEntry)
+		c.size -= old.size
+		cacheMetrics.Add("size", -old.size)
+		el.Value = entry
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[entry.key] = c.lru.PushFront(entry)
+	}
+	c.size += entry.size
+	cacheMetrics.Add("size", entry.size)
+
+	for limit := int64(c.config.Size) * megabyte; c.size > limit && c.lru.Len() > 1; {
+		oldest := c.lru.Back().Value.(*cacheEntry)
+		c.remove(oldest.key)
+		cacheMetrics.Add("evicted", 1)
+	}
+}
+
+// remove deletes entry with its files, must be called with mu held.
+func (c *cache) remove(key string) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*cacheEntry)
+
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	if u, ok := c.urls[entry.url]; ok {
+		delete(u.variants, key)
+		if len(u.variants) == 0 {
+			delete(c.urls, entry.url)
+		}
+	}
+	c.size -= entry.size
+	cacheMetrics.Add("size", -entry.size)
+
+	c.removeFiles(key)
+}
+
+// invalidate removes every variant of URL, e.g. after it was changed by unsafe request.
+func (c *cache) invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if u, ok := c.urls[cacheURL(req)]; ok {
+		for key := range u.variants {
+			c.remove(key)
+		}
+	}
+}
+
+func (c *cache) removeFiles(key string) {
+	for _, path := range []string{c.path(key, ".header"), c.path(key, ".body")} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.logger.Error("Cannot remove cached response", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+func (c *cache) path(key, ext string) string {
+	return filepath.Join(c.config.Dir, key+ext)
+}
+
+// open reads stored response, its body is stored file itself. Returns size of stored files. It must be called with
+// mu held once cache is served, otherwise head and body could be taken from different responses.
+func (c *cache) open(key string, req *http.Request) (*http.Response, int64, error) {
+	head, err := os.ReadFile(c.path(key, ".header"))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(string(head))), req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot parse stored response: %w", err)
+	}
+
+	body, err := os.Open(c.path(key, ".body"))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+
+	resp.Body = body
+	resp.ContentLength = info.Size()
+
+	return resp, int64(len(head)) + info.Size(), nil
+}
+
+// writeHead stores response head along with its metadata, it replaces previous one atomically.
+func (c *cache) writeHead(key, url string, resp *http.Response, size int64, requestTime, responseTime time.Time) (int64, error) {
+	header := resp.Header.Clone()
+	for _, h := range cacheHopHeaders {
+		header.Del(h)
+	}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set(cacheURLHeader, url)
+	header.Set(cacheRequestTimeHeader, strconv.FormatInt(requestTime.UnixNano(), 10))
+	header.Set(cacheResponseTimeHeader, strconv.FormatInt(responseTime.UnixNano(), 10))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if err := header.Write(&b); err != nil {
+		return 0, err
+	}
+	b.WriteString("\r\n")
+
+	f, err := os.CreateTemp(c.config.Dir, key+".*.header.tmp")
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key, ".header"))
+	}
+	if err != nil {
+		// nolint:errcheck
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	return int64(b.Len()), nil
+}
+
+// update replaces head of stored response after it was revalidated, response could be evicted already.
+func (c *cache) update(req *http.Request, resp *http.Response, requestTime, responseTime time.Time) {
+	url := cacheURL(req)
+	key := variantKey(url, varyHeaders(resp.Header), req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	headSize, err := c.writeHead(key, url, resp, resp.ContentLength, requestTime, responseTime)
+	if err != nil {
+		c.logger.Error("Cannot update stored response", zap.String("url", url), zap.Error(err))
+		c.remove(key)
+		return
+	}
+
+	entry := el.Value.(*cacheEntry)
+	c.add(&cacheEntry{key: key, url: url, size: headSize + resp.ContentLength}, c.urls[entry.url].vary)
+}
+
+// store returns body which stores response while it's read, response is cached once it's read completely.
+func (c *cache) store(req *http.Request, resp *http.Response, requestTime, responseTime time.Time) io.ReadCloser {
+	url := cacheURL(req)
+	vary := varyHeaders(resp.Header)
+	key := variantKey(url, vary, req)
+
+	f, err := os.CreateTemp(c.config.Dir, key+".*.body.tmp")
+	if err != nil {
+		c.logger.Error("Cannot store response", zap.String("url", url), zap.Error(err))
+		return resp.Body
+	}
+
+	return &cacheWriter{
+		cache:        c,
+		body:         resp.Body,
+		file:         f,
+		resp:         resp,
+		key:          key,
+		url:          url,
+		vary:         vary,
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+}
+
+// cacheWriter copies response body into file, it's committed once body is read completely.
+type cacheWriter struct {
+	cache *cache
+	body  io.ReadCloser
+	file  *os.File
+
+	resp                      *http.Response
+	key, url                  string
+	vary                      []string
+	requestTime, responseTime time.Time
+
+	written int64
+	done    bool
+}
+
+func (w *cacheWriter) Read(b []byte) (int, error) {
+	n, err := w.body.Read(b)
+	if n > 0 && !w.done {
+		if _, werr := w.file.Write(b[:n]); werr != nil {
+			w.cache.logger.Error("Cannot store response", zap.String("url", w.url), zap.Error(werr))
+			w.abort()
+		}
+		w.written += int64(n)
+		// Response which doesn't fit cache at all is not stored
+		if w.written > int64(w.cache.config.Size)*megabyte {
+			w.abort()
+		}
+	}
+	if err == io.EOF && !w.done {
+		w.commit()
+	} else if err != nil {
+		w.abort()
+	}
+
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	// Body is not read completely, e.g. client has gone
+	w.abort()
+	return w.body.Close()
+}
+
+func (w *cacheWriter) commit() {
+	w.done = true
+	tmp := w.file.Name()
+
+	err := w.file.Close()
+	if err == nil && w.resp.ContentLength >= 0 && w.resp.ContentLength != w.written {
+		err = fmt.Errorf("body is %d bytes instead of %d", w.written, w.resp.ContentLength)
+	}
+	if err != nil {
+		w.cache.logger.Error("Cannot store response", zap.String("url", w.url), zap.Error(err))
+		// nolint:errcheck
+		os.Remove(tmp)
+		return
+	}
+
+	c := w.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp, c.path(w.key, ".body")); err != nil {
+		c.logger.Error("Cannot store response", zap.String("url", w.url), zap.Error(err))
+		// nolint:errcheck
+		os.Remove(tmp)
+		return
+	}
+	headSize, err := c.writeHead(w.key, w.url, w.resp, w.written, w.requestTime, w.responseTime)
+	if err != nil {
+		c.logger.Error("Cannot store response", zap.String("url", w.url), zap.Error(err))
+		c.removeFiles(w.key)
+		return
+	}
+
+	c.add(&cacheEntry{key: w.key, url: w.url, size: headSize + w.written}, w.vary)
+	cacheMetrics.Add("stored", 1)
+}
+
+func (w *cacheWriter) abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	// nolint:errcheck
+	w.file.Close()
+	// nolint:errcheck
+	os.Remove(w.file.Name())
+}
+
+// cacheTransport serves GET requests from cache, stale responses are revalidated with their validators.
+type cacheTransport struct {
+	cache *cache
+	next  http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.cache.match(req.URL.Hostname()) {
+		return t.next.RoundTrip(req)
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return t.next.RoundTrip(req)
+	default:
+		// Unsafe request changes resource, so stored responses are not valid anymore
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			t.cache.invalidate(req)
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	// Partial responses are not stored
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	if stored, ok := t.cache.lookup(req); ok {
+		requestTime, responseTime := storedTimes(stored.Header)
+		age := currentAge(stored.Header, requestTime, responseTime, time.Now())
+		if fresh(stored.Header, reqCC, req.Header, responseTime, age) {
+			cacheMetrics.Add("hits", 1)
+			return serveStored(stored, req, age), nil
+		}
+
+		return t.revalidate(req, stored)
+	}
+
+	cacheMetrics.Add("misses", 1)
+	if reqCC.has("only-if-cached") {
+		return newResponse(http.StatusGatewayTimeout, nil, req), nil
+	}
+
+	return t.roundTrip(req)
+}
+
+// roundTrip sends request to destination and stores response if it's allowed.
+func (t *cacheTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if storable(req, resp) {
+		resp.Body = t.cache.store(req, resp, requestTime, time.Now())
+	}
+
+	return resp, nil
+}
+
+// revalidate asks destination whether stale response is still valid, it's served again if destination responds with
+// 304 Not Modified.
+func (t *cacheTransport) revalidate(req *http.Request, stored *http.Response) (*http.Response, error) {
+	etag, lastModified := stored.Header.Get("Etag"), stored.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		stored.Body.Close()
+		cacheMetrics.Add("misses", 1)
+		return t.roundTrip(req)
+	}
+
+	// Own conditions of client are replaced, stored response is served to it anyway
+	outreq := req.Clone(req.Context())
+	outreq.Header.Del("If-Match")
+	outreq.Header.Del("If-Unmodified-Since")
+	outreq.Header.Del("If-None-Match")
+	outreq.Header.Del("If-Modified-Since")
+	if etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(outreq)
+	if err != nil {
+		stored.Body.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		stored.Body.Close()
+		cacheMetrics.Add("misses", 1)
+		if storable(req, resp) {
+			resp.Body = t.cache.store(req, resp, requestTime, time.Now())
+		}
+		return resp, nil
+	}
+	resp.Body.Close()
+	responseTime := time.Now()
+
+	// Stored response gets updated headers
+	for k, vv := range resp.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		stored.Header[k] = vv
+	}
+	t.cache.update(req, stored, requestTime, responseTime)
+
+	cacheMetrics.Add("revalidated", 1)
+	return serveStored(stored, req, currentAge(stored.Header, requestTime, responseTime, time.Now())), nil
+}
+
+// serveStored prepares stored response for client, conditional request of client is answered with 304.
+func serveStored(resp *http.Response, req *http.Request, age time.Duration) *http.Response {
+	for _, h := range []string{cacheURLHeader, cacheRequestTimeHeader, cacheResponseTimeHeader} {
+		resp.Header.Del(h)
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	resp.Request = req
+
+	if notModified(resp.Header, req.Header) {
+		resp.Body.Close()
+		resp.StatusCode, resp.Status = http.StatusNotModified, "304 Not Modified"
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+
+	return resp
+}
+
+// notModified returns true if stored response matches conditions of request.
+func notModified(stored, req http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(stored.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(req.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(stored.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// storable returns true if response could be stored by shared cache.
+func storable(req *http.Request, resp *http.Response) bool {
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	// Response to authorized request is shared only if destination allows it
+	if req.Header.Get("Authorization") != "" && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	// Cookies are personal, shared cache never hands them out to other clients
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, h := range varyHeaders(resp.Header) {
+		if h == "*" {
+			return false
+		}
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified || resp.StatusCode < http.StatusOK {
+		return false
+	}
+
+	lifetime, explicit := freshnessLifetime(resp.Header, time.Now())
+	if !explicit && !respCC.has("public") && !heuristicStatuses[resp.StatusCode] {
+		return false
+	}
+
+	// Response which is stale at once and can't be revalidated is useless
+	return lifetime > 0 || resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// fresh returns true if stored response could be served without revalidation.
+func fresh(stored http.Header, reqCC cacheControl, req http.Header, responseTime time.Time, age time.Duration) bool {
+	if reqCC.has("no-cache") || parseCacheControl(stored).has("no-cache") {
+		return false
+	}
+	// Pragma is taken into account only without Cache-Control
+	if len(reqCC) == 0 && strings.Contains(strings.ToLower(req.Get("Pragma")), "no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	lifetime, _ := freshnessLifetime(stored, responseTime)
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		lifetime -= minFresh
+	}
+
+	return age < lifetime
+}
+
+// freshnessLifetime returns how long response is fresh, explicit is false if it's calculated heuristically.
+func freshnessLifetime(h http.Header, responseTime time.Time) (lifetime time.Duration, explicit bool) {
+	cc := parseCacheControl(h)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+
+	date := responseDate(h, responseTime)
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		// Invalid date means response has already expired
+		if err != nil || !expires.After(date) {
+			return 0, true
+		}
+		return expires.Sub(date), true
+	}
+
+	if lastModified, err := http.ParseTime(h.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		lifetime = date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicFreshness {
+			lifetime = maxHeuristicFreshness
+		}
+		return lifetime, false
+	}
+
+	return 0, false
+}
+
+// currentAge calculates age of stored response, RFC 9111 section 4.2.3.
+func currentAge(h http.Header, requestTime, responseTime, now time.Time) time.Duration {
+	apparentAge := responseTime.Sub(responseDate(h, responseTime))
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	var ageValue time.Duration
+	if v, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && v > 0 {
+		ageValue = time.Duration(v) * time.Second
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+
+	return correctedAge + now.Sub(responseTime)
+}
+
+// responseDate returns Date of response, time it was received if there is none.
+func responseDate(h http.Header, responseTime time.Time) time.Time {
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		return date
+	}
+
+	return responseTime
+}
+
+// storedTimes returns times request was sent and response was received at.
+func storedTimes(h http.Header) (requestTime, responseTime time.Time) {
+	parse := func(name string) time.Time {
+		v, err := strconv.ParseInt(h.Get(name), 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(0, v)
+	}
+
+	return parse(cacheRequestTimeHeader), parse(cacheResponseTimeHeader)
+}
+
+// cacheURL returns URL responses are stored by.
+func cacheURL(req *http.Request) string {
+	u := *req.URL
+	u.Fragment = ""
+	u.Host = strings.ToLower(u.Host)
+
+	return u.String()
+}
+
+// varyHeaders returns sorted canonical names of request headers listed in Vary.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// variantKey returns key of response variant selected by request headers listed in Vary.
+func variantKey(url string, vary []string, req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, url)
+	for _, name := range vary {
+		fmt.Fprintf(h, "\n%s:%s", name, strings.Join(req.Header.Values(name), ","))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cacheControl holds Cache-Control directives with their values.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns duration value of directive, e.g. max-age.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
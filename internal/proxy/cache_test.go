@@ -0,0 +1,362 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// cacheMetric returns current value of cache counter.
+func cacheMetric(name string) int64 {
+	if v, ok := cacheMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+
+	return 0
+}
+
+// cacheGet sends GET through transport and reads the whole body.
+func cacheGet(t *testing.T, tr http.RoundTripper, u string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	require.NoError(t, err)
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(b)
+}
+
+func TestCache_Resolve(t *testing.T) {
+	c := Cache{}
+	require.NoError(t, c.Resolve())
+	assert.Nil(t, c.Domains)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	c = Cache{Dir: dir, Size: 1, DomainStrings: []string{"Deb.Debian.Org."}}
+	require.NoError(t, c.Resolve())
+	assert.DirExists(t, dir)
+	assert.Contains(t, c.Domains, "deb.debian.org")
+
+	c = Cache{Dir: dir}
+	assert.Error(t, c.Resolve())
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	date := now.Format(http.TimeFormat)
+
+	for _, tc := range []struct {
+		name     string
+		header   http.Header
+		lifetime time.Duration
+		explicit bool
+	}{
+		{"s-maxage", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"expires", http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{"invalid expires", http.Header{"Date": {date}, "Expires": {"0"}}, 0, true},
+		{"heuristic", http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, time.Hour, false},
+		{"capped heuristic", http.Header{"Date": {date}, "Last-Modified": {now.AddDate(-1, 0, 0).Format(http.TimeFormat)}}, maxHeuristicFreshness, false},
+		{"none", http.Header{"Date": {date}}, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lifetime, explicit := freshnessLifetime(tc.header, now)
+			assert.Equal(t, tc.lifetime, lifetime)
+			assert.Equal(t, tc.explicit, explicit)
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		reqHeader http.Header
+		code      int
+		header    http.Header
+		storable  bool
+	}{
+		{"max-age", nil, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"validator only", nil, http.StatusOK, http.Header{"Etag": {`"v1"`}}, true},
+		{"nothing to reuse", nil, http.StatusOK, http.Header{}, false},
+		{"no-store", nil, http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"private", nil, http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"request no-store", http.Header{"Cache-Control": {"no-store"}}, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorized", http.Header{"Authorization": {"Basic dGVzdA=="}}, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorized public", http.Header{"Authorization": {"Basic dGVzdA=="}}, http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"cookie", nil, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}, false},
+		{"vary any", nil, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false},
+		{"partial", nil, http.StatusPartialContent, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"not heuristic", nil, http.StatusFound, http.Header{"Etag": {`"v1"`}}, false},
+		{"explicit redirect", nil, http.StatusFound, http.Header{"Cache-Control": {"max-age=60"}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/", nil)
+			for k, vv := range tc.reqHeader {
+				req.Header[k] = vv
+			}
+			resp := &http.Response{StatusCode: tc.code, Header: tc.header}
+
+			assert.Equal(t, tc.storable, storable(req, resp))
+		})
+	}
+}
+
+func TestCacheTransport(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			// nolint:errcheck
+			w.Write([]byte("fresh"))
+		case "/stale":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// nolint:errcheck
+			w.Write([]byte("stale"))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Vary", "Accept-Language")
+			// nolint:errcheck
+			w.Write([]byte("vary " + r.Header.Get("Accept-Language")))
+		case "/large":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			// nolint:errcheck
+			w.Write([]byte(strings.Repeat(r.URL.Query().Get("fill"), 600*kilobyte)))
+		default:
+			// nolint:errcheck
+			w.Write([]byte("none"))
+		}
+	}))
+	defer srv.Close()
+
+	config := &Cache{Dir: t.TempDir(), Size: 1}
+	require.NoError(t, config.Resolve())
+	c := newCache(zap.NewNop(), config)
+	tr := c.transport(http.DefaultTransport)
+
+	t.Run("fresh", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		hits, misses := cacheMetric("hits"), cacheMetric("misses")
+
+		_, body := cacheGet(t, tr, srv.URL+"/fresh", nil)
+		assert.Equal(t, "fresh", body)
+
+		resp, body := cacheGet(t, tr, srv.URL+"/fresh", nil)
+		assert.Equal(t, "fresh", body)
+		assert.Equal(t, "0", resp.Header.Get("Age"))
+		assert.Empty(t, resp.Header.Get(cacheURLHeader))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+		assert.Equal(t, hits+1, cacheMetric("hits"))
+		assert.Equal(t, misses+1, cacheMetric("misses"))
+
+		// Client asks to revalidate, there is no validator, so response is fetched again
+		_, body = cacheGet(t, tr, srv.URL+"/fresh", http.Header{"Cache-Control": {"no-cache"}})
+		assert.Equal(t, "fresh", body)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("revalidated", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		revalidated := cacheMetric("revalidated")
+
+		_, body := cacheGet(t, tr, srv.URL+"/stale", nil)
+		assert.Equal(t, "stale", body)
+
+		resp, body := cacheGet(t, tr, srv.URL+"/stale", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "stale", body)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+		assert.Equal(t, revalidated+1, cacheMetric("revalidated"))
+
+		// Conditional request of client is answered from cache
+		resp, _ = cacheGet(t, tr, srv.URL+"/stale", http.Header{"If-None-Match": {`"v1"`}})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+
+		for i := 0; i < 2; i++ {
+			_, body := cacheGet(t, tr, srv.URL+"/vary", http.Header{"Accept-Language": {"en"}})
+			assert.Equal(t, "vary en", body)
+			_, body = cacheGet(t, tr, srv.URL+"/vary", http.Header{"Accept-Language": {"ru"}})
+			assert.Equal(t, "vary ru", body)
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+
+		cacheGet(t, tr, srv.URL+"/fresh", nil)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/fresh", strings.NewReader("changed"))
+		require.NoError(t, err)
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		cacheGet(t, tr, srv.URL+"/fresh", nil)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("only-if-cached", func(t *testing.T) {
+		resp, _ := cacheGet(t, tr, srv.URL+"/missing", http.Header{"Cache-Control": {"only-if-cached"}})
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		evicted := cacheMetric("evicted")
+
+		// Two responses don't fit 1 MB, the least recently used one is evicted
+		cacheGet(t, tr, srv.URL+"/large?fill=a", nil)
+		cacheGet(t, tr, srv.URL+"/large?fill=b", nil)
+		assert.Greater(t, cacheMetric("evicted"), evicted)
+		assert.LessOrEqual(t, c.size, int64(megabyte))
+
+		cacheGet(t, tr, srv.URL+"/large?fill=b", nil)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+		cacheGet(t, tr, srv.URL+"/large?fill=a", nil)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("loaded", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+
+		// Stored responses survive restart
+		tr := newCache(zap.NewNop(), config).transport(http.DefaultTransport)
+		_, body := cacheGet(t, tr, srv.URL+"/large?fill=a", nil)
+		assert.Equal(t, strings.Repeat("a", 600*kilobyte), body)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+	})
+}
+
+func TestProxy_http_cache(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		// nolint:errcheck
+		w.Write([]byte("package"))
+	}))
+	defer srv.Close()
+
+	downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "test_password"))
+	u, err := url.Parse("http://" + downstreamAddr)
+	require.NoError(t, err)
+
+	config := &Config{
+		DownstreamProxyURL: u,
+		DownstreamProxyAuth: DownstreamProxyAuth{
+			User:     "test_user",
+			Password: "test_password",
+		},
+		// Destination is reached by IP, so it isn't cached
+		Cache: Cache{Dir: t.TempDir(), Size: 1, DomainStrings: []string{"localhost"}},
+		Mode:  BasicMode,
+	}
+	require.NoError(t, config.Cache.Resolve())
+
+	p := NewProxy(zap.NewNop(), config, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	defer func() {
+		// nolint:errcheck
+		p.Shutdown(context.Background())
+	}()
+
+	proxyURL, err := url.Parse("http://" + l.Addr().String())
+	require.NoError(t, err)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, body := cacheGet(t, tr, "http://localhost:"+port+"/pool/main/package.deb", nil)
+		assert.Equal(t, "package", body)
+		_, body = cacheGet(t, tr, srv.URL+"/pool/main/package.deb", nil)
+		assert.Equal(t, "package", body)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func TestCacheTransport_replaced(t *testing.T) {
+	var version int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every version has body of its own length
+		n := int(atomic.AddInt32(&version, 1))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		// nolint:errcheck
+		w.Write([]byte(strings.Repeat("v", kilobyte+n)))
+	}))
+	defer srv.Close()
+
+	config := &Cache{Dir: t.TempDir(), Size: 16}
+	require.NoError(t, config.Resolve())
+	c := newCache(zap.NewNop(), config)
+	tr := c.transport(http.DefaultTransport)
+
+	// Response is replaced by forced reloads while it's served to others
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		header := http.Header{}
+		if i%2 == 0 {
+			header.Set("Cache-Control", "no-cache")
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				resp, body := cacheGet(t, tr, srv.URL+"/replaced", header)
+				assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewProxy_gatewayCache(t *testing.T) {
+	// Downstream proxy applies policy per user, so its responses are never shared
+	p := NewProxy(zap.NewNop(), &Config{Mode: GatewayMode, Cache: Cache{Dir: t.TempDir(), Size: 1}}, nil)
+	assert.Nil(t, p.cache)
+}
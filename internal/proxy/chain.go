@@ -0,0 +1,254 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/L11R/escobar/internal/secrets"
+)
+
+// Hop is a proxy behind downstream one, tunnels are established through every hop in order.
+type Hop struct {
+	URL      *url.URL
+	Mode     Mode
+	User     string
+	Password string
+}
+
+// ParseHop parses proxy URL with optional own authentication,
+// e.g. "http://partner.corp:8080;mode=basic;user=ivanovii;password=env:PARTNER_PASSWORD".
+// Mode defaults to basic if user is set, to auto otherwise.
+func ParseHop(s string) (Hop, error) {
+	parts := strings.Split(s, ";")
+
+	u, err := url.Parse(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return Hop{}, fmt.Errorf("cannot parse proxy URL: %w", err)
+	}
+	if u.Scheme != "http" || u.Hostname() == "" {
+		return Hop{}, fmt.Errorf("proxy URL %q must be http one", parts[0])
+	}
+
+	hop := Hop{URL: u}
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case ok && key == "mode":
+			hop.Mode = Mode(value)
+		case ok && key == "user":
+			hop.User = value
+		case ok && key == "password":
+			hop.Password, err = secrets.ResolveString(value)
+			if err != nil {
+				return Hop{}, fmt.Errorf("cannot resolve proxy password: %w", err)
+			}
+		default:
+			return Hop{}, fmt.Errorf("invalid proxy option %q", part)
+		}
+	}
+
+	if hop.Mode == "" {
+		hop.Mode = AutoMode
+		if hop.User != "" {
+			hop.Mode = BasicMode
+		}
+	}
+
+	return hop, nil
+}
+
+// Addr returns hop address, port defaults to 80.
+func (h *Hop) Addr() string {
+	if h.URL.Port() != "" {
+		return h.URL.Host
+	}
+
+	return net.JoinHostPort(h.URL.Hostname(), "80")
+}
+
+// ResolveChain parses proxies behind downstream one.
+func (c *Config) ResolveChain() error {
+	c.Chain = make([]Hop, 0, len(c.ChainStrings))
+	for _, s := range c.ChainStrings {
+		hop, err := ParseHop(s)
+		if err != nil {
+			return err
+		}
+
+		if err := c.checkHopMode(hop); err != nil {
+			return fmt.Errorf("chain proxy %s: %w", hop.URL.Host, err)
+		}
+
+		c.Chain = append(c.Chain, hop)
+	}
+
+	return nil
+}
+
+// checkHopMode returns an error if hop can't be authenticated in its mode. Manual and gateway hops use Kerberos client
+// of escobar itself, so they are allowed in the same mode only.
+func (c *Config) checkHopMode(hop Hop) error {
+	switch hop.Mode {
+	case AutoMode, BasicMode:
+	case ManualMode, GatewayMode:
+		if hop.Mode != c.Mode {
+			return fmt.Errorf("%s mode requires escobar to run in the same mode", hop.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", hop.Mode)
+	}
+
+	return nil
+}
+
+// hopError is returned when proxy refuses to establish tunnel.
+type hopError struct {
+	host string
+	code int
+}
+
+func (e *hopError) Error() string {
+	return fmt.Sprintf("proxy %s responded with %d %s", e.host, e.code, http.StatusText(e.code))
+}
+
+// hopErrorCode returns status code to pass to client if proxy in chain refused to establish tunnel.
+// Authentication is escobar's business, so such failures become 502.
+func hopErrorCode(err error) (int, bool) {
+	var herr *hopError
+	if !errors.As(err, &herr) {
+		return 0, false
+	}
+	if herr.code == http.StatusProxyAuthRequired {
+		return http.StatusBadGateway, true
+	}
+
+	return herr.code, true
+}
+
+// dialChain connects to destination address through downstream proxy and every proxy in chain using nested CONNECTs.
+func (p *Proxy) dialChain(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, ctx, err := p.dialDownstream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.connectChain(ctx, conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connectChain establishes tunnel to destination address over connection with downstream proxy.
+func (p *Proxy) connectChain(ctx context.Context, conn net.Conn, addr string) error {
+	// Tunnels should be negotiated within dial timeout
+	if timeout := p.config.Timeouts.DownstreamProxy.DialTimeout; timeout != 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("cannot set deadline for connection with downstream proxy: %w", err)
+		}
+		// nolint:errcheck
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	br := bufio.NewReader(conn)
+	for i := 0; i <= len(p.config.Chain); i++ {
+		next := addr
+		if i < len(p.config.Chain) {
+			next = p.config.Chain[i].Addr()
+		}
+
+		var hop *Hop
+		if i > 0 {
+			hop = &p.config.Chain[i-1]
+			// Channel bindings belong to downstream proxy only
+			ctx = context.WithValue(ctx, channelBindingsCtx, nil)
+		}
+
+		if err := p.connectHop(ctx, conn, br, next, hop); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connectHop sends CONNECT to address through hop, downstream proxy is used if hop is nil. Downstream proxy is
+// authenticated preemptively as with plain HTTP requests, proxies in chain only if they require it.
+func (p *Proxy) connectHop(ctx context.Context, conn net.Conn, br *bufio.Reader, addr string, hop *Hop) error {
+	host := p.config.DownstreamProxyURL.Host
+	if hop != nil {
+		host = hop.URL.Host
+	}
+
+	// Every hop gets fresh request, so credentials of the previous one never leak further
+	req := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}).WithContext(ctx)
+	// Rules match CONNECT target, as with the one sent to downstream proxy directly
+	if target, _, err := net.SplitHostPort(addr); err == nil {
+		p.config.Headers.Apply(target, req.Header)
+	}
+
+	roundTrip := func() (*http.Response, error) {
+		if err := req.Write(conn); err != nil {
+			return nil, fmt.Errorf("cannot write CONNECT request to %s: %w", host, err)
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CONNECT response from %s: %w", host, err)
+		}
+
+		return resp, nil
+	}
+
+	if hop == nil {
+		if err := p.setProxyAuthorizationHeader(req); err != nil {
+			return fmt.Errorf("cannot set authorization header: %w", err)
+		}
+	}
+
+	resp, err := roundTrip()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusProxyAuthRequired && hop != nil {
+		// Body must be drained before connection is reused
+		resp.Body.Close()
+
+		if err := p.setHopAuthorizationHeader(req, hop); err != nil {
+			return fmt.Errorf("cannot set authorization header: %w", err)
+		}
+
+		resp, err = roundTrip()
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &hopError{host: host, code: resp.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectRequest is CONNECT request seen by proxy.
+type connectRequest struct {
+	host          string
+	authorization string
+}
+
+// serveConnect starts HTTP proxy which establishes tunnels with CONNECT and relays other requests as is, it requires
+// Proxy-Authorization header to be equal to authorization unless it's empty, seen requests are sent to the channel.
+func serveConnect(t *testing.T, authorization string) (string, <-chan connectRequest) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	requests := make(chan connectRequest, 10)
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			requests <- connectRequest{host: req.Host, authorization: req.Header.Get(HeaderProxyAuthorization)}
+
+			if authorization != "" && req.Header.Get(HeaderProxyAuthorization) != authorization {
+				// Body must be consumed by client to send the next request
+				body := "Proxy Authentication Required"
+				resp := newResponse(http.StatusProxyAuthRequired, strings.NewReader(body), req)
+				resp.ContentLength = int64(len(body))
+				resp.Header.Set("Proxy-Authenticate", "Basic")
+				// nolint:errcheck
+				resp.Write(conn)
+				continue
+			}
+
+			backend, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				// nolint:errcheck
+				newResponse(http.StatusBadGateway, nil, req).Write(conn)
+				return
+			}
+			defer backend.Close()
+			if req.Method == http.MethodConnect {
+				// nolint:errcheck
+				newResponse(http.StatusOK, nil, req).Write(conn)
+			} else {
+				req.Header.Del(HeaderProxyAuthorization)
+				// nolint:errcheck
+				req.Write(backend)
+			}
+
+			go func() {
+				// nolint:errcheck
+				io.Copy(backend, br)
+				// nolint:errcheck
+				backend.(*net.TCPConn).CloseWrite()
+			}()
+			// nolint:errcheck
+			io.Copy(conn, backend)
+			return
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), requests
+}
+
+func basicAuthorization(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// withChain routes tunnels through chain of proxies behind downstream one.
+func withChain(t *testing.T, chain ...string) func(config *Config) {
+	return func(config *Config) {
+		config.ChainStrings = chain
+		require.NoError(t, config.ResolveChain())
+	}
+}
+
+func TestParseHop(t *testing.T) {
+	t.Setenv("ESCOBAR_TEST_PARTNER_PASSWORD", "Partner123")
+
+	hop, err := ParseHop("http://partner.corp:8080;user=partner;password=env:ESCOBAR_TEST_PARTNER_PASSWORD")
+	require.NoError(t, err)
+	assert.Equal(t, "partner.corp:8080", hop.Addr())
+	assert.Equal(t, BasicMode, hop.Mode)
+	assert.Equal(t, "partner", hop.User)
+	assert.Equal(t, "Partner123", hop.Password)
+
+	hop, err = ParseHop("http://partner.corp")
+	require.NoError(t, err)
+	assert.Equal(t, "partner.corp:80", hop.Addr())
+	assert.Equal(t, AutoMode, hop.Mode)
+
+	hop, err = ParseHop("http://partner.corp; mode=gateway")
+	require.NoError(t, err)
+	assert.Equal(t, GatewayMode, hop.Mode)
+
+	for _, invalid := range []string{
+		"",
+		"partner.corp:8080",
+		"https://partner.corp:8080",
+		"http://partner.corp:8080;user",
+		"http://partner.corp:8080;port=80",
+		"http://partner.corp:8080;password=env:ESCOBAR_TEST_MISSING_PASSWORD",
+	} {
+		_, err := ParseHop(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConfig_ResolveChain(t *testing.T) {
+	config := &Config{
+		ChainStrings: []string{"http://10.0.0.2;mode=gateway", "http://10.0.0.3"},
+		Mode:         GatewayMode,
+	}
+	require.NoError(t, config.ResolveChain())
+	assert.Len(t, config.Chain, 2)
+
+	config.Mode = ManualMode
+	assert.EqualError(t, config.ResolveChain(), "chain proxy 10.0.0.2: gateway mode requires escobar to run in the same mode")
+
+	config.ChainStrings = []string{"http://10.0.0.2;mode=ntlm"}
+	assert.EqualError(t, config.ResolveChain(), `chain proxy 10.0.0.2: unknown mode "ntlm"`)
+}
+
+func TestProxy_https_chain(t *testing.T) {
+	echoAddr := serveEcho(t, "127.0.0.1")
+	lastAddr, lastRequests := serveConnect(t, "")
+	partnerAddr, partnerRequests := serveConnect(t, basicAuthorization("partner", "Partner123"))
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	addr := newTestProxy(t, "http://"+downstreamAddr, withChain(t,
+		"http://"+partnerAddr+";user=partner;password=Partner123",
+		"http://"+lastAddr,
+	))
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	req, err := http.NewRequest(http.MethodConnect, "http://"+echoAddr, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Downstream proxy is authenticated preemptively
+	assert.Equal(t, connectRequest{host: partnerAddr, authorization: basicAuthorization("test_user", "test_password")}, <-downstreamRequests)
+	// Proxy in chain is authenticated on demand with own credentials
+	assert.Equal(t, connectRequest{host: lastAddr}, <-partnerRequests)
+	assert.Equal(t, connectRequest{host: lastAddr, authorization: basicAuthorization("partner", "Partner123")}, <-partnerRequests)
+	// Credentials never leak to the next proxies
+	assert.Equal(t, connectRequest{host: echoAddr}, <-lastRequests)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		addr := newTestProxy(t, "http://"+downstreamAddr, withChain(t, "http://"+partnerAddr+";user=partner;password=wrong"))
+
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		req, err := http.NewRequest(http.MethodConnect, "http://"+echoAddr, nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
+
+func TestProxy_http_chain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Request goes straight to destination through tunnel, credentials must not leak
+		assert.Empty(t, r.Header.Get(HeaderProxyAuthorization))
+		assert.Equal(t, "/path", r.URL.String())
+		// nolint:errcheck
+		w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	partnerAddr, partnerRequests := serveConnect(t, basicAuthorization("partner", "Partner123"))
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	addr := newTestProxy(t, "http://"+downstreamAddr, withChain(t, "http://"+partnerAddr+";user=partner;password=Partner123"))
+
+	proxyURL, err := url.Parse("http://" + addr)
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := httpClient.Get(srv.URL + "/path")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "pong", string(b))
+
+	assert.Equal(t, partnerAddr, (<-downstreamRequests).host)
+	assert.Equal(t, connectRequest{host: srv.Listener.Addr().String()}, <-partnerRequests)
+	assert.Equal(t, srv.Listener.Addr().String(), (<-partnerRequests).host)
+}
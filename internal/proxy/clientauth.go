@@ -0,0 +1,175 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/L11R/escobar/internal/logging"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HeaderProxyAuthenticate = "Proxy-Authenticate"
+
+	// internalScheme is used by the proxy itself, e.g. while checking credentials against Ping URL
+	internalScheme = "Escobar"
+	// ctxCredentials is the context key gokrb5 uses to pass SPNEGO credentials
+	ctxCredentials = "github.com/jcmturner/gokrb5/v8/ctxCredentials"
+	// dummyHash is compared against for unknown users to not reveal existing ones by timing
+	dummyHash = "$2a$10$5EcJcWht6y3lNZOd8LynNeQPLEAbA3a3UZZLqAkxaZG2ZfB7kxeEO"
+)
+
+// newInternalToken returns random token to authenticate requests made by the proxy itself.
+func newInternalToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// internalAuthorization returns Proxy-Authorization header value for requests made by the proxy itself.
+func (p *Proxy) internalAuthorization() string {
+	return internalScheme + " " + p.internalToken
+}
+
+// authenticateClient checks client credentials. It responds with 407 and returns false if client is not authenticated.
+// Kerberos client of the user is returned in gateway mode, it must be released once request is done.
+func (p *Proxy) authenticateClient(rw http.ResponseWriter, req *http.Request) (string, *gatewayClient, bool) {
+	header := req.Header.Get(HeaderProxyAuthorization)
+	if subtle.ConstantTimeCompare([]byte(header), []byte(p.internalAuthorization())) == 1 {
+		return "", nil, true
+	}
+	// Gateway mode needs client credentials to obtain Kerberos identity, certificate is not enough
+	if user, ok := clientCertificateUser(req); ok && p.config.Mode != GatewayMode {
+		return user, nil, true
+	}
+
+	var (
+		user   string
+		krb5cl *gatewayClient
+		err    error
+	)
+	switch mode := p.config.ClientAuth.Mode; {
+	// Gateway mode authenticates clients against KDC regardless of client authentication mode
+	case p.config.Mode == GatewayMode:
+		user, krb5cl, err = p.gateway.authenticate(header)
+	case mode == BasicClientAuth:
+		user, err = p.authenticateBasic(header)
+	case mode == NegotiateClientAuth:
+		user, err = p.authenticateNegotiate(req, header)
+	default:
+		return "", nil, true
+	}
+
+	logger := p.logger.Named(logging.AuthSubsystem).With(
+		zap.String("client_addr", req.RemoteAddr),
+		zap.String("http_method", req.Method),
+		zap.String("uri", req.RequestURI),
+		zap.String("client_user", user),
+	)
+
+	if err != nil {
+		logger.Warn("Client authentication failed", zap.Error(err))
+
+		switch {
+		case p.config.Mode == GatewayMode, p.config.ClientAuth.Mode == BasicClientAuth:
+			rw.Header().Set(HeaderProxyAuthenticate, `Basic realm="Escobar"`)
+		case p.config.ClientAuth.Mode == NegotiateClientAuth:
+			rw.Header().Set(HeaderProxyAuthenticate, "Negotiate")
+		}
+		http.Error(rw, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+
+		return user, nil, false
+	}
+
+	logger.Debug("Client authenticated")
+	return user, krb5cl, true
+}
+
+// clientCertificateUser returns common name of client certificate verified by TLS listener.
+func clientCertificateUser(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+func (p *Proxy) authenticateBasic(header string) (string, error) {
+	scheme, value, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", errors.New("no basic credentials provided")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode credentials: %w", err)
+	}
+
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", errors.New("invalid credentials format")
+	}
+
+	hash, ok := p.config.ClientAuth.Htpasswd[user]
+	if !ok {
+		hash = []byte(dummyHash)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return user, errors.New("invalid user or password")
+	}
+
+	return user, nil
+}
+
+func (p *Proxy) authenticateNegotiate(req *http.Request, header string) (string, error) {
+	scheme, value, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Negotiate") {
+		return "", errors.New("no negotiate token provided")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode token: %w", err)
+	}
+
+	var token spnego.SPNEGOToken
+	if err := token.Unmarshal(b); err != nil {
+		return "", fmt.Errorf("cannot unmarshal token: %w", err)
+	}
+
+	var settings []func(*service.Settings)
+	if p.config.ClientAuth.ServicePrincipal != "" {
+		settings = append(settings, service.KeytabPrincipal(p.config.ClientAuth.ServicePrincipal))
+	}
+
+	ok, ctx, status := spnego.SPNEGOService(p.config.ClientAuth.Keytab, settings...).AcceptSecContext(&token)
+	if status.Code != gssapi.StatusComplete || !ok {
+		return "", fmt.Errorf("token validation failed: %s", status.Message)
+	}
+
+	creds, ok := ctx.Value(ctxCredentials).(*credentials.Credentials)
+	if !ok {
+		return "", errors.New("no credentials in security context")
+	}
+
+	return creds.UserName() + "@" + creds.Domain(), nil
+}
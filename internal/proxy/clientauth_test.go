@@ -0,0 +1,167 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_parseHtpasswd(t *testing.T) {
+	users, err := parseHtpasswd(strings.NewReader(`
+# team members
+ivanovii:$2y$05$abcdefghijklmnopqrstuu8B6R0xA0S/Y7ulDP5RZ3TqyIyNUE6Hy
+petrovpp:$2a$05$abcdefghijklmnopqrstuu8B6R0xA0S/Y7ulDP5RZ3TqyIyNUE6Hy
+`))
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	_, err = parseHtpasswd(strings.NewReader("ivanovii:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="))
+	assert.Error(t, err)
+}
+
+func TestProxy_authenticateClient(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("test_password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	p := NewProxy(
+		zap.NewNop(),
+		&Config{
+			ClientAuth: ClientAuth{
+				Mode:     BasicClientAuth,
+				Htpasswd: map[string][]byte{"test_user": hash},
+			},
+		},
+		nil,
+	)
+
+	newRequest := func(user, password string) *http.Request {
+		req := httptest.NewRequest(http.MethodConnect, "http://www.google.com:443", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+			req.Header.Set(HeaderProxyAuthorization, req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		}
+		return req
+	}
+
+	t.Run("valid credentials", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+
+		user, _, ok := p.authenticateClient(rw, newRequest("test_user", "test_password"))
+		assert.True(t, ok)
+		assert.Equal(t, "test_user", user)
+	})
+
+	t.Run("invalid password", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+
+		_, _, ok := p.authenticateClient(rw, newRequest("test_user", "wrong_password"))
+		assert.False(t, ok)
+		assert.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+		assert.Equal(t, `Basic realm="Escobar"`, rw.Header().Get(HeaderProxyAuthenticate))
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+
+		_, _, ok := p.authenticateClient(rw, newRequest("unknown_user", "test_password"))
+		assert.False(t, ok)
+		assert.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+
+		_, _, ok := p.authenticateClient(rw, newRequest("", ""))
+		assert.False(t, ok)
+		assert.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+	})
+
+	t.Run("internal request", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := newRequest("", "")
+		req.Header.Set(HeaderProxyAuthorization, p.internalAuthorization())
+
+		_, _, ok := p.authenticateClient(rw, req)
+		assert.True(t, ok)
+	})
+
+	p.config.ClientAuth.Mode = NegotiateClientAuth
+
+	t.Run("no negotiate token", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+
+		_, _, ok := p.authenticateClient(rw, newRequest("test_user", "test_password"))
+		assert.False(t, ok)
+		assert.Equal(t, http.StatusProxyAuthRequired, rw.Code)
+		assert.Equal(t, "Negotiate", rw.Header().Get(HeaderProxyAuthenticate))
+	})
+}
+
+func TestProxy_InternalTransport(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("test_password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nolint:errcheck
+		w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "test_password"))
+	u, err := url.Parse("http://" + downstreamAddr)
+	require.NoError(t, err)
+
+	p := NewProxy(zap.NewNop(), &Config{
+		DownstreamProxyURL: u,
+		DownstreamProxyAuth: DownstreamProxyAuth{
+			User:     "test_user",
+			Password: "test_password",
+		},
+		// Clients must authenticate, the proxy itself is trusted
+		ClientAuth: ClientAuth{
+			Mode:     BasicClientAuth,
+			Htpasswd: map[string][]byte{"test_user": hash},
+		},
+		Policy: Policy{ConnectPorts: []int{0}},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+		Mode: BasicMode,
+	}, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	defer p.Shutdown(context.Background())
+
+	tr := p.InternalTransport(l.Addr().(*net.TCPAddr))
+	defer tr.CloseIdleConnections()
+	tr.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	resp, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Default transport is shared by the whole process, it's left untouched
+	assert.NotSame(t, http.DefaultTransport, tr)
+	assert.Nil(t, http.DefaultTransport.(*http.Transport).ProxyConnectHeader)
+}
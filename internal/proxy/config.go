@@ -5,13 +5,23 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
+
+	"github.com/L11R/escobar/internal/secrets"
+	"github.com/jcmturner/gokrb5/v8/keytab"
 )
 
 const krb5conf = `[libdefaults]
@@ -28,19 +38,45 @@ const (
 	AutoMode   Mode = "auto"
 	ManualMode Mode = "manual"
 	BasicMode  Mode = "basic"
+	// GatewayMode authenticates every client with own Kerberos identity obtained with client Basic credentials
+	GatewayMode Mode = "gateway"
 )
 
 type Config struct {
-	AddrString string       `short:"a" long:"addr" env:"ADDR" description:"Proxy address" default:"localhost:3128" json:"addr"`
+	AddrString string       `short:"a" long:"addr" env:"ADDR" description:"Proxy address, empty to listen on unix socket only" default:"localhost:3128" json:"addr"`
 	Addr       *net.TCPAddr `no-flag:"yes" json:"-"`
 
-	DownstreamProxyURLString string   `short:"d" long:"downstream-proxy-url" env:"DOWNSTREAM_PROXY_URL" description:"Downstream proxy URL" value-name:"http://proxy.evil.corp:9090" required:"yes" json:"downstreamProxyURL"`
-	DownstreamProxyURL       *url.URL `no-flag:"yes" json:"-"`
-        DownstreamProxyDialRetries int `short:"r" long:"downstream-proxy-dial-retries" env:"DOWNSTREAM_PROXY_DIAL_RETRIES" description:"Downstream proxy dial retries" value-name:"0" required:"no" default:"0" json:"downstreamProxyDialRetries"`
+	ListenStrings []string   `long:"listen" env:"LISTEN" env-delim:" " description:"Additional proxy address with optional own ACL" value-name:"172.17.0.1:3128;allow=172.17.0.0/16" json:"listen"`
+	Listeners     []Listener `no-flag:"yes" json:"-"`
+
+	DownstreamProxyURLString   string   `short:"d" long:"downstream-proxy-url" env:"DOWNSTREAM_PROXY_URL" description:"Downstream proxy URL: http, https, socks5 or socks5h" value-name:"http://proxy.evil.corp:9090" required:"yes" json:"downstreamProxyURL"`
+	DownstreamProxyURL         *url.URL `no-flag:"yes" json:"-"`
+	DownstreamProxyDialRetries int      `short:"r" long:"downstream-proxy-dial-retries" env:"DOWNSTREAM_PROXY_DIAL_RETRIES" description:"Downstream proxy dial retries" value-name:"0" required:"no" default:"0" json:"downstreamProxyDialRetries"`
+
+	ChainStrings []string `long:"chain" env:"CHAIN" env-delim:" " description:"Proxy behind downstream one with optional own authentication, repeat to chain several in order" value-name:"http://partner.corp:8080;mode=basic;user=ivanovii;password=env:PARTNER_PASSWORD" json:"chain"`
+	Chain        []Hop    `no-flag:"yes" json:"-"`
+
+	Unix UnixSocket  `group:"Unix socket" namespace:"unix" env-namespace:"UNIX" json:"unix"`
+	TLS  ListenerTLS `group:"Proxy TLS" namespace:"tls" env-namespace:"TLS" json:"tls"`
 
 	DownstreamProxyAuth DownstreamProxyAuth `group:"Downstream Proxy authentication" namespace:"downstream-proxy-auth" env-namespace:"DOWNSTREAM_PROXY_AUTH" json:"downstreamProxyAuth"`
+	DownstreamProxyTLS  DownstreamProxyTLS  `group:"Downstream Proxy TLS" namespace:"downstream-proxy-tls" env-namespace:"DOWNSTREAM_PROXY_TLS" json:"downstreamProxyTLS"`
+
+	ACL ACL `group:"Access control" namespace:"acl" env-namespace:"ACL" json:"acl"`
+
+	Policy  Policy  `group:"Destination policy" namespace:"policy" env-namespace:"POLICY" json:"policy"`
+	Routing Routing `group:"Routing" namespace:"routing" env-namespace:"ROUTING" json:"routing"`
+	MITM    MITM    `group:"TLS interception" namespace:"mitm" env-namespace:"MITM" json:"mitm"`
+	Headers Headers `group:"Header rules" namespace:"headers" env-namespace:"HEADERS" json:"headers"`
+
+	Limits    Limits    `group:"Limits" namespace:"limits" env-namespace:"LIMITS" json:"limits"`
+	Bandwidth Bandwidth `group:"Bandwidth" namespace:"bandwidth" env-namespace:"BANDWIDTH" json:"bandwidth"`
+	Cache     Cache     `group:"Cache" namespace:"cache" env-namespace:"CACHE" json:"cache"`
+
+	ClientAuth ClientAuth `group:"Client authentication" namespace:"client-auth" env-namespace:"CLIENT_AUTH" json:"clientAuth"`
 
 	Kerberos Kerberos `group:"Kerberos options" namespace:"kerberos" env-namespace:"KERBEROS" json:"kerberos"`
+	Gateway  Gateway  `group:"Gateway mode" namespace:"gateway" env-namespace:"GATEWAY" json:"gateway"`
 	Timeouts Timeouts `group:"Timeouts" namespace:"timeouts" env-namespace:"TIMEOUTS" json:"timeouts"`
 
 	PingURLString string   `long:"ping-url" env:"PING_URL" description:"URL to ping anc check credentials validity" default:"https://www.google.com/" json:"pingURL"`
@@ -49,10 +85,407 @@ type Config struct {
 	Mode Mode `short:"m" long:"mode" env:"MODE" description:"Escobar mode" default:"auto" json:"mode"`
 }
 
+type UnixSocket struct {
+	Path string `long:"path" env:"PATH" description:"Path to unix socket to listen on in addition to proxy address" value-name:"/run/escobar/proxy.sock" json:"path"`
+
+	ModeString string      `long:"mode" env:"MODE" description:"Unix socket file mode" default:"0660" json:"mode"`
+	Mode       os.FileMode `no-flag:"yes" json:"-"`
+
+	Owner string `long:"owner" env:"OWNER" description:"Unix socket owner and optional group" value-name:"escobar:docker" json:"owner"`
+}
+
+// Resolve parses unix socket file mode.
+func (u *UnixSocket) Resolve() error {
+	mode, err := strconv.ParseUint(u.ModeString, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid unix socket mode %q", u.ModeString)
+	}
+	u.Mode = os.FileMode(mode)
+
+	return nil
+}
+
 type DownstreamProxyAuth struct {
-	User     string `short:"u" long:"user" env:"USER" description:"Downstream Proxy user" json:"user"`
-	Password string `short:"p" long:"password" env:"PASSWORD" description:"Downstream Proxy password" json:"password"`
-	Keytab   string `short:"k" long:"keytab" env:"KEYTAB" description:"Downstream Proxy path to keytab-file" json:"keytab"`
+	User string `short:"u" long:"user" env:"USER" description:"Downstream Proxy user" json:"user"`
+
+	PasswordString string `short:"p" long:"password" env:"PASSWORD" description:"Downstream Proxy password or reference (file:, env:, exec:)" json:"password"`
+	Password       string `no-flag:"yes" json:"-"`
+
+	KeytabString string         `short:"k" long:"keytab" env:"KEYTAB" description:"Downstream Proxy path to keytab-file or reference (file:, env: with base64, exec:)" json:"keytab"`
+	Keytab       *keytab.Keytab `no-flag:"yes" json:"-"`
+}
+
+// Resolve resolves password and keytab references into their values.
+func (a *DownstreamProxyAuth) Resolve() error {
+	password, err := secrets.ResolveString(a.PasswordString)
+	if err != nil {
+		return fmt.Errorf("cannot resolve password: %w", err)
+	}
+	a.Password = password
+
+	a.Keytab, err = resolveKeytab(a.KeytabString)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// resolveKeytab reads keytab from path or reference, returns nil if ref is empty.
+func resolveKeytab(ref string) (*keytab.Keytab, error) {
+	if ref == "" {
+		return nil, nil
+	}
+
+	// Plain value is a path to keytab-file
+	if !secrets.IsReference(ref) {
+		ref = secrets.FilePrefix + ref
+	}
+
+	b, err := secrets.Resolve(ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve keytab: %w", err)
+	}
+
+	// Environment variables cannot hold binary data
+	if strings.HasPrefix(ref, secrets.EnvPrefix) {
+		b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode keytab: %w", err)
+		}
+	}
+
+	kt := keytab.New()
+	if err := kt.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("cannot read keytab: %w", err)
+	}
+
+	return kt, nil
+}
+
+// DownstreamProxyTLS configures TLS session with https:// downstream proxy.
+type DownstreamProxyTLS struct {
+	CAString   string `long:"ca" env:"CA" description:"PEM bundle with CA certificates to verify downstream proxy, system ones are used if empty" value-name:"/etc/escobar/ca.pem" json:"ca"`
+	CertString string `long:"cert" env:"CERT" description:"Client certificate in PEM format for mutual TLS" value-name:"/etc/escobar/client.pem" json:"cert"`
+	KeyString  string `long:"key" env:"KEY" description:"Client private key in PEM format or reference (file:, env:, exec:)" value-name:"/etc/escobar/client.key" json:"key"`
+	ServerName string `long:"server-name" env:"SERVER_NAME" description:"Server name sent in SNI and verified in certificate, downstream proxy host by default" json:"serverName"`
+
+	Config *tls.Config `no-flag:"yes" json:"-"`
+}
+
+// Resolve loads CA bundle and client certificate, host is used as server name unless it's overridden.
+func (t *DownstreamProxyTLS) Resolve(host string) error {
+	t.Config = &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.ServerName != "" {
+		t.Config.ServerName = t.ServerName
+	}
+
+	if t.CAString != "" {
+		b, err := os.ReadFile(t.CAString)
+		if err != nil {
+			return fmt.Errorf("cannot read CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in CA bundle %q", t.CAString)
+		}
+		t.Config.RootCAs = pool
+	}
+
+	if (t.CertString == "") != (t.KeyString == "") {
+		return fmt.Errorf("both client certificate and private key are required")
+	}
+	if t.CertString == "" {
+		return nil
+	}
+
+	cert, err := loadKeyPair(t.CertString, t.KeyString)
+	if err != nil {
+		return fmt.Errorf("client certificate: %w", err)
+	}
+	t.Config.Certificates = []tls.Certificate{cert}
+
+	return nil
+}
+
+// loadKeyPair reads certificate from path and its private key from path or reference.
+func loadKeyPair(certPath, keyRef string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot read certificate: %w", err)
+	}
+
+	// Plain value is a path to private key
+	if !secrets.IsReference(keyRef) {
+		keyRef = secrets.FilePrefix + keyRef
+	}
+	keyPEM, err := secrets.Resolve(keyRef)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot resolve private key: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot load certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// loadOrGenerateKeyPair loads certificate and its private key, both are generated and saved if neither file exists.
+// Private key referenced as secret is never generated.
+func loadOrGenerateKeyPair(certPath, keyRef string, generate func() (tls.Certificate, error)) (tls.Certificate, error) {
+	if secrets.IsReference(keyRef) {
+		return loadKeyPair(certPath, keyRef)
+	}
+
+	switch certMissing, keyMissing := isNotExist(certPath), isNotExist(keyRef); {
+	case certMissing && keyMissing:
+		cert, err := generate()
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("cannot generate certificate: %w", err)
+		}
+		if err := saveKeyPair(cert, certPath, keyRef); err != nil {
+			return tls.Certificate{}, err
+		}
+
+		return cert, nil
+	case certMissing:
+		return tls.Certificate{}, fmt.Errorf("certificate %q doesn't exist, but private key %q does", certPath, keyRef)
+	case keyMissing:
+		return tls.Certificate{}, fmt.Errorf("private key %q doesn't exist, but certificate %q does", keyRef, certPath)
+	}
+
+	return loadKeyPair(certPath, keyRef)
+}
+
+type ACL struct {
+	AllowStrings []string     `long:"allow" env:"ALLOW" env-delim:"," description:"Allowed client networks, everyone is allowed if empty" value-name:"172.17.0.0/16" json:"allow"`
+	Allow        []*net.IPNet `no-flag:"yes" json:"-"`
+
+	DenyStrings []string     `long:"deny" env:"DENY" env-delim:"," description:"Denied client networks, takes precedence over allowed ones" value-name:"172.17.0.1/32" json:"deny"`
+	Deny        []*net.IPNet `no-flag:"yes" json:"-"`
+}
+
+// Resolve parses allowed and denied networks, plain IP addresses are accepted as well.
+func (a *ACL) Resolve() error {
+	var err error
+
+	a.Allow, err = parseNetworks(a.AllowStrings)
+	if err != nil {
+		return fmt.Errorf("invalid allowed network: %w", err)
+	}
+
+	a.Deny, err = parseNetworks(a.DenyStrings)
+	if err != nil {
+		return fmt.Errorf("invalid denied network: %w", err)
+	}
+
+	return nil
+}
+
+// Allowed returns true if ip is not denied and is allowed (or there is no allowed networks at all).
+func (a *ACL) Allowed(ip net.IP) bool {
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.Allow) == 0 {
+		return true
+	}
+
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Empty returns true if ACL doesn't restrict anything.
+func (a *ACL) Empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", network)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+type Policy struct {
+	ConnectPorts   []int         `long:"connect-port" env:"CONNECT_PORTS" env-delim:"," description:"Allowed CONNECT ports, 0 allows any port" default:"443" json:"connectPorts"`
+	Blocklists     []string      `long:"blocklist" env:"BLOCKLISTS" env-delim:"," description:"Files with blocked domains in hosts-file or plain format" json:"blocklists"`
+	ReloadInterval time.Duration `long:"reload-interval" env:"RELOAD_INTERVAL" description:"How often blocklist files are checked for changes" default:"30s" json:"reloadInterval"`
+}
+
+type Routing struct {
+	UpstreamStrings []string        `long:"upstream" env:"UPSTREAMS" env-delim:" " description:"Named upstream proxy with optional own authentication" value-name:"github=http://gw.evil.corp:8080;mode=basic;user=ivanovii;password=env:GW_PASSWORD" json:"upstreams"`
+	Upstreams       map[string]*Hop `no-flag:"yes" json:"-"`
+	RuleStrings     []string        `long:"rule" env:"RULES" env-delim:" " description:"Routing rule, the first matching one is used, downstream proxy otherwise" value-name:"domain=*.github.com;action=github" json:"rules"`
+	Rules           []Rule          `no-flag:"yes" json:"-"`
+}
+
+type Limits struct {
+	Rate          float64 `long:"rate" env:"RATE" description:"Requests per second allowed for a single client IP, 0 disables limit" default:"0" json:"rate"`
+	Burst         int     `long:"burst" env:"BURST" description:"Requests a single client IP could make at once above the rate" default:"20" json:"burst"`
+	ClientTunnels int     `long:"client-tunnels" env:"CLIENT_TUNNELS" description:"Maximum concurrent CONNECT tunnels of a single client IP, 0 means unlimited" default:"0" json:"clientTunnels"`
+	Tunnels       int     `long:"tunnels" env:"TUNNELS" description:"Maximum concurrent CONNECT tunnels in total, 0 means unlimited" default:"0" json:"tunnels"`
+	Dials         int     `long:"dials" env:"DIALS" description:"Maximum open connections to downstream proxy, 0 means unlimited" default:"0" json:"dials"`
+}
+
+type Bandwidth struct {
+	Global int `long:"global" env:"GLOBAL" description:"Total bandwidth limit in KB/s, 0 means unlimited" default:"0" json:"global"`
+	Client int `long:"client" env:"CLIENT" description:"Bandwidth limit of a single client IP in KB/s, 0 means unlimited" default:"0" json:"client"`
+
+	DomainStrings []string       `long:"domain" env:"DOMAINS" env-delim:"," description:"Bandwidth limit of destination domain and its subdomains in KB/s" value-name:"artifactory.evil.corp=1024" json:"domains"`
+	Domains       map[string]int `no-flag:"yes" json:"-"`
+
+	Burst int `long:"burst" env:"BURST" description:"Burst allowance in KB above every limit" default:"256" json:"burst"`
+}
+
+// Resolve parses domain limits.
+func (b *Bandwidth) Resolve() error {
+	if b.Global < 0 || b.Client < 0 {
+		return fmt.Errorf("bandwidth limit cannot be negative")
+	}
+	if b.Burst < 1 {
+		return fmt.Errorf("bandwidth burst should be at least 1 KB")
+	}
+
+	b.Domains = make(map[string]int, len(b.DomainStrings))
+	for _, s := range b.DomainStrings {
+		domain, limitString, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("invalid domain bandwidth limit %q, expected domain=KB/s", s)
+		}
+
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid domain bandwidth limit %q, expected domain=KB/s", s)
+		}
+
+		b.Domains[strings.TrimSuffix(strings.ToLower(domain), ".")] = limit
+	}
+
+	return nil
+}
+
+type ClientAuthMode string
+
+const (
+	NoneClientAuth      ClientAuthMode = "none"
+	BasicClientAuth     ClientAuthMode = "basic"
+	NegotiateClientAuth ClientAuthMode = "negotiate"
+)
+
+type ClientAuth struct {
+	Mode ClientAuthMode `long:"mode" env:"MODE" description:"Inbound client authentication mode" choice:"none" choice:"basic" choice:"negotiate" default:"none" json:"mode"`
+
+	HtpasswdString string            `long:"htpasswd" env:"HTPASSWD" description:"Path to htpasswd-file with bcrypt hashes, used in basic mode" json:"htpasswd"`
+	Htpasswd       map[string][]byte `no-flag:"yes" json:"-"`
+
+	KeytabString string         `long:"keytab" env:"KEYTAB" description:"Path to service keytab-file or reference (file:, env: with base64, exec:), used in negotiate mode" json:"keytab"`
+	Keytab       *keytab.Keytab `no-flag:"yes" json:"-"`
+
+	ServicePrincipal string `long:"spn" env:"SPN" description:"Service principal to look up in keytab-file" value-name:"HTTP/escobar.evil.corp" json:"spn"`
+}
+
+// Resolve loads htpasswd-file or service keytab depending on mode.
+func (a *ClientAuth) Resolve() error {
+	switch a.Mode {
+	case BasicClientAuth:
+		if a.HtpasswdString == "" {
+			return fmt.Errorf("basic client authentication requires htpasswd-file")
+		}
+
+		f, err := os.Open(a.HtpasswdString)
+		if err != nil {
+			return fmt.Errorf("cannot open htpasswd-file: %w", err)
+		}
+		//noinspection ALL
+		defer f.Close()
+
+		a.Htpasswd, err = parseHtpasswd(f)
+		if err != nil {
+			return err
+		}
+	case NegotiateClientAuth:
+		if a.KeytabString == "" {
+			return fmt.Errorf("negotiate client authentication requires service keytab")
+		}
+
+		var err error
+		a.Keytab, err = resolveKeytab(a.KeytabString)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseHtpasswd parses htpasswd-file, only bcrypt hashes are supported.
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid htpasswd-file line %d", n)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return nil, fmt.Errorf("htpasswd-file line %d: only bcrypt hashes are supported", n)
+		}
+
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read htpasswd-file: %w", err)
+	}
+
+	return users, nil
+}
+
+type Gateway struct {
+	CacheTTL time.Duration `long:"cache-ttl" env:"CACHE_TTL" description:"How long Kerberos client of authenticated user is cached" default:"8h" json:"cacheTTL"`
 }
 
 type Kerberos struct {
@@ -87,6 +520,7 @@ type ServerTimeouts struct {
 	ReadHeaderTimeout time.Duration `long:"read-header" env:"READ_HEADER" default:"30s" description:"HTTP server read header timeout" json:"readHeaderTimeout"`
 	WriteTimeout      time.Duration `long:"write" env:"WRITE" default:"0s" description:"HTTP server write timeout" json:"writeTimeout"`
 	IdleTimeout       time.Duration `long:"idle" env:"IDLE" default:"1m" description:"HTTP server idle timeout" json:"idleTimeout"`
+	DrainTimeout      time.Duration `long:"drain" env:"DRAIN" default:"30s" description:"Grace period for active tunnels to finish on shutdown" json:"drainTimeout"`
 }
 
 type ClientTimeouts struct {
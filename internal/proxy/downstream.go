@@ -0,0 +1,256 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// channelBindingsCtx holds RFC 5929 tls-server-end-point channel bindings of downstream proxy TLS session
+const channelBindingsCtx ctxKey = "channel_bindings"
+
+// DownstreamProxyAddr returns downstream proxy address, port defaults to the one of URL scheme.
+func (c *Config) DownstreamProxyAddr() string {
+	if c.DownstreamProxyURL.Port() != "" {
+		return c.DownstreamProxyURL.Host
+	}
+
+	port := "80"
+	switch c.DownstreamProxyURL.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+
+	return net.JoinHostPort(c.DownstreamProxyURL.Hostname(), port)
+}
+
+// dialDownstream connects to downstream proxy, TLS session is established with https one and its channel bindings are
+// put into returned context.
+func (p *Proxy) dialDownstream(ctx context.Context) (net.Conn, context.Context, error) {
+	conn, err := p.dialContext(ctx, "tcp", p.config.DownstreamProxyAddr())
+	if err != nil {
+		return nil, ctx, err
+	}
+	if p.config.DownstreamProxyURL.Scheme != "https" {
+		return conn, ctx, nil
+	}
+
+	hctx := ctx
+	if timeout := p.config.Timeouts.DownstreamProxy.DialTimeout; timeout != 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tconn, err := p.config.DownstreamProxyTLS.Client(hctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, ctx, err
+	}
+
+	// Kerberos token is bound to this session
+	bindings := tlsServerEndPoint(tconn.ConnectionState().PeerCertificates[0])
+	return tconn, context.WithValue(ctx, channelBindingsCtx, bindings), nil
+}
+
+// bindsChannel reports whether Kerberos token of plain HTTP request has to be bound to TLS session with downstream
+// proxy, so the request is sent through its own connection.
+func (c *Config) bindsChannel() bool {
+	return c.DownstreamProxyTLS.Config != nil && (c.Mode == ManualMode || c.Mode == GatewayMode)
+}
+
+// downstreamTransport sends every plain HTTP request through new TLS session with downstream proxy, Proxy-Authorization
+// header is set once the session is established, so token is bound to the connection request goes through.
+type downstreamTransport struct {
+	p *Proxy
+}
+
+func (t *downstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, ctx, err := t.p.dialDownstream(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	outreq := req.Clone(ctx)
+	outreq.Close = true
+	if err := t.p.setProxyAuthorizationHeader(outreq); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot set authorization header: %w", err)
+	}
+
+	// Connection is dropped once request is canceled, otherwise it's closed with response body
+	done := make(chan struct{})
+	var once sync.Once
+	closeConn := func() error {
+		var err error
+		once.Do(func() {
+			close(done)
+			err = conn.Close()
+		})
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// nolint:errcheck
+			closeConn()
+		case <-done:
+		}
+	}()
+
+	if err := outreq.WriteProxy(conn); err != nil {
+		// nolint:errcheck
+		closeConn()
+		return nil, fmt.Errorf("cannot write request into downstream proxy connection: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), outreq)
+	if err != nil {
+		// nolint:errcheck
+		closeConn()
+		return nil, fmt.Errorf("cannot read response from downstream proxy connection: %w", err)
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, close: closeConn}
+
+	return resp, nil
+}
+
+// connBody closes connection along with response body.
+type connBody struct {
+	io.ReadCloser
+	close func() error
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+
+	return err
+}
+
+// Client establishes TLS session with downstream proxy over conn.
+func (t *DownstreamProxyTLS) Client(ctx context.Context, conn net.Conn) (*tls.Conn, error) {
+	tconn := tls.Client(conn, t.Config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("cannot establish TLS session with downstream proxy: %w", err)
+	}
+
+	return tconn, nil
+}
+
+// tlsServerEndPoint returns tls-server-end-point channel bindings of server certificate, RFC 5929 section 4.
+func tlsServerEndPoint(cert *x509.Certificate) []byte {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced with SHA-256 as well
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+
+	return append([]byte("tls-server-end-point:"), h.Sum(nil)...)
+}
+
+// authenticatorChecksum returns GSS-API checksum of Kerberos authenticator with channel bindings, RFC 4121 section 4.1.1.
+func authenticatorChecksum(bindings []byte, flags ...int) []byte {
+	// gss_channel_bindings_struct without initiator and acceptor addresses
+	cb := make([]byte, 20+len(bindings))
+	binary.LittleEndian.PutUint32(cb[16:20], uint32(len(bindings)))
+	copy(cb[20:], bindings)
+	// MD5 is required by RFC 4121
+	// nolint:gosec
+	sum := md5.Sum(cb)
+
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(sum)))
+	copy(b[4:20], sum[:])
+	for _, f := range flags {
+		binary.LittleEndian.PutUint32(b[20:24], binary.LittleEndian.Uint32(b[20:24])|uint32(f))
+	}
+
+	return b
+}
+
+// negotiateHeader returns SPNEGO header with channel bindings, gokrb5 always sends empty ones.
+func negotiateHeader(krb5cl *client.Client, spn string, bindings []byte) (string, error) {
+	if err := krb5cl.AffirmLogin(); err != nil {
+		return "", fmt.Errorf("could not acquire client credential: %w", err)
+	}
+
+	tkt, key, err := krb5cl.GetServiceTicket(spn)
+	if err != nil {
+		return "", fmt.Errorf("cannot get service ticket: %w", err)
+	}
+
+	flags := []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}
+	token, err := spnego.NewKRB5TokenAPREQ(krb5cl, tkt, key, flags, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot create KRB5 token: %w", err)
+	}
+
+	// Replace authenticator with the one carrying channel bindings
+	auth, err := types.NewAuthenticator(krb5cl.Credentials.Domain(), krb5cl.Credentials.CName())
+	if err != nil {
+		return "", fmt.Errorf("cannot create authenticator: %w", err)
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  authenticatorChecksum(bindings, flags...),
+	}
+	token.APReq, err = messages.NewAPReq(tkt, key, auth)
+	if err != nil {
+		return "", fmt.Errorf("cannot create AP-REQ: %w", err)
+	}
+
+	mechToken, err := token.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal KRB5 token: %w", err)
+	}
+
+	negToken := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mechToken,
+		},
+	}
+	b, err := negToken.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal SPNEGO token: %w", err)
+	}
+
+	return "Negotiate " + base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/undefinedlabs/go-mpatch"
+	"go.uber.org/zap"
+)
+
+// issueCertificate creates certificate signed by parent, it's self-signed if parent is nil.
+func issueCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, any(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes certificate and its private key in PEM format into dir.
+func writeCertificate(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	certPath := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	return certPath, keyPath
+}
+
+func TestDownstreamProxyTLS_Resolve(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Evil Corp CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caPath, keyPath := writeCertificate(t, dir, "ca", ca)
+
+	c := DownstreamProxyTLS{}
+	require.NoError(t, c.Resolve("proxy.evil.corp"))
+	assert.Equal(t, "proxy.evil.corp", c.Config.ServerName)
+	assert.Nil(t, c.Config.RootCAs)
+	assert.Empty(t, c.Config.Certificates)
+
+	c = DownstreamProxyTLS{
+		CAString:   caPath,
+		CertString: caPath,
+		KeyString:  keyPath,
+		ServerName: "gateway.evil.corp",
+	}
+	require.NoError(t, c.Resolve("10.0.0.1"))
+	assert.Equal(t, "gateway.evil.corp", c.Config.ServerName)
+	assert.NotNil(t, c.Config.RootCAs)
+	assert.Len(t, c.Config.Certificates, 1)
+
+	// Private key could be passed by reference
+	b, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	t.Setenv("ESCOBAR_TEST_CLIENT_KEY", string(b))
+	c = DownstreamProxyTLS{CertString: caPath, KeyString: "env:ESCOBAR_TEST_CLIENT_KEY"}
+	require.NoError(t, c.Resolve("proxy.evil.corp"))
+	assert.Len(t, c.Config.Certificates, 1)
+
+	for _, invalid := range []DownstreamProxyTLS{
+		{CAString: filepath.Join(dir, "missing.pem")},
+		{CAString: keyPath},
+		{CertString: caPath},
+		{KeyString: keyPath},
+		{CertString: keyPath, KeyString: keyPath},
+	} {
+		assert.Error(t, invalid.Resolve("proxy.evil.corp"))
+	}
+}
+
+func TestConfig_DownstreamProxyAddr(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"http://proxy.evil.corp:9090": "proxy.evil.corp:9090",
+		"http://proxy.evil.corp":      "proxy.evil.corp:80",
+		"https://proxy.evil.corp":     "proxy.evil.corp:443",
+		"https://[::1]":               "[::1]:443",
+	} {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+
+		config := &Config{DownstreamProxyURL: u}
+		assert.Equal(t, expected, config.DownstreamProxyAddr())
+	}
+}
+
+func Test_channelBindings(t *testing.T) {
+	cert := issueCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"gateway.evil.corp"},
+	}, nil)
+
+	hash := sha256.Sum256(cert.Leaf.Raw)
+	bindings := tlsServerEndPoint(cert.Leaf)
+	assert.Equal(t, append([]byte("tls-server-end-point:"), hash[:]...), bindings)
+
+	checksum := authenticatorChecksum(bindings, gssapi.ContextFlagInteg, gssapi.ContextFlagConf)
+	require.Len(t, checksum, 24)
+	assert.Equal(t, uint32(16), binary.LittleEndian.Uint32(checksum[:4]))
+	assert.Equal(t, uint32(gssapi.ContextFlagInteg|gssapi.ContextFlagConf), binary.LittleEndian.Uint32(checksum[20:24]))
+
+	// Addresses are empty, only application data is hashed
+	cb := append(make([]byte, 16), byte(len(bindings)), 0, 0, 0)
+	// nolint:gosec
+	sum := md5.Sum(append(cb, bindings...))
+	assert.Equal(t, sum[:], checksum[4:20])
+}
+
+func TestProxy_https_tlsDownstream(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Evil Corp CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := issueCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"gateway.evil.corp"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := issueCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "escobar"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	caPath, _ := writeCertificate(t, dir, "ca", ca)
+	certPath, keyPath := writeCertificate(t, dir, "client", client)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	serverNames := make(chan string, 1)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	go acceptDownstream(l)
+
+	u, err := url.Parse("https://" + l.Addr().String())
+	require.NoError(t, err)
+
+	config := &Config{
+		DownstreamProxyURL: u,
+		DownstreamProxyTLS: DownstreamProxyTLS{
+			CAString:   caPath,
+			CertString: certPath,
+			KeyString:  keyPath,
+			ServerName: "gateway.evil.corp",
+		},
+		Policy: Policy{ConnectPorts: []int{0}},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+	}
+	require.NoError(t, config.DownstreamProxyTLS.Resolve(u.Hostname()))
+
+	p := NewProxy(zap.NewNop(), config, nil)
+
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(pl)
+	}()
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.DialTimeout("tcp", pl.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	req, err := http.NewRequest(http.MethodConnect, "http://www.google.com:443", nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "gateway.evil.corp", <-serverNames)
+
+	// Tunnel goes through TLS session with downstream proxy
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestProxy_http_channelBindings(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Evil Corp CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caPath, _ := writeCertificate(t, dir, "ca", ca)
+
+	// Every new session is established with another certificate, so tokens bound to other session are rejected
+	var servers []tls.Certificate
+	for i := 0; i < 2; i++ {
+		servers = append(servers, issueCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			DNSNames:     []string{"gateway.evil.corp"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, &ca))
+	}
+
+	var (
+		mu     sync.Mutex
+		served = make(map[net.Conn]*x509.Certificate)
+		n      int
+	)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			cert := &servers[n%len(servers)]
+			served[hello.Conn] = cert.Leaf
+			n++
+			return cert, nil
+		},
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				tconn := conn.(*tls.Conn)
+				req, err := http.ReadRequest(bufio.NewReader(tconn))
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				cert := served[tconn.NetConn()]
+				mu.Unlock()
+
+				code := http.StatusProxyAuthRequired
+				bindings := base64.StdEncoding.EncodeToString(tlsServerEndPoint(cert))
+				if req.Header.Get(HeaderProxyAuthorization) == "Negotiate "+bindings {
+					code = http.StatusOK
+				}
+				// nolint:errcheck
+				newResponse(code, nil, req).Write(conn)
+			}()
+		}
+	}()
+
+	patch, err := mpatch.PatchMethod(negotiateHeader, func(krb5cl *client.Client, spn string, bindings []byte) (string, error) {
+		return "Negotiate " + base64.StdEncoding.EncodeToString(bindings), nil
+	})
+	require.NoError(t, err)
+	// nolint:errcheck
+	defer patch.Unpatch()
+
+	u, err := url.Parse("https://" + l.Addr().String())
+	require.NoError(t, err)
+
+	config := &Config{
+		Mode:               ManualMode,
+		DownstreamProxyURL: u,
+		DownstreamProxyTLS: DownstreamProxyTLS{
+			CAString:   caPath,
+			ServerName: "gateway.evil.corp",
+		},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+	}
+	require.NoError(t, config.DownstreamProxyTLS.Resolve(u.Hostname()))
+
+	p := NewProxy(zap.NewNop(), config, nil)
+
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(pl)
+	}()
+	defer p.Shutdown(context.Background())
+
+	proxyURL, err := url.Parse("http://" + pl.Addr().String())
+	require.NoError(t, err)
+	c := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   10 * time.Second,
+	}
+
+	for i := 0; i < 2*len(servers); i++ {
+		resp, err := c.Get("http://www.evil.corp/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	mu.Lock()
+	assert.Equal(t, 2*len(servers), n)
+	mu.Unlock()
+
+	t.Run("upgrade", func(t *testing.T) {
+		// Downstream proxy drops connection after 407, token is sent again through new session
+		resp, _, _ := upgradeThrough(t, pl.Addr().String(), "http://www.evil.corp/", "websocket")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+)
+
+// gatewayClientCtx holds Kerberos client of the user authenticated by gateway
+const gatewayClientCtx ctxKey = "gateway_client"
+
+// gatewayUser is a cached Kerberos client of the user authenticated by gateway.
+type gatewayUser struct {
+	client   *gatewayClient
+	password []byte
+	expires  time.Time
+}
+
+// gatewayClient is Kerberos client shared by requests of the user. It's destroyed once it's replaced or evicted and
+// the last request using it releases it, otherwise it would keep renewing its TGT forever.
+type gatewayClient struct {
+	gateway *gateway
+	krb5cl  *client.Client
+
+	// refs counts requests using client, it's guarded by gateway mu along with retired
+	refs    int
+	retired bool
+}
+
+// gatewayLogin is login to KDC in progress, concurrent requests with the same credentials wait for it.
+type gatewayLogin struct {
+	done chan struct{}
+	// waiters are requests waiting for login, client is acquired for each of them
+	waiters int
+
+	client *gatewayClient
+	err    error
+}
+
+// gateway authenticates clients with their Basic credentials against KDC and keeps their Kerberos clients,
+// so every user authenticates to downstream proxy with own identity.
+type gateway struct {
+	config *Config
+	// key is used to keep password MACs instead of passwords themselves
+	key []byte
+	// login obtains TGT for the user
+	login func(user, realm, password string) (*client.Client, error)
+
+	mu     sync.Mutex
+	users  map[string]*gatewayUser
+	logins map[string]*gatewayLogin
+}
+
+func newGateway(config *Config) *gateway {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	g := &gateway{
+		config: config,
+		key:    key,
+		users:  make(map[string]*gatewayUser),
+		logins: make(map[string]*gatewayLogin),
+	}
+	g.login = g.loginKDC
+
+	return g
+}
+
+// authenticate checks Basic credentials, user logs in to KDC if there is no valid cached client. Returned client is
+// acquired by request and must be released once request is done.
+func (g *gateway) authenticate(header string) (string, *gatewayClient, error) {
+	scheme, value, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", nil, errors.New("no basic credentials provided")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot decode credentials: %w", err)
+	}
+
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok || user == "" {
+		return "", nil, errors.New("invalid credentials format")
+	}
+
+	// User could pass realm, but Kerberos config knows the configured one only
+	realm := g.config.Kerberos.Realm
+	if i := strings.LastIndexByte(user, '@'); i >= 0 {
+		if !strings.EqualFold(user[i+1:], realm) {
+			return user, nil, fmt.Errorf("realm %s is not supported, only %s is", user[i+1:], realm)
+		}
+		user = user[:i]
+	}
+	name := user + "@" + realm
+
+	mac := g.mac(password)
+	// Logins with another password aren't shared, KDC decides which one is valid
+	loginKey := name + ":" + string(mac)
+
+	g.mu.Lock()
+	cached, ok := g.users[name]
+	if ok && time.Now().Before(cached.expires) && hmac.Equal(cached.password, mac) {
+		cached.client.refs++
+		g.mu.Unlock()
+		return name, cached.client, nil
+	}
+	if login, ok := g.logins[loginKey]; ok {
+		login.waiters++
+		g.mu.Unlock()
+
+		<-login.done
+		return name, login.client, login.err
+	}
+	login := &gatewayLogin{done: make(chan struct{})}
+	g.logins[loginKey] = login
+	g.mu.Unlock()
+
+	krb5cl, err := g.login(user, realm, password)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer close(login.done)
+	delete(g.logins, loginKey)
+
+	if err != nil {
+		login.err = fmt.Errorf("cannot login: %w", err)
+		return name, nil, login.err
+	}
+	login.client = &gatewayClient{gateway: g, krb5cl: krb5cl, refs: 1 + login.waiters}
+
+	// Replace expired client or the one obtained with another password
+	now := time.Now()
+	if old, ok := g.users[name]; ok {
+		old.client.retire()
+	}
+	g.users[name] = &gatewayUser{
+		client:   login.client,
+		password: mac,
+		expires:  now.Add(g.config.Gateway.CacheTTL),
+	}
+	g.evict(now)
+
+	return name, login.client, nil
+}
+
+// evict removes expired users, should be called with mu held.
+func (g *gateway) evict(now time.Time) {
+	for name, cached := range g.users {
+		if now.After(cached.expires) {
+			delete(g.users, name)
+			cached.client.retire()
+		}
+	}
+}
+
+// retire marks client as no longer cached, it's destroyed once it isn't used. Should be called with gateway mu held.
+func (c *gatewayClient) retire() {
+	c.retired = true
+	c.destroyUnused()
+}
+
+// release is called by request once it doesn't use client anymore.
+func (c *gatewayClient) release() {
+	c.gateway.mu.Lock()
+	defer c.gateway.mu.Unlock()
+
+	c.refs--
+	c.destroyUnused()
+}
+
+func (c *gatewayClient) destroyUnused() {
+	if c.retired && c.refs == 0 {
+		c.krb5cl.Destroy()
+	}
+}
+
+func (g *gateway) mac(password string) []byte {
+	h := hmac.New(sha256.New, g.key)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (g *gateway) loginKDC(user, realm, password string) (*client.Client, error) {
+	r, err := g.config.Kerberos.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Kerberos config: %w", err)
+	}
+
+	krb5conf, err := krb5config.NewFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Kerberos config: %w", err)
+	}
+
+	krb5cl := client.NewWithPassword(user, realm, password, krb5conf, client.DisablePAFXFAST(true))
+	if err := krb5cl.Login(); err != nil {
+		return nil, err
+	}
+
+	return krb5cl, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_gateway(t *testing.T) {
+	g := newGateway(&Config{
+		Kerberos: Kerberos{
+			Realm: "EVIL.CORP",
+		},
+		Gateway: Gateway{
+			CacheTTL: time.Hour,
+		},
+	})
+
+	logins := 0
+	g.login = func(user, realm, password string) (*client.Client, error) {
+		logins++
+		if password != "Qwerty123" {
+			return nil, errors.New("KDC_ERR_PREAUTH_FAILED")
+		}
+
+		return client.NewWithPassword(user, realm, password, krb5config.New()), nil
+	}
+
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	t.Run("login", func(t *testing.T) {
+		user, cl, err := g.authenticate(basic("ivanovii", "Qwerty123"))
+		require.NoError(t, err)
+		defer cl.release()
+		assert.Equal(t, "ivanovii@EVIL.CORP", user)
+		assert.Equal(t, 1, logins)
+		assert.Equal(t, "ivanovii", cl.krb5cl.Credentials.UserName())
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		_, cl, err := g.authenticate(basic("ivanovii", "Qwerty123"))
+		require.NoError(t, err)
+		cl.release()
+		assert.Equal(t, 1, logins)
+	})
+
+	t.Run("another password is checked against KDC", func(t *testing.T) {
+		_, _, err := g.authenticate(basic("ivanovii", "Qwerty321"))
+		assert.Error(t, err)
+		assert.Equal(t, 2, logins)
+	})
+
+	t.Run("own realm", func(t *testing.T) {
+		user, cl, err := g.authenticate(basic("petrovpp@evil.corp", "Qwerty123"))
+		require.NoError(t, err)
+		cl.release()
+		assert.Equal(t, "petrovpp@EVIL.CORP", user)
+
+		// Kerberos config knows the configured realm only
+		_, _, err = g.authenticate(basic("petrovpp@PARTNER.CORP", "Qwerty123"))
+		assert.EqualError(t, err, "realm PARTNER.CORP is not supported, only EVIL.CORP is")
+		assert.Equal(t, 3, logins)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		g.config.Gateway.CacheTTL = -time.Second
+		defer func() {
+			g.config.Gateway.CacheTTL = time.Hour
+		}()
+
+		_, cl, err := g.authenticate(basic("sidorovss", "Qwerty123"))
+		require.NoError(t, err)
+		_, other, err := g.authenticate(basic("sidorovss", "Qwerty123"))
+		require.NoError(t, err)
+		assert.Equal(t, 5, logins)
+		assert.NotContains(t, g.users, "sidorovss@EVIL.CORP")
+
+		// Evicted client is destroyed once the last request releases it
+		assert.Equal(t, "sidorovss", cl.krb5cl.Credentials.UserName())
+		cl.release()
+		assert.Empty(t, cl.krb5cl.Credentials.UserName())
+		other.release()
+		assert.Empty(t, other.krb5cl.Credentials.UserName())
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		_, cl, err := g.authenticate(basic("kuznetsovaa", "Qwerty123"))
+		require.NoError(t, err)
+		cl.release()
+		// Cached client isn't destroyed while nobody uses it
+		assert.Equal(t, "kuznetsovaa", cl.krb5cl.Credentials.UserName())
+
+		_, cl, err = g.authenticate(basic("kuznetsovaa", "Qwerty123"))
+		require.NoError(t, err)
+		g.mu.Lock()
+		g.users["kuznetsovaa@EVIL.CORP"].password = g.mac("Qwerty321")
+		g.mu.Unlock()
+
+		_, replacement, err := g.authenticate(basic("kuznetsovaa", "Qwerty123"))
+		require.NoError(t, err)
+		defer replacement.release()
+		assert.NotSame(t, cl, replacement)
+
+		assert.Equal(t, "kuznetsovaa", cl.krb5cl.Credentials.UserName())
+		cl.release()
+		assert.Empty(t, cl.krb5cl.Credentials.UserName())
+		assert.Equal(t, "kuznetsovaa", replacement.krb5cl.Credentials.UserName())
+	})
+}
+
+func Test_gateway_concurrentLogins(t *testing.T) {
+	g := newGateway(&Config{
+		Kerberos: Kerberos{
+			Realm: "EVIL.CORP",
+		},
+		Gateway: Gateway{
+			CacheTTL: time.Hour,
+		},
+	})
+
+	var logins int32
+	started, proceed := make(chan struct{}), make(chan struct{})
+	g.login = func(user, realm, password string) (*client.Client, error) {
+		atomic.AddInt32(&logins, 1)
+		close(started)
+		<-proceed
+
+		return client.NewWithPassword(user, realm, password, krb5config.New()), nil
+	}
+
+	header := "Basic " + base64.StdEncoding.EncodeToString([]byte("ivanovii:Qwerty123"))
+	clients := make(chan *gatewayClient, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(clients); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, cl, err := g.authenticate(header)
+			assert.NoError(t, err)
+			clients <- cl
+		}()
+	}
+
+	// Racing requests wait for login in progress instead of logging in on their own
+	<-started
+	assert.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		for _, login := range g.logins {
+			return login.waiters == cap(clients)-1
+		}
+		return false
+	}, 10*time.Second, time.Millisecond)
+	close(proceed)
+	wg.Wait()
+	close(clients)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+	var first *gatewayClient
+	for cl := range clients {
+		if first == nil {
+			first = cl
+		}
+		assert.Same(t, first, cl)
+	}
+	assert.Equal(t, cap(clients), first.refs)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SetHeader replaces every value of header
+	SetHeader = "set"
+	// AddHeader appends value to header
+	AddHeader = "add"
+	// RemoveHeader drops header, it isn't filled with default value afterwards, e.g. X-Forwarded-For
+	RemoveHeader = "remove"
+	// ReplaceHeader substitutes pattern matches in every value of header
+	ReplaceHeader = "replace"
+)
+
+type Headers struct {
+	RuleStrings []string     `long:"rule" env:"RULES" env-delim:"\n" description:"Header rule of outbound requests and CONNECTs, every matching one is applied in order, SOCKS5 tunnels carry no headers" value-name:"domain=*.evil.corp;action=set;header=User-Agent;value=Mozilla/5.0" json:"rules"`
+	Rules       []HeaderRule `no-flag:"yes" json:"-"`
+}
+
+// HeaderRule rewrites header of requests to matching destinations.
+type HeaderRule struct {
+	// Domains are destination domain globs, e.g. "*.evil.corp", rule applies to any destination without them
+	Domains []string
+
+	Action  string
+	Header  string
+	Value   string
+	Pattern *regexp.Regexp
+}
+
+// ParseHeaderRule parses header rule, e.g. "domain=*.evil.corp;action=set;header=User-Agent;value=Mozilla/5.0".
+// Value is the last option and takes the rest of the rule. Action is set, add, remove or replace, the last one
+// substitutes pattern with value which could be empty, e.g.
+// "action=replace;header=User-Agent;pattern=^curl/(.*)$;value=Wget/$1".
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	var (
+		rule     HeaderRule
+		hasValue bool
+	)
+	parts := strings.Split(s, ";")
+	for i, part := range parts {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if key == "value" {
+			// Value is the last option, so it could contain semicolons, e.g. User-Agent
+			rule.Value, hasValue = strings.Join(append([]string{value}, parts[i+1:]...), ";"), true
+			break
+		}
+		if !ok || value == "" {
+			return HeaderRule{}, fmt.Errorf("invalid header rule option %q", part)
+		}
+
+		switch key {
+		case "domain":
+			if _, err := path.Match(value, ""); err != nil {
+				return HeaderRule{}, fmt.Errorf("invalid domain glob %q: %w", value, err)
+			}
+			rule.Domains = append(rule.Domains, strings.ToLower(value))
+		case "action":
+			rule.Action = strings.ToLower(value)
+		case "header":
+			rule.Header = http.CanonicalHeaderKey(value)
+		case "pattern":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return HeaderRule{}, fmt.Errorf("invalid pattern %q: %w", value, err)
+			}
+			rule.Pattern = re
+		default:
+			return HeaderRule{}, fmt.Errorf("invalid header rule option %q", part)
+		}
+	}
+
+	if rule.Header == "" {
+		return HeaderRule{}, fmt.Errorf("header rule %q has no header", s)
+	}
+	// Client hop headers are never forwarded, and ours are set on the way to the next hop
+	if strings.HasPrefix(rule.Header, "Proxy-") {
+		return HeaderRule{}, fmt.Errorf("header %s cannot be rewritten", rule.Header)
+	}
+
+	switch rule.Action {
+	case SetHeader, AddHeader:
+		if rule.Value == "" {
+			return HeaderRule{}, fmt.Errorf("header rule %q has no value", s)
+		}
+	case RemoveHeader:
+		if hasValue {
+			return HeaderRule{}, fmt.Errorf("header rule %q removes header, value is not expected", s)
+		}
+	case ReplaceHeader:
+		if rule.Pattern == nil {
+			return HeaderRule{}, fmt.Errorf("header rule %q has no pattern", s)
+		}
+	case "":
+		return HeaderRule{}, fmt.Errorf("header rule %q has no action", s)
+	default:
+		return HeaderRule{}, fmt.Errorf("unknown header rule action %q", rule.Action)
+	}
+	if rule.Pattern != nil && rule.Action != ReplaceHeader {
+		return HeaderRule{}, fmt.Errorf("header rule %q has pattern, but doesn't replace", s)
+	}
+
+	return rule, nil
+}
+
+// Resolve parses header rules.
+func (h *Headers) Resolve() error {
+	h.Rules = make([]HeaderRule, 0, len(h.RuleStrings))
+	for _, s := range h.RuleStrings {
+		rule, err := ParseHeaderRule(s)
+		if err != nil {
+			return err
+		}
+
+		h.Rules = append(h.Rules, rule)
+	}
+
+	return nil
+}
+
+// Apply rewrites header of request to host with every matching rule in order.
+func (h *Headers) Apply(host string, header http.Header) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range h.Rules {
+		if rule := &h.Rules[i]; rule.match(host) {
+			rule.apply(header)
+		}
+	}
+}
+
+func (r *HeaderRule) match(host string) bool {
+	if len(r.Domains) == 0 {
+		return true
+	}
+	for _, glob := range r.Domains {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *HeaderRule) apply(header http.Header) {
+	switch r.Action {
+	case SetHeader:
+		header.Set(r.Header, r.Value)
+	case AddHeader:
+		header.Add(r.Header, r.Value)
+	case RemoveHeader:
+		// Nil value tells forwarding proxy and transport not to fill header in
+		header[r.Header] = nil
+	case ReplaceHeader:
+		values := header.Values(r.Header)
+		if len(values) == 0 {
+			return
+		}
+
+		replaced := make([]string, 0, len(values))
+		for _, v := range values {
+			if v = r.Pattern.ReplaceAllString(v, r.Value); v != "" {
+				replaced = append(replaced, v)
+			}
+		}
+		if len(replaced) == 0 {
+			// Value is gone completely, so is header
+			replaced = nil
+		}
+		header[r.Header] = replaced
+	}
+}
+
+// stripProxyHeaders drops every Proxy-* header sent by client, they are meant for us, not for the next hop.
+func stripProxyHeaders(header http.Header) {
+	for k := range header {
+		if strings.HasPrefix(k, "Proxy-") {
+			delete(header, k)
+		}
+	}
+}
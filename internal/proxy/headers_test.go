@@ -0,0 +1,242 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withHeaders rewrites outbound headers with rules.
+func withHeaders(t *testing.T, rules ...string) func(config *Config) {
+	return func(config *Config) {
+		config.Headers.RuleStrings = rules
+		require.NoError(t, config.Headers.Resolve())
+	}
+}
+
+func TestParseHeaderRule(t *testing.T) {
+	rule, err := ParseHeaderRule("domain=*.Evil.Corp;domain=evil.corp;action=SET;header=user-agent;value=Mozilla/5.0 (X11; Linux x86_64)")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.evil.corp", "evil.corp"}, rule.Domains)
+	assert.Equal(t, SetHeader, rule.Action)
+	assert.Equal(t, "User-Agent", rule.Header)
+	// Value takes the rest of the rule
+	assert.Equal(t, "Mozilla/5.0 (X11; Linux x86_64)", rule.Value)
+
+	rule, err = ParseHeaderRule("action=replace;header=Via;pattern=\\s*[^,]+\\.internal\\.evil\\.corp,?;value=")
+	require.NoError(t, err)
+	assert.Empty(t, rule.Domains)
+	assert.Empty(t, rule.Value)
+
+	for _, invalid := range []string{
+		"action=set;header=User-Agent",
+		"action=remove;header=Via;value=proxy",
+		"action=replace;header=Via;value=proxy",
+		"action=add;header=X-Team;pattern=.*;value=platform",
+		"action=rename;header=Via",
+		"header=Via",
+		"action=remove",
+		"action=remove;header=Proxy-Authorization",
+		"action=remove;header=Proxy-Connection",
+		"domain=[;action=remove;header=Via",
+		"action=replace;header=Via;pattern=(;value=proxy",
+		"action=remove;header=Via;port=443",
+	} {
+		_, err := ParseHeaderRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHeaders_Apply(t *testing.T) {
+	h := Headers{RuleStrings: []string{
+		"domain=*.evil.corp;action=set;header=User-Agent;value=Mozilla/5.0",
+		"action=add;header=X-Team;value=platform",
+		"action=remove;header=X-Forwarded-For",
+		"action=replace;header=Via;pattern=^1.1 (\\S+)\\.evil\\.corp$;value=1.1 $1",
+		"action=replace;header=X-Trace;pattern=.*;value=",
+	}}
+	require.NoError(t, h.Resolve())
+
+	header := http.Header{
+		"User-Agent":      {"curl/8.0.1"},
+		"X-Team":          {"escobar"},
+		"X-Forwarded-For": {"10.0.0.1"},
+		"Via":             {"1.1 gw.evil.corp", "1.1 partner.corp"},
+		"X-Trace":         {"secret"},
+	}
+	h.Apply("Jira.Evil.Corp.", header)
+	assert.Equal(t, []string{"Mozilla/5.0"}, header["User-Agent"])
+	assert.Equal(t, []string{"escobar", "platform"}, header["X-Team"])
+	assert.Equal(t, []string{"1.1 gw", "1.1 partner.corp"}, header["Via"])
+	// Removed headers are kept nil, so they aren't filled in by forwarding proxy
+	v, ok := header["X-Forwarded-For"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	v, ok = header["X-Trace"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+
+	// Rules scoped by domain don't apply to other destinations
+	header = http.Header{"User-Agent": {"curl/8.0.1"}}
+	h.Apply("www.google.com", header)
+	assert.Equal(t, []string{"curl/8.0.1"}, header["User-Agent"])
+	assert.Equal(t, []string{"platform"}, header["X-Team"])
+}
+
+func TestProxy_headers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Mozilla/5.0", r.UserAgent())
+		assert.Equal(t, "platform", r.Header.Get("X-Team"))
+		assert.Empty(t, r.Header.Values("X-Forwarded-For"))
+		assert.Empty(t, r.Header.Values("Proxy-Connection"))
+		assert.Empty(t, r.Header.Values("Proxy-Secret"))
+		// nolint:errcheck
+		w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "test_password"))
+	addr := newTestProxy(t, "http://"+downstreamAddr, withHeaders(t,
+		"domain=127.0.0.1;action=set;header=User-Agent;value=Mozilla/5.0",
+		"domain=localhost;action=set;header=User-Agent;value=Wget/1.21",
+		"action=add;header=X-Team;value=platform",
+		"action=remove;header=X-Forwarded-For",
+	))
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr, nil)
+		require.NoError(t, err)
+		// Request is sent in absolute form as if proxy was used
+		req.URL.Opaque = srv.URL + "/"
+		req.Header.Set("User-Agent", "curl/8.0.1")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Proxy-Secret", "Qwerty123")
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "pong", string(b))
+	})
+
+	t.Run("CONNECT", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		// Downstream proxy asks for credentials, so CONNECT is sent twice
+		headers := make(chan http.Header, 2)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			br := bufio.NewReader(conn)
+			for _, code := range []int{http.StatusProxyAuthRequired, http.StatusOK} {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				headers <- req.Header
+
+				resp := newResponse(code, nil, req)
+				resp.ContentLength = 0
+				// nolint:errcheck
+				resp.Write(conn)
+			}
+		}()
+		addr := newTestProxy(t, "http://"+l.Addr().String(), withHeaders(t,
+			"domain=localhost;action=set;header=User-Agent;value=Mozilla/5.0",
+			"action=add;header=X-Team;value=platform",
+		))
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		req, err := http.NewRequest(http.MethodConnect, "http://localhost:443", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "curl/8.0.1")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		require.NoError(t, req.Write(conn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Rules are applied once, authenticated CONNECT is the same request
+		for i := 0; i < 2; i++ {
+			header := <-headers
+			assert.Equal(t, []string{"Mozilla/5.0"}, header.Values("User-Agent"))
+			assert.Equal(t, []string{"platform"}, header.Values("X-Team"))
+			assert.Empty(t, header.Values("Proxy-Connection"))
+		}
+	})
+
+	t.Run("CONNECT through chain", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		// Proxy in chain sees CONNECT to destination inside tunnel through downstream proxy
+		headers := make(chan http.Header, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			headers <- req.Header
+
+			// nolint:errcheck
+			newResponse(http.StatusOK, nil, req).Write(conn)
+		}()
+		addr := newTestProxy(t, "http://"+downstreamAddr,
+			withChain(t, "http://"+l.Addr().String()),
+			withHeaders(t,
+				"domain=localhost;action=set;header=User-Agent;value=Mozilla/5.0",
+				"action=add;header=X-Team;value=platform",
+			),
+		)
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		req, err := http.NewRequest(http.MethodConnect, "http://localhost:443", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "curl/8.0.1")
+		require.NoError(t, req.Write(conn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		header := <-headers
+		assert.Equal(t, []string{"Mozilla/5.0"}, header.Values("User-Agent"))
+		assert.Equal(t, []string{"platform"}, header.Values("X-Team"))
+	})
+}
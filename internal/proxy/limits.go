@@ -0,0 +1,224 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientIdleTimeout is how long state of a client without tunnels is kept
+const clientIdleTimeout = 10 * time.Minute
+
+// errDialsLimit is returned when ceiling of concurrent downstream proxy dials is reached
+var errDialsLimit = errors.New("downstream proxy dials limit reached")
+
+// limitsMetrics are published with expvar, counters of rejected requests and gauges of active tunnels and dials
+var limitsMetrics = expvar.NewMap("limits")
+
+// idleCloser is implemented by transports pooling downstream proxy connections.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+type clientLimits struct {
+	rate     *rate.Limiter
+	tunnels  int
+	lastSeen time.Time
+}
+
+// limiter enforces request rate, concurrent tunnels and downstream proxy dials limits.
+type limiter struct {
+	config *Limits
+
+	mu      sync.Mutex
+	clients map[string]*clientLimits
+	tunnels int
+	dials   int
+	swept   time.Time
+	// pools keep idle connections which hold dial slots too
+	pools map[idleCloser]struct{}
+}
+
+func newLimiter(config *Limits) *limiter {
+	return &limiter{
+		config:  config,
+		clients: make(map[string]*clientLimits),
+		pools:   make(map[idleCloser]struct{}),
+	}
+}
+
+// addPool registers transport, its idle connections are closed once dials ceiling is reached.
+func (l *limiter) addPool(pool idleCloser) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pools[pool] = struct{}{}
+}
+
+func (l *limiter) removePool(pool idleCloser) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.pools, pool)
+}
+
+// client returns state of client, must be called with mu held.
+func (l *limiter) client(ip string) *clientLimits {
+	now := time.Now()
+
+	// Forget idle clients from time to time
+	if now.Sub(l.swept) > clientIdleTimeout {
+		for k, c := range l.clients {
+			if c.tunnels == 0 && now.Sub(c.lastSeen) > clientIdleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		limit := rate.Inf
+		if l.config.Rate > 0 {
+			limit = rate.Limit(l.config.Rate)
+		}
+
+		c = &clientLimits{rate: rate.NewLimiter(limit, l.config.Burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+
+	return c
+}
+
+// allowRequest takes a token from the bucket of client.
+func (l *limiter) allowRequest(ip string) bool {
+	if l.config.Rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.client(ip).rate.Allow() {
+		limitsMetrics.Add("rate_limited", 1)
+		return false
+	}
+
+	return true
+}
+
+// acquireTunnel reserves a tunnel slot for client. If limit is reached, it returns status code to respond with.
+func (l *limiter) acquireTunnel(ip string) (release func(), code int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.Tunnels > 0 && l.tunnels >= l.config.Tunnels {
+		limitsMetrics.Add("tunnels_rejected", 1)
+		return nil, http.StatusServiceUnavailable
+	}
+
+	c := l.client(ip)
+	if l.config.ClientTunnels > 0 && c.tunnels >= l.config.ClientTunnels {
+		limitsMetrics.Add("client_tunnels_rejected", 1)
+		return nil, http.StatusTooManyRequests
+	}
+
+	c.tunnels++
+	l.tunnels++
+	limitsMetrics.Add("tunnels", 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			c.tunnels--
+			c.lastSeen = time.Now()
+			l.tunnels--
+			limitsMetrics.Add("tunnels", -1)
+		})
+	}, 0
+}
+
+// acquireDial reserves a downstream proxy dial slot, returns false if ceiling is reached even without idle connections.
+func (l *limiter) acquireDial() (release func(), ok bool) {
+	l.mu.Lock()
+	if l.config.Dials > 0 && l.dials >= l.config.Dials {
+		pools := make([]idleCloser, 0, len(l.pools))
+		for pool := range l.pools {
+			pools = append(pools, pool)
+		}
+		l.mu.Unlock()
+
+		// Closed connections release their slots, so mutex must not be held
+		for _, pool := range pools {
+			pool.CloseIdleConnections()
+		}
+
+		l.mu.Lock()
+	}
+	defer l.mu.Unlock()
+
+	if l.config.Dials > 0 && l.dials >= l.config.Dials {
+		limitsMetrics.Add("dials_rejected", 1)
+		return nil, false
+	}
+
+	l.dials++
+	limitsMetrics.Add("dials", 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.dials--
+			limitsMetrics.Add("dials", -1)
+		})
+	}, true
+}
+
+// limitedConn holds downstream proxy dial slot until connection is closed, so the ceiling applies to open connections.
+type limitedConn struct {
+	*net.TCPConn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.TCPConn.Close()
+}
+
+// tcpConn returns TCP connection behind conn, if there is one.
+func tcpConn(conn interface{}) (*net.TCPConn, bool) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c, true
+	case *limitedConn:
+		return c.TCPConn, true
+	default:
+		return nil, false
+	}
+}
+
+// clientIP returns IP address of client without port.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
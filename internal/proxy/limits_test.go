@@ -0,0 +1,239 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_limiter(t *testing.T) {
+	l := newLimiter(&Limits{
+		Rate:          1,
+		Burst:         2,
+		ClientTunnels: 1,
+		Tunnels:       2,
+		Dials:         1,
+	})
+
+	// Burst is allowed, then bucket is empty
+	assert.True(t, l.allowRequest("10.0.0.1"))
+	assert.True(t, l.allowRequest("10.0.0.1"))
+	assert.False(t, l.allowRequest("10.0.0.1"))
+	assert.True(t, l.allowRequest("10.0.0.2"))
+
+	release1, code := l.acquireTunnel("10.0.0.1")
+	require.Zero(t, code)
+	_, code = l.acquireTunnel("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	release2, code := l.acquireTunnel("10.0.0.2")
+	require.Zero(t, code)
+	_, code = l.acquireTunnel("10.0.0.3")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// Released slots are available again, double release is harmless
+	release1()
+	release1()
+	release2()
+	_, code = l.acquireTunnel("10.0.0.1")
+	assert.Zero(t, code)
+
+	release, ok := l.acquireDial()
+	require.True(t, ok)
+	_, ok = l.acquireDial()
+	assert.False(t, ok)
+	release()
+	_, ok = l.acquireDial()
+	assert.True(t, ok)
+
+	// Unlimited by default
+	unlimited := newLimiter(&Limits{})
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.allowRequest("10.0.0.1"))
+		_, code := unlimited.acquireTunnel("10.0.0.1")
+		assert.Zero(t, code)
+	}
+}
+
+func TestProxy_dialContext_limit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := NewProxy(zap.NewNop(), &Config{
+		Limits: Limits{Dials: 1},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+	}, nil)
+
+	// Slot is held while connection is open, not just while it's dialed
+	conn, err := p.dialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, ok := tcpConn(conn)
+	assert.True(t, ok)
+
+	_, err = p.dialContext(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorIs(t, err, errDialsLimit)
+
+	require.NoError(t, conn.Close())
+	conn, err = p.dialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestProxy_idleDialsLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nolint:errcheck
+		w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+	echoAddr := serveEcho(t, "127.0.0.1")
+
+	downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "test_password"))
+	addr := newTestProxy(t, "http://"+downstreamAddr, func(config *Config) {
+		config.Limits.Dials = 1
+	})
+
+	proxyURL, err := url.Parse("http://" + addr)
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer httpClient.CloseIdleConnections()
+
+	// Connection to downstream proxy is kept alive in the pool once response is read
+	resp, err := httpClient.Get(srv.URL)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Nothing is in flight, so tunnel gets the slot of idle connection
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	req, err := http.NewRequest(http.MethodConnect, "http://"+echoAddr, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxy_ServeHTTP_rateLimit(t *testing.T) {
+	p := NewProxy(zap.NewNop(), &Config{
+		Limits: Limits{Rate: 1, Burst: 1},
+	}, nil)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://www.google.com/", nil)
+		req.RemoteAddr = "10.0.0.1:50000"
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, newRequest())
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, newRequest())
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestProxy_https_tunnelsLimit(t *testing.T) {
+	// Downstream proxy establishes tunnels and holds them
+	downstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer downstream.Close()
+
+	go func() {
+		for {
+			conn, err := downstream.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				// nolint:errcheck
+				newResponse(http.StatusOK, nil, req).Write(conn)
+				// nolint:errcheck
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	downstreamURL, err := url.Parse("http://" + downstream.Addr().String())
+	require.NoError(t, err)
+
+	p := NewProxy(zap.NewNop(), &Config{
+		DownstreamProxyURL: downstreamURL,
+		Policy:             Policy{ConnectPorts: []int{0}},
+		Limits:             Limits{ClientTunnels: 1},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+	}, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	defer p.Shutdown(context.Background())
+
+	connect := func() (net.Conn, int) {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 10*time.Second)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodConnect, "http://www.google.com:443", nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+
+		return conn, resp.StatusCode
+	}
+
+	conn, code := connect()
+	defer conn.Close()
+	assert.Equal(t, http.StatusOK, code)
+
+	second, code := connect()
+	defer second.Close()
+	assert.Equal(t, http.StatusTooManyRequests, code)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Listener is additional proxy address, global ACL is used if it has no own one.
+type Listener struct {
+	Addr *net.TCPAddr
+	ACL  *ACL
+}
+
+// ParseListener parses address with optional own ACL, e.g. "172.17.0.1:3128;allow=172.17.0.0/16;deny=172.17.0.1",
+// allow and deny could be repeated.
+func ParseListener(s string) (Listener, error) {
+	parts := strings.Split(s, ";")
+	if strings.TrimSpace(parts[0]) == "" {
+		return Listener{}, fmt.Errorf("listener address is required")
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return Listener{}, fmt.Errorf("cannot resolve listener address: %w", err)
+	}
+
+	if len(parts) == 1 {
+		return Listener{Addr: addr}, nil
+	}
+
+	acl := &ACL{}
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case ok && key == "allow":
+			acl.AllowStrings = append(acl.AllowStrings, value)
+		case ok && key == "deny":
+			acl.DenyStrings = append(acl.DenyStrings, value)
+		default:
+			return Listener{}, fmt.Errorf("invalid listener option %q", part)
+		}
+	}
+
+	if err := acl.Resolve(); err != nil {
+		return Listener{}, fmt.Errorf("invalid listener %q: %w", s, err)
+	}
+
+	return Listener{Addr: addr, ACL: acl}, nil
+}
+
+// ResolveListeners parses additional proxy addresses.
+func (c *Config) ResolveListeners() error {
+	c.Listeners = make([]Listener, 0, len(c.ListenStrings))
+	for _, s := range c.ListenStrings {
+		l, err := ParseListener(s)
+		if err != nil {
+			return err
+		}
+
+		c.Listeners = append(c.Listeners, l)
+	}
+
+	return nil
+}
+
+// AddrFor returns proxy address for clients connected to local IP: listener on the same IP, wildcard listener
+// with local IP or the first one. Returns nil if proxy listens on unix socket only.
+func (c *Config) AddrFor(local net.IP) *net.TCPAddr {
+	addrs := make([]*net.TCPAddr, 0, len(c.Listeners)+1)
+	if c.Addr != nil {
+		addrs = append(addrs, c.Addr)
+	}
+	for _, l := range c.Listeners {
+		addrs = append(addrs, l.Addr)
+	}
+
+	return addrFor(addrs, local)
+}
+
+// TLSAddrFor returns TLS proxy address for clients connected to local IP, nil if TLS listener is disabled.
+func (c *Config) TLSAddrFor(local net.IP) *net.TCPAddr {
+	if c.TLS.Addr == nil {
+		return nil
+	}
+
+	return addrFor([]*net.TCPAddr{c.TLS.Addr}, local)
+}
+
+// addrFor returns address on local IP, wildcard address with local IP or the first one.
+func addrFor(addrs []*net.TCPAddr, local net.IP) *net.TCPAddr {
+	if len(addrs) == 0 {
+		return nil
+	}
+	if local == nil {
+		return addrs[0]
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.Equal(local) {
+			return addr
+		}
+	}
+
+	// Wildcard address listens on every interface
+	for _, addr := range addrs {
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			return &net.TCPAddr{IP: local, Port: addr.Port}
+		}
+	}
+
+	return addrs[0]
+}
+
+// aclFor returns ACL of listener with given address, global one is used by default.
+func (c *Config) aclFor(addr net.Addr) *ACL {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		for _, l := range c.Listeners {
+			if l.ACL != nil && l.Addr.IP.Equal(tcpAddr.IP) && l.Addr.Port == tcpAddr.Port {
+				return l.ACL
+			}
+		}
+	}
+
+	return &c.ACL
+}
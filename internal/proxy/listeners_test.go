@@ -0,0 +1,114 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseListener(t *testing.T) {
+	l, err := ParseListener("[::1]:3128")
+	require.NoError(t, err)
+	assert.Equal(t, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 3128}, l.Addr)
+	assert.Nil(t, l.ACL)
+
+	l, err = ParseListener("172.17.0.1:3128; allow=172.17.0.0/16;allow=10.0.0.1;deny=172.17.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 3128, l.Addr.Port)
+	require.NotNil(t, l.ACL)
+	assert.True(t, l.ACL.Allowed(net.ParseIP("172.17.0.2")))
+	assert.True(t, l.ACL.Allowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, l.ACL.Allowed(net.ParseIP("172.17.0.1")))
+
+	for _, invalid := range []string{
+		"",
+		"localhost:http-proxy-port",
+		"127.0.0.1:3128;allow",
+		"127.0.0.1:3128;permit=10.0.0.0/8",
+		"127.0.0.1:3128;deny=10.0.0.0/33",
+	} {
+		_, err := ParseListener(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConfig_AddrFor(t *testing.T) {
+	config := &Config{
+		ListenStrings: []string{"[::1]:3128", "172.17.0.1:3128", ":3130"},
+	}
+	require.NoError(t, config.ResolveListeners())
+
+	assert.Equal(t, "[::1]:3128", config.AddrFor(nil).String())
+	assert.Equal(t, "[::1]:3128", config.AddrFor(net.ParseIP("::1")).String())
+	assert.Equal(t, "172.17.0.1:3128", config.AddrFor(net.ParseIP("172.17.0.1")).String())
+	// Wildcard listener
+	assert.Equal(t, "192.168.1.10:3130", config.AddrFor(net.ParseIP("192.168.1.10")).String())
+
+	config.Addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3128}
+	assert.Equal(t, "127.0.0.1:3128", config.AddrFor(nil).String())
+	assert.Equal(t, "127.0.0.1:3128", config.AddrFor(net.ParseIP("127.0.0.1")).String())
+
+	// Unix socket only
+	assert.Nil(t, (&Config{}).AddrFor(net.ParseIP("127.0.0.1")))
+}
+
+func TestConfig_TLSAddrFor(t *testing.T) {
+	config := &Config{}
+	assert.Nil(t, config.TLSAddrFor(net.ParseIP("127.0.0.1")))
+
+	config.TLS.Addr = &net.TCPAddr{Port: 3130}
+	assert.Equal(t, "192.168.1.10:3130", config.TLSAddrFor(net.ParseIP("192.168.1.10")).String())
+	assert.Equal(t, ":3130", config.TLSAddrFor(nil).String())
+}
+
+func TestProxy_Serve_listenerACL(t *testing.T) {
+	config := &Config{
+		ListenStrings: []string{"127.0.0.1:0;deny=127.0.0.0/8"},
+	}
+	require.NoError(t, config.ResolveListeners())
+
+	p := NewProxy(zap.NewNop(), config, nil)
+
+	open, err := p.ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	denied, err := p.ListenTCP(config.Listeners[0].Addr)
+	require.NoError(t, err)
+	// Listener ACL is looked up by actual address
+	config.Listeners[0].Addr = denied.Addr().(*net.TCPAddr)
+
+	for _, l := range []net.Listener{open, denied} {
+		go func(l net.Listener) {
+			// nolint:errcheck
+			p.Serve(l)
+		}(l)
+	}
+	defer p.Shutdown(context.Background())
+
+	// Global ACL allows everyone
+	conn, err := net.DialTimeout("tcp", open.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET https://www.google.com/ HTTP/1.1\r\nHost: www.google.com\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NoError(t, err)
+
+	// Connection should be closed by listener ACL
+	conn, err = net.DialTimeout("tcp", denied.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,440 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/L11R/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxLeafCertificates is the size of minted certificates cache, it's cleared once it's full
+	maxLeafCertificates = 1024
+	// leafValidity is validity period of minted certificate, it's capped by root CA expiration
+	leafValidity = 30 * 24 * time.Hour
+	// leafRenewal is how long before expiration cached certificate is minted again
+	leafRenewal = 24 * time.Hour
+)
+
+// MITM configures TLS interception of listed domains with local root CA, other domains are tunneled untouched.
+type MITM struct {
+	DomainStrings []string            `long:"domain" env:"DOMAINS" env-delim:"," description:"Domain to intercept TLS of, its subdomains are intercepted as well" value-name:"jira.evil.corp" json:"domains"`
+	Domains       map[string]struct{} `no-flag:"yes" json:"-"`
+
+	CACertString string `long:"ca-cert" env:"CA_CERT" description:"Root CA certificate in PEM format, it's generated and saved along with the key if neither file exists" value-name:"/etc/escobar/mitm-ca.pem" json:"caCert"`
+	CAKeyString  string `long:"ca-key" env:"CA_KEY" description:"Root CA private key in PEM format or reference (file:, env:, exec:)" value-name:"/etc/escobar/mitm-ca.key" json:"caKey"`
+
+	// CA mints certificates of intercepted domains, its Leaf is served by static server
+	CA *tls.Certificate `no-flag:"yes" json:"-"`
+}
+
+// Resolve loads root CA or generates and saves it, so clients keep trusting it after restart.
+// TLS interception is disabled if there are no domains.
+func (m *MITM) Resolve() error {
+	m.Domains, m.CA = nil, nil
+	if len(m.DomainStrings) == 0 {
+		return nil
+	}
+
+	m.Domains = make(map[string]struct{}, len(m.DomainStrings))
+	for _, domain := range m.DomainStrings {
+		m.Domains[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")] = struct{}{}
+	}
+
+	if m.CACertString == "" || m.CAKeyString == "" {
+		return fmt.Errorf("both root CA certificate and private key are required")
+	}
+
+	ca, err := loadOrGenerateKeyPair(m.CACertString, m.CAKeyString, newRootCA)
+	if err != nil {
+		return fmt.Errorf("root CA: %w", err)
+	}
+
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("cannot parse root CA certificate: %w", err)
+	}
+	if !ca.Leaf.IsCA {
+		return fmt.Errorf("certificate %q is not CA one", m.CACertString)
+	}
+	// Minted certificates would be valid for less than renewal period, so clients would fail soon after start
+	if time.Until(ca.Leaf.NotAfter) < leafRenewal {
+		return fmt.Errorf("root CA %q expires at %s, it must be renewed", m.CACertString, ca.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	m.CA = &ca
+
+	return nil
+}
+
+// isNotExist returns true if there is no file at path.
+func isNotExist(path string) bool {
+	_, err := os.Stat(path)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// newRootCA generates root CA valid for ten years.
+func newRootCA() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Escobar MITM CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// saveKeyPair writes certificate and its private key in PEM format, key is readable by owner only.
+func saveKeyPair(cert tls.Certificate, certPath, keyPath string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("cannot marshal private key: %w", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("cannot save private key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("cannot save certificate: %w", err)
+	}
+
+	return nil
+}
+
+// mitm mints and caches certificates of intercepted domains.
+type mitm struct {
+	config *MITM
+	// destinationTLS verifies destinations, system roots are used by default
+	destinationTLS *tls.Config
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newMITM(config *MITM) *mitm {
+	return &mitm{
+		config:         config,
+		destinationTLS: &tls.Config{MinVersion: tls.VersionTLS12},
+		certs:          make(map[string]*tls.Certificate),
+	}
+}
+
+// match returns true if host or any of its parent domains is intercepted.
+func (m *mitm) match(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for domain := host; domain != ""; {
+		if _, ok := m.config.Domains[domain]; ok {
+			return true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	return false
+}
+
+// certificate returns cached certificate for host name or mints new one.
+func (m *mitm) certificate(name string) (*tls.Certificate, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cert, ok := m.certs[name]; ok {
+		// Certificate capped by root CA expiration can't be renewed, so it's kept until the CA itself expires
+		capped := !cert.Leaf.NotAfter.Before(m.config.CA.Leaf.NotAfter)
+		if capped || time.Until(cert.Leaf.NotAfter) > leafRenewal {
+			return cert, nil
+		}
+	}
+
+	cert, err := m.mint(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot mint certificate for %s: %w", name, err)
+	}
+
+	if len(m.certs) >= maxLeafCertificates {
+		m.certs = make(map[string]*tls.Certificate)
+	}
+	m.certs[name] = cert
+
+	return cert, nil
+}
+
+// mint issues certificate for host name signed by root CA.
+func (m *mitm) mint(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	ca := m.config.CA
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(ca.Leaf.NotAfter) {
+		template.NotAfter = ca.Leaf.NotAfter
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// intercept terminates client TLS with minted certificate and forwards decrypted requests to destination, every
+// request is logged. Destination is reached through the same route as CONNECT would be.
+func (p *Proxy) intercept(conn net.Conn, brw *bufio.ReadWriter, req *http.Request) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	// Tunnel is established by ourselves, destination is dialed by requests
+	if err := newResponse(http.StatusOK, nil, req).Write(brw); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write response into client connection: %w", err))
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot flush writer to commit response into client connection: %w", err))
+		return
+	}
+
+	host := req.URL.Hostname()
+	tconn := tls.Server(&bufferedConn{Conn: conn, r: brw.Reader}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+
+			return p.mitm.certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+
+	// Handshake is bounded the same way as request headers of TLS listener
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout := p.config.Timeouts.Server.ReadHeaderTimeout; timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	err := tconn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		logger.Warn("TLS handshake with client failed, root CA is probably not trusted", zap.Error(err))
+		return
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = p.dialTunnel
+	tr.TLSClientConfig = p.mitm.destinationTLS.Clone()
+	defer tr.CloseIdleConnections()
+	p.limiter.addPool(tr)
+	defer p.limiter.removePool(tr)
+
+	fp := httputil.NewForwardingProxy()
+	fp.Transport = p.cacheTransport(tr)
+	fp.ErrorHandler = httpErrorHandler
+	fp.ErrorLog = zap.NewStdLog(logger)
+	fp.ModifyResponse = func(resp *http.Response) error {
+		logger := resp.Request.Context().Value(LogEntryCtx).(*zap.Logger)
+		logger.Info("Request intercepted", zap.Int("resp_code", resp.StatusCode))
+
+		return p.shapeResponse(resp)
+	}
+
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		// Client identity and route of tunnel apply to every request inside it
+		ctx := r.Context()
+		for _, key := range []ctxKey{clientUserCtx, gatewayClientCtx, routeCtx} {
+			if v := req.Context().Value(key); v != nil {
+				ctx = context.WithValue(ctx, key, v)
+			}
+		}
+		r.URL.Scheme, r.URL.Host = "https", req.Host
+		// nolint:staticcheck
+		ctx = context.WithValue(ctx, LogEntryCtx, logger.With(zap.String("http_method", r.Method), zap.String("url", r.URL.String())))
+		r = r.WithContext(ctx)
+
+		// Requests for other hosts must not sneak through tunnel which is intercepted for its host only
+		if !strings.EqualFold(hostname(r.Host), host) {
+			r.Context().Value(LogEntryCtx).(*zap.Logger).Warn("Misdirected request inside intercepted tunnel", zap.String("host", r.Host))
+			http.Error(rw, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		stripProxyHeaders(r.Header)
+		p.config.Headers.Apply(host, r.Header)
+
+		fp.ServeHTTP(rw, r)
+	}
+
+	server := &http.Server{
+		Handler:           http.HandlerFunc(handler),
+		ReadHeaderTimeout: p.config.Timeouts.Server.ReadHeaderTimeout,
+		IdleTimeout:       p.config.Timeouts.Server.IdleTimeout,
+		ErrorLog:          zap.NewStdLog(logger),
+	}
+
+	logger.Debug("Intercepted tunnel opened")
+	defer logger.Debug("Intercepted tunnel closed")
+
+	if err := server.Serve(newConnListener(tconn)); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("Error while serving intercepted requests", zap.Error(err))
+	}
+}
+
+// dialTunnel opens tunnel to destination the same way CONNECT does: by route, through SOCKS5 downstream proxy or
+// through downstream proxy and chain.
+func (p *Proxy) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	if rule, ok := ctx.Value(routeCtx).(*Rule); ok {
+		return p.dialRule(rule)(ctx, network, addr)
+	}
+	if p.config.IsSOCKS() {
+		return p.dialSOCKS(ctx, network, addr)
+	}
+
+	return p.dialChain(ctx, network, addr)
+}
+
+// hostname returns host without port.
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+
+	return strings.Trim(hostport, "[]")
+}
+
+// bufferedConn reads data buffered by reader first, client could send it right after CONNECT.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener accepts the only connection, it's closed once the connection is.
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	addr  net.Addr
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conns: make(chan net.Conn, 1),
+		done:  make(chan struct{}),
+		addr:  conn.LocalAddr(),
+	}
+	l.conns <- &listenedConn{Conn: conn, l: l}
+
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenedConn closes its listener on close, so server stops serving.
+type listenedConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *listenedConn) Close() error {
+	// nolint:errcheck
+	c.l.Close()
+
+	return c.Conn.Close()
+}
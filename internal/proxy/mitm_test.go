@@ -0,0 +1,237 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/undefinedlabs/go-mpatch"
+)
+
+// newMITMConfig returns TLS interception config with root CA generated in temporary directory.
+func newMITMConfig(t *testing.T, domains ...string) MITM {
+	dir := t.TempDir()
+	return MITM{
+		DomainStrings: domains,
+		CACertString:  filepath.Join(dir, "mitm-ca.pem"),
+		CAKeyString:   filepath.Join(dir, "mitm-ca.key"),
+	}
+}
+
+// withMITM intercepts domains with root CA generated in temporary directory, the CA is added to pool.
+func withMITM(t *testing.T, pool *x509.CertPool, domains ...string) func(config *Config) {
+	return func(config *Config) {
+		config.MITM = newMITMConfig(t, domains...)
+		require.NoError(t, config.MITM.Resolve())
+
+		pool.AddCert(config.MITM.CA.Leaf)
+	}
+}
+
+func TestMITM_Resolve(t *testing.T) {
+	m := MITM{}
+	require.NoError(t, m.Resolve())
+	assert.Nil(t, m.CA)
+
+	// CA is generated and saved once, then it's loaded
+	m = newMITMConfig(t, "Jira.Evil.Corp.")
+	require.NoError(t, m.Resolve())
+	assert.Contains(t, m.Domains, "jira.evil.corp")
+	assert.True(t, m.CA.Leaf.IsCA)
+	certPath, keyPath := m.CACertString, m.CAKeyString
+	generated := m.CA.Leaf.Raw
+
+	info, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	require.NoError(t, m.Resolve())
+	assert.Equal(t, generated, m.CA.Leaf.Raw)
+
+	// Lone certificate or key is never overwritten
+	certPEM, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(certPath))
+	assert.Error(t, m.Resolve())
+	assert.NoFileExists(t, certPath)
+
+	require.NoError(t, os.WriteFile(certPath, certPEM, 0644))
+	require.NoError(t, os.Remove(keyPath))
+	assert.Error(t, m.Resolve())
+	assert.NoFileExists(t, keyPath)
+
+	dir := t.TempDir()
+	cert := issueCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(1)}, nil)
+	leafPath, leafKeyPath := writeCertificate(t, dir, "leaf", cert)
+	// CA expires in an hour
+	expiring := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	expiringPath, expiringKeyPath := writeCertificate(t, dir, "expiring", expiring)
+
+	for _, invalid := range []MITM{
+		{DomainStrings: []string{"jira.evil.corp"}},
+		{DomainStrings: []string{"jira.evil.corp"}, CACertString: certPath},
+		{DomainStrings: []string{"jira.evil.corp"}, CAKeyString: keyPath},
+		{DomainStrings: []string{"jira.evil.corp"}, CACertString: leafPath, CAKeyString: leafKeyPath},
+		{DomainStrings: []string{"jira.evil.corp"}, CACertString: expiringPath, CAKeyString: expiringKeyPath},
+		{DomainStrings: []string{"jira.evil.corp"}, CACertString: filepath.Join(dir, "missing.pem"), CAKeyString: "env:ESCOBAR_TEST_MISSING_KEY"},
+	} {
+		assert.Error(t, invalid.Resolve())
+	}
+}
+
+func TestMITM_certificate(t *testing.T) {
+	config := newMITMConfig(t, "evil.corp", "10.0.0.1")
+	require.NoError(t, config.Resolve())
+	m := newMITM(&config)
+
+	assert.True(t, m.match("jira.evil.corp"))
+	assert.True(t, m.match("EVIL.CORP."))
+	assert.True(t, m.match("10.0.0.1"))
+	assert.False(t, m.match("notevil.corp"))
+	assert.False(t, m.match("www.google.com"))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(config.CA.Leaf)
+
+	cert, err := m.certificate("jira.evil.corp")
+	require.NoError(t, err)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "jira.evil.corp", Roots: pool})
+	assert.NoError(t, err)
+	assert.Len(t, cert.Certificate, 2)
+
+	// Minted certificate is cached
+	cached, err := m.certificate("Jira.Evil.Corp")
+	require.NoError(t, err)
+	assert.Same(t, cert, cached)
+
+	cert, err = m.certificate("10.0.0.1")
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("10.0.0.1"))
+
+	// Certificate is capped by CA expiring soon, it's cached anyway instead of being minted on every handshake
+	ca := issueCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	m = newMITM(&MITM{CA: &ca})
+
+	cert, err = m.certificate("jira.evil.corp")
+	require.NoError(t, err)
+	assert.Equal(t, ca.Leaf.NotAfter, cert.Leaf.NotAfter)
+	cached, err = m.certificate("jira.evil.corp")
+	require.NoError(t, err)
+	assert.Same(t, cert, cached)
+}
+
+func TestProxy_https_MITM(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(HeaderProxyAuthorization))
+		// nolint:errcheck
+		w.Write([]byte("pong " + r.URL.Path))
+	}))
+	defer srv.Close()
+	destinations := x509.NewCertPool()
+	destinations.AddCert(srv.Certificate())
+	// Destination is verified with its own certificate instead of system roots
+	patch, err := mpatch.PatchMethod(newMITM, func(config *MITM) *mitm {
+		return &mitm{
+			config:         config,
+			destinationTLS: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: destinations},
+			certs:          make(map[string]*tls.Certificate),
+		}
+	})
+	require.NoError(t, err)
+	defer patch.Unpatch()
+
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+	pool := x509.NewCertPool()
+	addr := newTestProxy(t, "http://"+downstreamAddr, withMITM(t, pool, "127.0.0.1"))
+
+	proxyURL, err := url.Parse("http://" + addr)
+	require.NoError(t, err)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		Timeout: 10 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	// Every request inside tunnel is decrypted and forwarded through downstream proxy
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "pong "+path, string(b))
+		// Client sees certificate minted by proxy
+		assert.Equal(t, "Escobar MITM CA", resp.TLS.PeerCertificates[0].Issuer.CommonName)
+	}
+
+	// Destination is reached with authenticated CONNECT, connection is reused by requests
+	req := <-downstreamRequests
+	assert.Equal(t, srv.Listener.Addr().String(), req.host)
+	assert.Equal(t, basicAuthorization("test_user", "test_password"), req.authorization)
+
+	t.Run("other domains", func(t *testing.T) {
+		_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		connect, err := http.NewRequest(http.MethodConnect, "http://localhost:"+port, nil)
+		require.NoError(t, err)
+		require.NoError(t, connect.Write(conn))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, connect)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Tunnel is passed through untouched, so destination certificate is seen
+		// nolint:gosec
+		tconn := tls.Client(&bufferedConn{Conn: conn, r: br}, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, tconn.Handshake())
+		assert.Equal(t, srv.Certificate().Raw, tconn.ConnectionState().PeerCertificates[0].Raw)
+	})
+
+	t.Run("misdirected request", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req.Host = "www.google.com"
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	})
+}
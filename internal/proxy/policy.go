@@ -0,0 +1,216 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hostsNames are usual hosts-file entries which should never be blocked
+var hostsNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// policy decides if destination is allowed, blocklists are reloaded on change.
+type policy struct {
+	logger *zap.Logger
+	config *Policy
+
+	mu       sync.RWMutex
+	blocked  map[string]struct{}
+	modTimes map[string]time.Time
+}
+
+func newPolicy(logger *zap.Logger, config *Policy) *policy {
+	return &policy{
+		logger:   logger,
+		config:   config,
+		blocked:  make(map[string]struct{}),
+		modTimes: make(map[string]time.Time),
+	}
+}
+
+// load reads all blocklist files.
+func (p *policy) load() error {
+	blocked := make(map[string]struct{})
+	modTimes := make(map[string]time.Time, len(p.config.Blocklists))
+
+	for _, path := range p.config.Blocklists {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("cannot get blocklist stats: %w", err)
+		}
+		modTimes[path] = info.ModTime()
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot open blocklist: %w", err)
+		}
+
+		err = parseBlocklist(f, blocked)
+		//noinspection ALL
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read blocklist %s: %w", path, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.blocked = blocked
+	p.modTimes = modTimes
+	p.mu.Unlock()
+
+	p.logger.Info("Blocklists loaded", zap.Int("domains", len(blocked)))
+	return nil
+}
+
+// changed returns true if any of blocklist files was modified since last load.
+func (p *policy) changed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, path := range p.config.Blocklists {
+		info, err := os.Stat(path)
+		if err != nil {
+			// File is probably being replaced, try again later
+			continue
+		}
+
+		if !info.ModTime().Equal(p.modTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch reloads blocklists on change until ctx is done.
+func (p *policy) watch(ctx context.Context) {
+	if len(p.config.Blocklists) == 0 || p.config.ReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !p.changed() {
+				continue
+			}
+
+			if err := p.load(); err != nil {
+				p.logger.Error("Cannot reload blocklists, keeping previous ones", zap.Error(err))
+			}
+		}
+	}
+}
+
+// allowConnect returns an error if CONNECT to host:port is not allowed.
+func (p *policy) allowConnect(hostport string) error {
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %w", err)
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("invalid destination port: %w", err)
+	}
+
+	if !p.portAllowed(port) {
+		return fmt.Errorf("port %d is not allowed", port)
+	}
+
+	return p.allowHost(host)
+}
+
+// allowHost returns an error if host or any of its parent domains is blocked.
+func (p *policy) allowHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for domain := host; domain != ""; {
+		if _, ok := p.blocked[domain]; ok {
+			return fmt.Errorf("domain %s is blocked", domain)
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	return nil
+}
+
+func (p *policy) portAllowed(port int) bool {
+	if len(p.config.ConnectPorts) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.config.ConnectPorts {
+		if allowed == 0 || allowed == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseBlocklist parses hosts-file ("0.0.0.0 ads.evil.corp") or plain ("ads.evil.corp") format into blocked.
+func parseBlocklist(r io.Reader, blocked map[string]struct{}) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Hosts-file format starts with IP address
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+
+		for _, domain := range fields {
+			domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+			if hostsNames[domain] {
+				continue
+			}
+
+			blocked[domain] = struct{}{}
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_parseBlocklist(t *testing.T) {
+	blocked := make(map[string]struct{})
+	require.NoError(t, parseBlocklist(strings.NewReader(`
+# hosts-file format
+127.0.0.1 localhost
+0.0.0.0 ads.evil.corp tracker.evil.corp # inline comment
+
+# plain format
+Casino.example.
+`), blocked))
+
+	assert.Equal(t, map[string]struct{}{
+		"ads.evil.corp":     {},
+		"tracker.evil.corp": {},
+		"casino.example":    {},
+	}, blocked)
+}
+
+func Test_policy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(path, []byte("casino.example\n"), 0600))
+
+	p := newPolicy(zap.NewNop(), &Policy{
+		ConnectPorts:   []int{443},
+		Blocklists:     []string{path},
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, p.load())
+
+	assert.NoError(t, p.allowConnect("www.google.com:443"))
+	assert.Error(t, p.allowConnect("smtp.google.com:25"))
+	assert.Error(t, p.allowConnect("casino.example:443"))
+	assert.Error(t, p.allowConnect("www.casino.example:443"))
+	assert.NoError(t, p.allowHost("notcasino.example"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.watch(ctx)
+
+	// Blocklist is reloaded on change
+	require.NoError(t, os.WriteFile(path, []byte("poker.example\n"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.Eventually(t, func() bool {
+		return p.allowHost("poker.example") != nil && p.allowHost("casino.example") == nil
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestProxy_https_policy(t *testing.T) {
+	p := NewProxy(zap.NewNop(), &Config{
+		Policy: Policy{
+			ConnectPorts: []int{443},
+		},
+	}, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "http://smtp.google.com:25", nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestProxy_Serve_policyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(path, []byte("casino.example\n"), 0600))
+
+	p := NewProxy(zap.NewNop(), &Config{
+		Policy: Policy{
+			Blocklists:     []string{path},
+			ReloadInterval: 10 * time.Millisecond,
+		},
+	}, nil)
+	require.NoError(t, p.LoadPolicy())
+	defer p.Shutdown(context.Background())
+
+	// Policy is reloaded while proxy is serving, even if the first listener is gone
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan struct{})
+	go func() {
+		// nolint:errcheck
+		p.Serve(first)
+		close(served)
+	}()
+
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		// nolint:errcheck
+		p.Serve(second)
+	}()
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", first.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, first.Close())
+	<-served
+
+	require.NoError(t, os.WriteFile(path, []byte("poker.example\n"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.Eventually(t, func() bool {
+		return p.policy.allowHost("poker.example") != nil
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -15,6 +15,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/L11R/httputil"
@@ -28,12 +29,36 @@ const (
 	HeaderProxyAuthorization = "Proxy-Authorization"
 )
 
+type ctxKey string
+
+// clientUserCtx holds the name of authenticated client
+const clientUserCtx ctxKey = "client_user"
+
 type Proxy struct {
-	logger    *zap.Logger
-	config    *Config
-	krb5cl    *client.Client
+	logger *zap.Logger
+	config *Config
+
+	// mu guards credentials which could be replaced on reload
+	mu     sync.RWMutex
+	krb5cl *client.Client
+
 	server    *http.Server
+	tlsServer *http.Server
 	httpProxy *httputil.ReverseProxy
+	policy    *policy
+	limiter   *limiter
+	shaper    *shaper
+	tunnels   *tunnels
+	gateway   *gateway
+	mitm      *mitm
+	cache     *cache
+
+	// internalToken authenticates requests made by the proxy itself
+	internalToken string
+
+	watchOnce sync.Once
+	// stopWatch stops policy reloading, it's set once the first listener is served
+	stopWatch context.CancelFunc
 }
 
 // NewProxy returns Proxy instance
@@ -42,11 +67,64 @@ func NewProxy(logger *zap.Logger, config *Config, krb5cl *client.Client) *Proxy
 	fp.ErrorHandler = httpErrorHandler
 
 	p := &Proxy{
-		logger:    logger,
-		config:    config,
-		krb5cl:    krb5cl,
-		httpProxy: fp,
-	}
+		logger:        logger,
+		config:        config,
+		krb5cl:        krb5cl,
+		httpProxy:     fp,
+		policy:        newPolicy(logger, &config.Policy),
+		limiter:       newLimiter(&config.Limits),
+		shaper:        newShaper(config.Bandwidth),
+		tunnels:       newTunnels(),
+		internalToken: newInternalToken(),
+	}
+
+	if config.Mode == GatewayMode {
+		p.gateway = newGateway(config)
+	}
+	if config.MITM.CA != nil {
+		p.mitm = newMITM(&config.MITM)
+	}
+	// Downstream proxy applies policy per user in gateway mode, so its responses are never shared
+	if config.Cache.Dir != "" && config.Mode != GatewayMode {
+		p.cache = newCache(logger, &config.Cache)
+	}
+
+	// Plain HTTP requests are forwarded with own transport, dials are limited
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = func(*http.Request) (*url.URL, error) {
+		return p.config.DownstreamProxyURL, nil
+	}
+	tr.DialContext = p.dialContext
+	if config.IsSOCKS() {
+		// Requests are sent to destination through SOCKS5 tunnel
+		tr.Proxy = nil
+		tr.DialContext = p.dialSOCKS
+	}
+	if len(config.Chain) != 0 {
+		// Requests are sent to destination through tunnel which could carry client identity, so it is never reused
+		tr.Proxy = nil
+		tr.DialContext = p.dialChain
+		tr.DisableKeepAlives = true
+	}
+	if config.DownstreamProxyTLS.Config != nil {
+		tr.TLSClientConfig = config.DownstreamProxyTLS.Config.Clone()
+	}
+	var downstream http.RoundTripper = tr
+	if config.bindsChannel() {
+		// Pooled connection is picked after request is authenticated, so every request gets its own TLS session
+		downstream = &downstreamTransport{p: p}
+	}
+	// Routed requests go straight to destination or through named upstream
+	routed := http.DefaultTransport.(*http.Transport).Clone()
+	routed.Proxy = routeProxy
+	routed.DialContext = p.dialContext
+	if config.Limits.Dials > 0 {
+		// Idle connections must not keep dial slots from new requests and tunnels
+		p.limiter.addPool(tr)
+		p.limiter.addPool(routed)
+	}
+	p.httpProxy.Transport = p.cacheTransport(&routeTransport{downstream: downstream, routed: routed})
+	p.httpProxy.ModifyResponse = p.shapeResponse
 
 	p.httpProxy.ErrorLog = zap.NewStdLog(logger)
 	p.server = &http.Server{
@@ -60,27 +138,97 @@ func NewProxy(logger *zap.Logger, config *Config, krb5cl *client.Client) *Proxy
 		WriteTimeout:      config.Timeouts.Server.WriteTimeout,
 		IdleTimeout:       config.Timeouts.Server.IdleTimeout,
 	}
+	if config.TLS.Config != nil {
+		p.tlsServer = p.newTLSServer()
+	}
 
 	return p
 }
 
-// CheckAuth checks auth against Ping URL; should be called after starting proxy server itself
-func (p *Proxy) CheckAuth() (bool, error) {
-	u, err := url.Parse("http://" + p.config.Addr.String())
-	if err != nil {
-		return false, fmt.Errorf("invalid proxy url: %w", err)
+// cacheTransport serves responses from cache if it's enabled.
+func (p *Proxy) cacheTransport(next http.RoundTripper) http.RoundTripper {
+	if p.cache == nil {
+		return next
 	}
 
-	// We need http client with custom transport
-	httpClient := http.DefaultClient
+	return p.cache.transport(next)
+}
+
+// SetCredentials replaces downstream proxy credentials and Kerberos client, e.g. after secrets were resolved again.
+func (p *Proxy) SetCredentials(auth DownstreamProxyAuth, krb5cl *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.krb5cl
+	p.config.DownstreamProxyAuth = auth
+	p.krb5cl = krb5cl
+
+	if old != nil && old != krb5cl {
+		old.Destroy()
+	}
+}
+
+// Bandwidth returns current bandwidth limits.
+func (p *Proxy) Bandwidth() Bandwidth {
+	return p.shaper.get()
+}
+
+// SetBandwidth replaces bandwidth limits at runtime, active transfers are affected as well.
+func (p *Proxy) SetBandwidth(b Bandwidth) error {
+	if err := b.Resolve(); err != nil {
+		return err
+	}
+
+	p.shaper.set(b)
+	p.logger.Info("Bandwidth limits changed", zap.Int("global", b.Global), zap.Int("client", b.Client), zap.Strings("domains", b.DomainStrings))
+
+	return nil
+}
+
+// LoadPolicy loads destination policy blocklists, they are reloaded on change while serving.
+func (p *Proxy) LoadPolicy() error {
+	return p.policy.load()
+}
+
+// InternalTransport returns transport sending requests through the proxy itself at addr, unix socket is used if addr is
+// nil. Tunnels are authenticated as the proxy, so client authentication doesn't apply to them, plain HTTP requests need
+// internal authorization header of their own.
+func (p *Proxy) InternalTransport(addr *net.TCPAddr) *http.Transport {
+	// We need transport of our own, default one is shared by the whole process
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	host := "localhost"
+	if addr != nil {
+		host = addr.String()
+	} else {
+		// Proxy listens on unix socket only
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", p.config.Unix.Path)
+		}
+	}
 
-	tr := http.DefaultTransport
 	// Pass our newly deployed local proxy
-	tr.(*http.Transport).Proxy = http.ProxyURL(u)
+	tr.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: host})
+	// Authenticate as the proxy itself in case client authentication is enabled
+	tr.ProxyConnectHeader = http.Header{HeaderProxyAuthorization: []string{p.internalAuthorization()}}
+
+	return tr
+}
+
+// CheckAuth checks auth against Ping URL; should be called after starting proxy server itself
+func (p *Proxy) CheckAuth() (bool, error) {
+	if p.config.Mode == GatewayMode {
+		return false, errors.New("gateway mode has no own credentials to check")
+	}
+
+	tr := p.InternalTransport(p.config.AddrFor(nil))
+	defer tr.CloseIdleConnections()
 	// We check it against corporate proxy, so it usually use MITM
-	tr.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	// nolint:gosec
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
-	httpClient.Transport = tr
+	httpClient := &http.Client{Transport: tr}
 
 	req, err := http.NewRequest("GET", p.config.PingURL.String(), nil)
 	if err != nil {
@@ -91,8 +239,8 @@ func (p *Proxy) CheckAuth() (bool, error) {
 	defer cancel()
 	req = req.WithContext(ctx)
 
-	if err := p.setProxyAuthorizationHeader(req); err != nil {
-		return false, fmt.Errorf("cannot set authorization header: %w", err)
+	if req.URL.Scheme == "http" {
+		req.Header.Set(HeaderProxyAuthorization, p.internalAuthorization())
 	}
 
 	repeat := true
@@ -144,6 +292,47 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	logger.Debug("Request started")
 
+	if !p.limiter.allowRequest(clientIP(req)) {
+		logger.Warn("Client request rate limit exceeded", zap.String("client_addr", req.RemoteAddr))
+		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	user, krb5cl, ok := p.authenticateClient(rw, req)
+	if !ok {
+		return
+	}
+	if user != "" {
+		logger = logger.With(zap.String("client_user", user))
+		// nolint:staticcheck
+		ctx := context.WithValue(context.Background(), LogEntryCtx, logger)
+		req = req.WithContext(context.WithValue(ctx, clientUserCtx, user))
+	}
+	if krb5cl != nil {
+		// Request is served within handler, tunnels and intercepted requests included
+		defer krb5cl.release()
+		req = req.WithContext(context.WithValue(req.Context(), gatewayClientCtx, krb5cl.krb5cl))
+	}
+	// Client credentials and other hop headers are meant for us, not for downstream proxy
+	stripProxyHeaders(req.Header)
+
+	if rule := p.config.Routing.Match(req.Context(), requestHostPort(req), net.ParseIP(clientIP(req)), time.Now()); rule != nil {
+		if rule.Action == RejectAction {
+			logger.Warn("Request rejected by routing rule", zap.String("host", req.URL.Hostname()))
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		logger.Debug("Request routed", zap.String("route", rule.Action))
+		req = req.WithContext(context.WithValue(req.Context(), routeCtx, rule))
+	}
+
+	// HTTP/2 request carries destination in :authority, its URI isn't absolute
+	if req.ProtoMajor == 2 && req.Method != http.MethodConnect && req.URL.Host == "" {
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+	}
+
 	if req.URL.Scheme == "http" {
 		p.http(rw, req)
 	} else {
@@ -161,15 +350,52 @@ func httpErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
 		return
 	}
 
+	if errors.Is(err, errDialsLimit) {
+		logger.Warn("http: downstream proxy dials limit reached")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if code, ok := hopErrorCode(err); ok {
+		logger.Warn("http: proxy refused to establish tunnel", zap.Error(err))
+		rw.WriteHeader(code)
+		return
+	}
+
 	logger.Error("http: proxy error", zap.Error(err))
 	rw.WriteHeader(http.StatusBadGateway)
 }
 
 func (p *Proxy) http(rw http.ResponseWriter, req *http.Request) {
-	tr := http.DefaultTransport
-	tr.(*http.Transport).Proxy = http.ProxyURL(p.config.DownstreamProxyURL)
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	if err := p.policy.allowHost(req.URL.Hostname()); err != nil {
+		logger.Warn("Destination blocked by policy", zap.Error(err))
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	p.config.Headers.Apply(req.URL.Hostname(), req.Header)
+
+	// Protocol switch takes the connection over, so it's relayed as a tunnel
+	if isUpgrade(req) {
+		p.upgrade(rw, req)
+		return
+	}
 
-	if err := p.setProxyAuthorizationHeader(req); err != nil {
+	var err error
+	rule, routed := req.Context().Value(routeCtx).(*Rule)
+	switch {
+	case routed && rule.Upstream != nil:
+		// Named upstream is authenticated with own mode and credentials
+		err = p.setHopAuthorizationHeader(req, rule.Upstream)
+	case routed, p.config.IsSOCKS(), len(p.config.Chain) != 0:
+		// Request goes straight to destination, SOCKS5 proxy and proxy chain authenticate on connection
+	case p.config.bindsChannel():
+		// Kerberos token is bound to TLS session, so it's set by transport once the session is established
+	default:
+		err = p.setProxyAuthorizationHeader(req)
+	}
+	if err != nil {
 		httpErrorHandler(rw, req, fmt.Errorf("cannot set authorization header: %w", err))
 		return
 	}
@@ -177,6 +403,20 @@ func (p *Proxy) http(rw http.ResponseWriter, req *http.Request) {
 	p.httpProxy.ServeHTTP(rw, req)
 }
 
+// shapeResponse limits bandwidth of plain HTTP response body.
+func (p *Proxy) shapeResponse(resp *http.Response) error {
+	req := resp.Request
+	limiters, release := p.shaper.acquire(clientIP(req), req.URL.Hostname())
+
+	resp.Body = &shapedReadCloser{
+		Reader:  newShapedReader(req.Context(), resp.Body, limiters),
+		closer:  resp.Body,
+		release: release,
+	}
+
+	return nil
+}
+
 func httpsErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
 	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
 
@@ -189,7 +429,14 @@ func httpsErrorHijackedHandler(brw *bufio.ReadWriter, req *http.Request, err err
 
 	logger.Error("https: proxy error", zap.Error(err))
 
-	resp := newResponse(http.StatusBadGateway, nil, req)
+	writeHijackedResponse(brw, req, http.StatusBadGateway)
+}
+
+// writeHijackedResponse writes empty response with code into hijacked connection.
+func writeHijackedResponse(brw *bufio.ReadWriter, req *http.Request, code int) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	resp := newResponse(code, nil, req)
 	if err := resp.Write(brw); err != nil {
 		logger.Error("Cannot write response", zap.Error(err))
 	}
@@ -207,33 +454,112 @@ func (p *Proxy) https(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Take control of the connection
-	hj, ok := rw.(http.Hijacker)
+	conn, brw, release, ok := p.hijackTunnel(rw, req)
 	if !ok {
-		httpsErrorHandler(rw, req, fmt.Errorf("hijacking is not supported"))
 		return
 	}
+	defer release()
 
-	conn, brw, err := hj.Hijack()
-	if err != nil {
-		httpsErrorHandler(rw, req, fmt.Errorf("hijack failed: %w", err))
+	// Refusal is written into tunnel as other errors, so HTTP/2 stream gets it as headers too
+	if err := p.policy.allowConnect(req.Host); err != nil {
+		logger.Warn("Destination blocked by policy", zap.Error(err))
+		writeHijackedResponse(brw, req, http.StatusForbidden)
 		return
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
+
+	if p.mitm != nil && p.mitm.match(req.URL.Hostname()) {
+		p.intercept(conn, brw, req)
+		return
+	}
+	if rule, ok := req.Context().Value(routeCtx).(*Rule); ok {
+		p.dialAndCopy(conn, brw, req, p.dialRule(rule))
+		return
+	}
+	if p.config.IsSOCKS() {
+		p.dialAndCopy(conn, brw, req, p.dialSOCKS)
+		return
+	}
+	if len(p.config.Chain) != 0 {
+		p.dialAndCopy(conn, brw, req, p.dialChain)
+		return
+	}
+
+	p.connectAndCopy(conn, brw, req, false)
+}
+
+// hijackTunnel takes control of client connection for a tunnel, release must be called once the tunnel is closed.
+func (p *Proxy) hijackTunnel(rw http.ResponseWriter, req *http.Request) (net.Conn, *bufio.ReadWriter, func(), bool) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	var (
+		conn net.Conn
+		brw  *bufio.ReadWriter
+	)
+	if req.ProtoMajor == 2 {
+		// HTTP/2 stream can't be hijacked, it's used as connection itself
+		sconn := newStreamConn(rw, req)
+		conn, brw = sconn, bufio.NewReadWriter(bufio.NewReader(sconn), bufio.NewWriter(sconn))
+	} else {
+		// Take control of the connection
+		hj, ok := rw.(http.Hijacker)
+		if !ok {
+			httpsErrorHandler(rw, req, fmt.Errorf("hijacking is not supported"))
+			return nil, nil, nil, false
+		}
+
+		var err error
+		conn, brw, err = hj.Hijack()
+		if err != nil {
+			httpsErrorHandler(rw, req, fmt.Errorf("hijack failed: %w", err))
+			return nil, nil, nil, false
+		}
+	}
+
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	releases = append(releases, func() {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			logger.Error("Cannot close connection", zap.Error(err))
 		}
-	}()
+		if sconn, ok := conn.(*streamConn); ok {
+			sconn.wait()
+		}
+	})
+
+	// Track tunnel to drain it on shutdown
+	if !p.tunnels.add(conn) {
+		writeHijackedResponse(brw, req, http.StatusServiceUnavailable)
+		release()
+		return nil, nil, nil, false
+	}
+	releases = append(releases, func() {
+		p.tunnels.remove(conn)
+	})
+
+	releaseTunnel, code := p.limiter.acquireTunnel(clientIP(req))
+	if code != 0 {
+		logger.Warn("Tunnels limit reached", zap.String("client_addr", req.RemoteAddr), zap.Int("code", code))
+		writeHijackedResponse(brw, req, code)
+		release()
+		return nil, nil, nil, false
+	}
+	releases = append(releases, releaseTunnel)
 
 	// Set Keep-Alive
 	if tconn, ok := conn.(*net.TCPConn); ok {
 		if err := tconn.SetKeepAlive(true); err != nil {
 			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot turn on keep-alive: %w", err))
-			return
+			release()
+			return nil, nil, nil, false
 		}
 		if err := tconn.SetKeepAlivePeriod(p.config.Timeouts.Client.KeepAlivePeriod); err != nil {
 			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot set keep-alive period: %w", err))
-			return
+			release()
+			return nil, nil, nil, false
 		}
 	}
 
@@ -242,17 +568,19 @@ func (p *Proxy) https(rw http.ResponseWriter, req *http.Request) {
 	if p.config.Timeouts.Client.ReadTimeout.Nanoseconds() != 0 {
 		if err := conn.SetReadDeadline(now.Add(p.config.Timeouts.Client.ReadTimeout)); err != nil {
 			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot set read timeout for connection with client: %w", err))
-			return
+			release()
+			return nil, nil, nil, false
 		}
 	}
 	if p.config.Timeouts.Client.WriteTimeout.Nanoseconds() != 0 {
 		if err := conn.SetWriteDeadline(now.Add(p.config.Timeouts.Client.WriteTimeout)); err != nil {
 			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot set write timeout for connection with client: %w", err))
-			return
+			release()
+			return nil, nil, nil, false
 		}
 	}
 
-	p.connectAndCopy(conn, brw, req, false)
+	return conn, brw, release, true
 }
 
 // connectAndCopy connects to downstream proxy, authenticates if there is a need and copies traffic between connections
@@ -262,8 +590,14 @@ func (p *Proxy) connectAndCopy(conn net.Conn, brw *bufio.ReadWriter, req *http.R
 	retries := 0
 ProxyDialRetry:
 	// Open connection with downstream proxy
-	pconn, err := net.DialTimeout("tcp", p.config.DownstreamProxyURL.Host, p.config.Timeouts.DownstreamProxy.DialTimeout)
+	pconn, err := p.dialContext(context.Background(), "tcp", p.config.DownstreamProxyAddr())
 	if err != nil {
+		if errors.Is(err, errDialsLimit) {
+			logger.Warn("Downstream proxy dials limit reached")
+			writeHijackedResponse(brw, req, http.StatusServiceUnavailable)
+			return
+		}
+
 		if retries < p.config.DownstreamProxyDialRetries {
 			logger.Error("Connection to downstream proxy failed.", zap.Error(err))
 			retries++
@@ -277,13 +611,14 @@ ProxyDialRetry:
 		return
 	}
 	defer func() {
-		if err := pconn.Close(); err != nil {
+		if err := pconn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			logger.Error("Cannot close connection", zap.Error(err))
 		}
 	}()
+	p.tunnels.setBackend(conn, pconn)
 
 	// Set Keep-Alive
-	if tconn, ok := pconn.(*net.TCPConn); ok {
+	if tconn, ok := tcpConn(pconn); ok {
 		if err := tconn.SetKeepAlive(true); err != nil {
 			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot turn on keep-alive: %w", err))
 			return
@@ -295,23 +630,35 @@ ProxyDialRetry:
 	}
 
 	// Set Downstream Proxy connection timeouts
-	now := time.Now()
-	if p.config.Timeouts.DownstreamProxy.ReadTimeout.Nanoseconds() != 0 {
-		if err := pconn.SetReadDeadline(now.Add(p.config.Timeouts.DownstreamProxy.ReadTimeout)); err != nil {
-			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot set read timeout for connection with downstream proxy: %w", err))
-			return
-		}
+	if err := p.setDownstreamDeadlines(pconn); err != nil {
+		httpsErrorHijackedHandler(brw, req, err)
+		return
 	}
-	if p.config.Timeouts.DownstreamProxy.WriteTimeout.Nanoseconds() != 0 {
-		if err := pconn.SetWriteDeadline(now.Add(p.config.Timeouts.DownstreamProxy.WriteTimeout)); err != nil {
-			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot set write timeout for connection with downstream proxy: %w", err))
+
+	// CONNECT is sent inside TLS session with downstream proxy itself
+	if p.config.DownstreamProxyURL.Scheme == "https" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeouts.DownstreamProxy.DialTimeout)
+		tconn, err := p.config.DownstreamProxyTLS.Client(ctx, pconn)
+		cancel()
+		if err != nil {
+			httpsErrorHijackedHandler(brw, req, err)
 			return
 		}
+		pconn = tconn
+
+		// Kerberos token is bound to this session
+		bindings := tlsServerEndPoint(tconn.ConnectionState().PeerCertificates[0])
+		req = req.WithContext(context.WithValue(req.Context(), channelBindingsCtx, bindings))
 	}
 
 	pbw := bufio.NewWriter(pconn)
 	pbr := bufio.NewReader(pconn)
 
+	// Request is rewritten once, reconnection sends it as is
+	if !reconnected {
+		p.config.Headers.Apply(req.URL.Hostname(), req.Header)
+	}
+
 	// Write client's request into proxy connection
 	if err := req.Write(pbw); err != nil {
 		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write request into proxy connection: %w", err))
@@ -401,12 +748,108 @@ ProxyDialRetry:
 		return
 	}
 
+	p.copyTunnel(conn, pconn, brw, req)
+}
+
+// dialAndCopy opens tunnel to destination with dial function, e.g. through SOCKS5 downstream proxy or proxy chain,
+// and copies traffic.
+func (p *Proxy) dialAndCopy(conn net.Conn, brw *bufio.ReadWriter, req *http.Request, dial dialerFunc) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	var pconn net.Conn
+	err := p.dialRetrying(logger, func() (err error) {
+		pconn, err = dial(req.Context(), "tcp", req.Host)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errDialsLimit) {
+			logger.Warn("Downstream proxy dials limit reached")
+			writeHijackedResponse(brw, req, http.StatusServiceUnavailable)
+			return
+		}
+		if code, ok := hopErrorCode(err); ok {
+			logger.Warn("Proxy refused to establish tunnel", zap.Error(err))
+			writeHijackedResponse(brw, req, code)
+			return
+		}
+
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot connect through downstream proxy: %w", err))
+		return
+	}
+	defer func() {
+		if err := pconn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Cannot close connection", zap.Error(err))
+		}
+	}()
+	p.tunnels.setBackend(conn, pconn)
+
+	if err := p.setDownstreamDeadlines(pconn); err != nil {
+		httpsErrorHijackedHandler(brw, req, err)
+		return
+	}
+
+	// Tunnel is established, response of the proxy has been consumed already
+	if err := newResponse(http.StatusOK, nil, req).Write(brw); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write response into client connection: %w", err))
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot flush writer to commit response into client connection: %w", err))
+		return
+	}
+
+	p.copyTunnel(conn, pconn, brw, req)
+}
+
+// dialRetrying calls dial until it succeeds or downstream proxy dial retries are exhausted.
+func (p *Proxy) dialRetrying(logger *zap.Logger, dial func() error) error {
+	for retries := 0; ; retries++ {
+		err := dial()
+		if err == nil || errors.Is(err, errDialsLimit) || retries >= p.config.DownstreamProxyDialRetries {
+			return err
+		}
+		// Proxy in chain has answered, there is no point to retry
+		if _, ok := hopErrorCode(err); ok {
+			return err
+		}
+
+		logger.Error("Connection to downstream proxy failed.", zap.Error(err))
+		time.Sleep(1 * time.Second)
+		logger.Debug("Downstream proxy dial retry.", zap.Int("retries", retries+1))
+	}
+}
+
+// setDownstreamDeadlines sets downstream proxy connection timeouts.
+func (p *Proxy) setDownstreamDeadlines(pconn net.Conn) error {
+	now := time.Now()
+	if p.config.Timeouts.DownstreamProxy.ReadTimeout.Nanoseconds() != 0 {
+		if err := pconn.SetReadDeadline(now.Add(p.config.Timeouts.DownstreamProxy.ReadTimeout)); err != nil {
+			return fmt.Errorf("cannot set read timeout for connection with downstream proxy: %w", err)
+		}
+	}
+	if p.config.Timeouts.DownstreamProxy.WriteTimeout.Nanoseconds() != 0 {
+		if err := pconn.SetWriteDeadline(now.Add(p.config.Timeouts.DownstreamProxy.WriteTimeout)); err != nil {
+			return fmt.Errorf("cannot set write timeout for connection with downstream proxy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// copyTunnel copies traffic between client and established tunnel.
+func (p *Proxy) copyTunnel(conn, pconn net.Conn, brw *bufio.ReadWriter, req *http.Request) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	limiters, release := p.shaper.acquire(clientIP(req), req.URL.Hostname())
+	defer release()
+
 	// Start traffic copying inside newly created tunnel
 	errc := make(chan error, 1)
 	cc := connectCopier{
-		logger:  logger,
-		client:  conn,
-		backend: pconn,
+		logger:   logger,
+		client:   conn,
+		backend:  pconn,
+		limiters: limiters,
 	}
 	go cc.copyToBackend(errc)
 	go cc.copyFromBackend(errc)
@@ -414,7 +857,7 @@ ProxyDialRetry:
 	logger.Debug("CONNECT tunnel opened")
 	defer logger.Debug("CONNECT tunnel closed")
 
-	err = <-errc
+	err := <-errc
 	if err == nil {
 		err = <-errc
 	}
@@ -427,10 +870,39 @@ ProxyDialRetry:
 	logger.Debug("Traffic copied successfully")
 }
 
+// dialContext dials downstream proxy, open connections are limited.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	release, ok := p.limiter.acquireDial()
+	if !ok {
+		return nil, errDialsLimit
+	}
+
+	d := net.Dialer{Timeout: p.config.Timeouts.DownstreamProxy.DialTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Slot is held while connection is open
+	tconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		release()
+		return conn, nil
+	}
+
+	return &limitedConn{TCPConn: tconn, release: release}, nil
+}
+
 func (p *Proxy) Listen() (net.Listener, error) {
-	p.logger.Info("Listening socket", zap.String("address", p.config.Addr.String()))
+	return p.ListenTCP(p.config.Addr)
+}
 
-	l, err := net.Listen("tcp", p.config.Addr.String())
+// ListenTCP listens on proxy address, e.g. one of additional listeners.
+func (p *Proxy) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	p.logger.Info("Listening socket", zap.String("address", addr.String()))
+
+	l, err := net.Listen("tcp", addr.String())
 	if err != nil {
 		p.logger.Error("Error while listening!", zap.Error(err))
 		return nil, err
@@ -439,12 +911,30 @@ func (p *Proxy) Listen() (net.Listener, error) {
 	return l, nil
 }
 
-// Serve serves HTTP requests.
+// Serve serves HTTP requests, listener could be inherited from previous process.
 func (p *Proxy) Serve(l net.Listener) error {
-	p.logger.Info("Serving HTTP requests", zap.String("address", p.config.Addr.String()))
+	p.logger.Info("Serving HTTP requests", zap.String("address", l.Addr().String()))
+
+	if acl := p.config.aclFor(l.Addr()); !acl.Empty() {
+		l = newACLListener(l, p.logger, acl)
+	}
 
-	if err := p.server.Serve(l); err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
+	server := p.server
+	if p.tlsServer != nil && p.config.TLS.isAddr(l.Addr()) {
+		server = p.tlsServer
+		l = tls.NewListener(l, server.TLSConfig)
+	}
+
+	// Reload policy while serving, once for all listeners until proxy is shut down
+	p.watchOnce.Do(func() {
+		var ctx context.Context
+		ctx, p.stopWatch = context.WithCancel(context.Background())
+		go p.policy.watch(ctx)
+	})
+
+	if err := server.Serve(l); err != nil {
+		// Listener is closed on shutdown or when it's handed over to new process
+		if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 			p.logger.Error("Error while serving HTTP requests!", zap.Error(err))
 			return err
 		}
@@ -453,12 +943,70 @@ func (p *Proxy) Serve(l net.Listener) error {
 	return nil
 }
 
-// Shutdown shuts down the HTTP server.
+// Shutdown shuts down the HTTP server and drains CONNECT tunnels, they are force-closed after grace period.
 func (p *Proxy) Shutdown(ctx context.Context) error {
+	// Policy isn't reloaded after shutdown, even if listener is served later
+	p.watchOnce.Do(func() {})
+	if p.stopWatch != nil {
+		p.stopWatch()
+	}
+	p.tunnels.stop()
+
+	// HTTP/2 connection is active while its streams carry tunnels, so it's closed once they are drained
+	tlsErrc := make(chan error, 1)
+	go func() {
+		if p.tlsServer == nil {
+			tlsErrc <- nil
+			return
+		}
+
+		tlsErrc <- p.tlsServer.Shutdown(ctx)
+	}()
+
+	err := p.shutdown(ctx)
+	if tlsErr := <-tlsErrc; tlsErr != nil {
+		p.logger.Error("Error shutting down TLS server!", zap.Error(tlsErr))
+		if err == nil {
+			err = tlsErr
+		}
+	}
+
+	return err
+}
+
+// shutdown shuts down plain HTTP server and drains tunnels.
+func (p *Proxy) shutdown(ctx context.Context) error {
 	if err := p.server.Shutdown(ctx); err != nil {
 		p.logger.Error("Error shutting down HTTP server!", zap.Error(err))
+		p.tunnels.closeAll()
 		return err
 	}
 
+	active := p.tunnels.count()
+	if active == 0 {
+		return nil
+	}
+
+	p.logger.Info("Draining tunnels", zap.Int("tunnels", active), zap.Duration("grace_period", p.config.Timeouts.Server.DrainTimeout))
+
+	timer := time.NewTimer(p.config.Timeouts.Server.DrainTimeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+Drain:
+	for p.tunnels.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			break Drain
+		case <-ctx.Done():
+			break Drain
+		}
+	}
+
+	forced := p.tunnels.closeAll()
+	p.logger.Info("Tunnels drained", zap.Int("drained", active-forced), zap.Int("forced", forced))
+
 	return nil
 }
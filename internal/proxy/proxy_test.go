@@ -42,6 +42,53 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
+// newTestProxy starts proxy authenticating to downstream proxy with test credentials, options change its config and
+// resolve parts they set. Proxy listens with TLS only if it's configured. Returns proxy address.
+func newTestProxy(t *testing.T, downstreamProxyURL string, options ...func(config *Config)) string {
+	u, err := url.Parse(downstreamProxyURL)
+	require.NoError(t, err)
+
+	config := &Config{
+		DownstreamProxyURL: u,
+		DownstreamProxyAuth: DownstreamProxyAuth{
+			User:     "test_user",
+			Password: "test_password",
+		},
+		Policy: Policy{ConnectPorts: []int{0}},
+		Timeouts: Timeouts{
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+		Mode: BasicMode,
+	}
+	for _, option := range options {
+		option(config)
+	}
+
+	p := NewProxy(zap.NewNop(), config, nil)
+
+	var l net.Listener
+	if config.TLS.Config != nil {
+		l, err = p.ListenTLS()
+		require.NoError(t, err)
+		// TLS is served on listener by its actual address
+		config.TLS.Addr = l.Addr().(*net.TCPAddr)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+	}
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	t.Cleanup(func() {
+		// nolint:errcheck
+		p.Shutdown(context.Background())
+	})
+
+	return l.Addr().String()
+}
+
 func TestNewProxy(t *testing.T) {
 	logger := zap.NewNop()
 
@@ -107,6 +154,10 @@ func TestNewProxy(t *testing.T) {
 		config:    config,
 		krb5cl:    krb5cl,
 		httpProxy: httputil.NewForwardingProxy(),
+		policy:    newPolicy(logger, &config.Policy),
+		limiter:   newLimiter(&config.Limits),
+		shaper:    newShaper(config.Bandwidth),
+		tunnels:   newTunnels(),
 	}
 
 	expected.httpProxy.ErrorLog = zap.NewStdLog(logger)
@@ -121,6 +172,8 @@ func TestNewProxy(t *testing.T) {
 	}
 
 	actual := NewProxy(logger, config, krb5cl)
+	// Token is random
+	expected.internalToken = actual.internalToken
 	assert.Equal(t, expected, actual)
 }
 
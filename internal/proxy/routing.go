@@ -0,0 +1,404 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeCtx holds routing rule matched by request
+const routeCtx ctxKey = "route"
+
+const (
+	// DirectAction sends request straight to destination
+	DirectAction = "DIRECT"
+	// RejectAction refuses request with 403
+	RejectAction = "REJECT"
+)
+
+// Rule routes requests matching every set condition, any of condition values should match.
+type Rule struct {
+	// Domains are destination domain globs, e.g. "*.github.com"
+	Domains []string
+	// Networks are destination networks, domains are resolved to match them
+	Networks []*net.IPNet
+	Ports    []int
+	Clients  []*net.IPNet
+	Windows  []TimeWindow
+
+	// Action is DIRECT, REJECT or upstream name
+	Action   string
+	Upstream *Hop
+}
+
+// TimeWindow is a local time range in minutes since midnight, it wraps around midnight if end is before start.
+type TimeWindow struct {
+	Start int
+	End   int
+}
+
+// ParseTimeWindow parses local time range, e.g. "09:00-18:00" or "22:00-06:00".
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return TimeWindow{}, fmt.Errorf("invalid time window %q", s)
+	}
+
+	parse := func(s string) (int, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time window %q: %w", s, err)
+		}
+
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	var (
+		w   TimeWindow
+		err error
+	)
+	if w.Start, err = parse(start); err != nil {
+		return TimeWindow{}, err
+	}
+	if w.End, err = parse(end); err != nil {
+		return TimeWindow{}, err
+	}
+
+	return w, nil
+}
+
+// Contains returns true if local time of t is within the window, end is exclusive.
+func (w TimeWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return m >= w.Start && m < w.End
+	}
+
+	return m >= w.Start || m < w.End
+}
+
+// ParseRule parses routing rule, e.g. "domain=*.github.com;domain=github.com;port=443;action=github".
+// Conditions are domain, cidr, port, client and time, action is DIRECT, REJECT or upstream name.
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || value == "" {
+			return Rule{}, fmt.Errorf("invalid rule option %q", part)
+		}
+
+		switch key {
+		case "domain":
+			if _, err := path.Match(value, ""); err != nil {
+				return Rule{}, fmt.Errorf("invalid domain glob %q: %w", value, err)
+			}
+			rule.Domains = append(rule.Domains, strings.ToLower(value))
+		case "cidr":
+			networks, err := parseNetworks([]string{value})
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid destination network: %w", err)
+			}
+			rule.Networks = append(rule.Networks, networks...)
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid port %q: %w", value, err)
+			}
+			rule.Ports = append(rule.Ports, port)
+		case "client":
+			networks, err := parseNetworks([]string{value})
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid client network: %w", err)
+			}
+			rule.Clients = append(rule.Clients, networks...)
+		case "time":
+			w, err := ParseTimeWindow(value)
+			if err != nil {
+				return Rule{}, err
+			}
+			rule.Windows = append(rule.Windows, w)
+		case "action":
+			if rule.Action != "" {
+				return Rule{}, fmt.Errorf("rule %q has several actions", s)
+			}
+			rule.Action = value
+			if a := strings.ToUpper(value); a == DirectAction || a == RejectAction {
+				rule.Action = a
+			}
+		default:
+			return Rule{}, fmt.Errorf("invalid rule option %q", part)
+		}
+	}
+
+	if rule.Action == "" {
+		return Rule{}, fmt.Errorf("rule %q has no action", s)
+	}
+
+	return rule, nil
+}
+
+// ResolveRouting parses named upstreams and routing rules.
+func (c *Config) ResolveRouting() error {
+	c.Routing.Upstreams = make(map[string]*Hop, len(c.Routing.UpstreamStrings))
+	for _, s := range c.Routing.UpstreamStrings {
+		name, rawHop, ok := strings.Cut(s, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("upstream %q has no name", s)
+		}
+		if a := strings.ToUpper(name); a == DirectAction || a == RejectAction {
+			return fmt.Errorf("upstream name %s is reserved", name)
+		}
+		if _, ok := c.Routing.Upstreams[name]; ok {
+			return fmt.Errorf("upstream %s is defined twice", name)
+		}
+
+		hop, err := ParseHop(rawHop)
+		if err != nil {
+			return fmt.Errorf("upstream %s: %w", name, err)
+		}
+		if err := c.checkHopMode(hop); err != nil {
+			return fmt.Errorf("upstream %s: %w", name, err)
+		}
+
+		c.Routing.Upstreams[name] = &hop
+	}
+
+	c.Routing.Rules = make([]Rule, 0, len(c.Routing.RuleStrings))
+	for _, s := range c.Routing.RuleStrings {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return err
+		}
+
+		if rule.Action != DirectAction && rule.Action != RejectAction {
+			upstream, ok := c.Routing.Upstreams[rule.Action]
+			if !ok {
+				return fmt.Errorf("rule %q refers to unknown upstream %s", s, rule.Action)
+			}
+			rule.Upstream = upstream
+		}
+
+		c.Routing.Rules = append(c.Routing.Rules, rule)
+	}
+
+	return nil
+}
+
+// routeRequest is destination and client of request being routed.
+type routeRequest struct {
+	host   string
+	port   int
+	client net.IP
+	now    time.Time
+
+	// ips of destination domain, resolved once if any rule needs them
+	ips      []net.IP
+	resolved bool
+}
+
+// Match returns the first rule matching request, nil means downstream proxy.
+func (r *Routing) Match(ctx context.Context, hostport string, client net.IP, now time.Time) *Rule {
+	if len(r.Rules) == 0 {
+		return nil
+	}
+
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil
+	}
+
+	rr := &routeRequest{
+		host:   strings.TrimSuffix(strings.ToLower(host), "."),
+		port:   port,
+		client: client,
+		now:    now,
+	}
+	for i := range r.Rules {
+		if r.Rules[i].match(ctx, rr) {
+			return &r.Rules[i]
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) match(ctx context.Context, rr *routeRequest) bool {
+	if len(r.Domains) != 0 && !r.matchDomain(rr.host) {
+		return false
+	}
+	if len(r.Ports) != 0 && !r.matchPort(rr.port) {
+		return false
+	}
+	if len(r.Clients) != 0 && (rr.client == nil || !containsIP(r.Clients, rr.client)) {
+		return false
+	}
+	if len(r.Windows) != 0 && !r.matchTime(rr.now) {
+		return false
+	}
+	if len(r.Networks) != 0 && !r.matchNetwork(rr.destinationIPs(ctx)) {
+		return false
+	}
+
+	return true
+}
+
+func (r *Rule) matchDomain(host string) bool {
+	for _, glob := range r.Domains {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchPort(port int) bool {
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchTime(now time.Time) bool {
+	for _, w := range r.Windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchNetwork(ips []net.IP) bool {
+	for _, ip := range ips {
+		if containsIP(r.Networks, ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// destinationIPs returns destination IP or resolves domain, resolving failure matches nothing.
+func (rr *routeRequest) destinationIPs(ctx context.Context) []net.IP {
+	if rr.resolved {
+		return rr.ips
+	}
+	rr.resolved = true
+
+	if ip := net.ParseIP(rr.host); ip != nil {
+		rr.ips = []net.IP{ip}
+		return rr.ips
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, rr.host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		rr.ips = append(rr.ips, addr.IP)
+	}
+
+	return rr.ips
+}
+
+// requestHostPort returns destination of request with default port of its scheme.
+func requestHostPort(req *http.Request) string {
+	if req.URL.Scheme == "http" {
+		if req.URL.Port() == "" {
+			return net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+
+		return req.URL.Host
+	}
+
+	return req.Host
+}
+
+// dialRule returns dial function connecting to destination according to rule action.
+func (p *Proxy) dialRule(rule *Rule) dialerFunc {
+	if rule.Upstream == nil {
+		return p.dialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := p.dialContext(ctx, network, rule.Upstream.Addr())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.connectUpstream(ctx, conn, addr, rule.Upstream); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// connectUpstream establishes tunnel to destination address through named upstream within dial timeout.
+func (p *Proxy) connectUpstream(ctx context.Context, conn net.Conn, addr string, upstream *Hop) error {
+	if timeout := p.config.Timeouts.DownstreamProxy.DialTimeout; timeout != 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("cannot set deadline for connection with upstream: %w", err)
+		}
+		// nolint:errcheck
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	return p.connectHop(ctx, conn, bufio.NewReader(conn), addr, upstream)
+}
+
+// routeTransport sends plain HTTP request with transport of its route.
+type routeTransport struct {
+	// downstream sends requests through downstream proxy
+	downstream http.RoundTripper
+	// routed sends requests to destination or named upstream
+	routed http.RoundTripper
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Value(routeCtx).(*Rule); ok {
+		return t.routed.RoundTrip(req)
+	}
+
+	return t.downstream.RoundTrip(req)
+}
+
+// routeProxy returns upstream URL of request route, nil means destination itself.
+func routeProxy(req *http.Request) (*url.URL, error) {
+	if rule, ok := req.Context().Value(routeCtx).(*Rule); ok && rule.Upstream != nil {
+		return rule.Upstream.URL, nil
+	}
+
+	return nil, nil
+}
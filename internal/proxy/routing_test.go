@@ -0,0 +1,286 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("domain=*.GitHub.com;domain=github.com;port=443;client=10.0.0.0/8;cidr=192.168.0.1;time=09:00-18:00;action=github")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.github.com", "github.com"}, rule.Domains)
+	assert.Equal(t, []int{443}, rule.Ports)
+	assert.Equal(t, "10.0.0.0/8", rule.Clients[0].String())
+	assert.Equal(t, "192.168.0.1/32", rule.Networks[0].String())
+	assert.Equal(t, []TimeWindow{{Start: 9 * 60, End: 18 * 60}}, rule.Windows)
+	assert.Equal(t, "github", rule.Action)
+
+	rule, err = ParseRule("action=direct")
+	require.NoError(t, err)
+	assert.Equal(t, DirectAction, rule.Action)
+
+	for _, invalid := range []string{
+		"",
+		"domain=*.github.com",
+		"domain=[;action=DIRECT",
+		"port=https;action=DIRECT",
+		"cidr=10.0.0.0/33;action=DIRECT",
+		"client=evil.corp;action=DIRECT",
+		"time=9-18;action=DIRECT",
+		"time=09:00;action=DIRECT",
+		"action=DIRECT;action=REJECT",
+		"host=github.com;action=DIRECT",
+	} {
+		_, err := ParseRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTimeWindow_Contains(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	day := TimeWindow{Start: 9 * 60, End: 18 * 60}
+	assert.True(t, day.Contains(at(9, 0)))
+	assert.True(t, day.Contains(at(17, 59)))
+	assert.False(t, day.Contains(at(18, 0)))
+	assert.False(t, day.Contains(at(8, 59)))
+
+	// Window wraps around midnight
+	night := TimeWindow{Start: 22 * 60, End: 6 * 60}
+	assert.True(t, night.Contains(at(23, 0)))
+	assert.True(t, night.Contains(at(5, 59)))
+	assert.False(t, night.Contains(at(12, 0)))
+}
+
+func TestConfig_ResolveRouting(t *testing.T) {
+	config := &Config{
+		Routing: Routing{
+			UpstreamStrings: []string{"github=http://gw.evil.corp:8080;user=ivanovii;password=Qwerty123"},
+			RuleStrings:     []string{"domain=*.github.com;action=github", "cidr=10.0.0.0/8;action=DIRECT"},
+		},
+		Mode: AutoMode,
+	}
+	require.NoError(t, config.ResolveRouting())
+	require.Len(t, config.Routing.Rules, 2)
+	assert.Same(t, config.Routing.Upstreams["github"], config.Routing.Rules[0].Upstream)
+	assert.Equal(t, BasicMode, config.Routing.Rules[0].Upstream.Mode)
+	assert.Nil(t, config.Routing.Rules[1].Upstream)
+
+	for upstreams, expected := range map[string]string{
+		"http://gw.evil.corp:8080":                    `upstream "http://gw.evil.corp:8080" has no name`,
+		"direct=http://gw.evil.corp:8080":             "upstream name direct is reserved",
+		"github=gw.evil.corp:8080":                    `upstream github: proxy URL "gw.evil.corp:8080" must be http one`,
+		"github=http://gw.evil.corp:8080;mode=manual": "upstream github: manual mode requires escobar to run in the same mode",
+	} {
+		config.Routing.UpstreamStrings = []string{upstreams}
+		assert.EqualError(t, config.ResolveRouting(), expected)
+	}
+
+	config.Routing.UpstreamStrings = nil
+	assert.EqualError(t, config.ResolveRouting(), `rule "domain=*.github.com;action=github" refers to unknown upstream github`)
+}
+
+func TestRouting_Match(t *testing.T) {
+	config := &Config{
+		Routing: Routing{
+			UpstreamStrings: []string{"github=http://gw.evil.corp:8080", "night=http://night.evil.corp:8080"},
+			RuleStrings: []string{
+				"domain=vendor.evil.corp;client=10.0.0.0/8;action=REJECT",
+				"domain=*.github.com;domain=github.com;port=443;action=github",
+				"cidr=192.168.0.0/16;action=DIRECT",
+				"time=22:00-06:00;action=night",
+			},
+		},
+	}
+	require.NoError(t, config.ResolveRouting())
+
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	midnight := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	client := net.ParseIP("10.0.0.1")
+
+	for _, tc := range []struct {
+		hostport string
+		client   net.IP
+		now      time.Time
+		expected string
+	}{
+		{"vendor.evil.corp:443", client, noon, RejectAction},
+		{"vendor.evil.corp:443", net.ParseIP("172.16.0.1"), noon, ""},
+		{"api.GitHub.com.:443", client, noon, "github"},
+		{"github.com:443", client, noon, "github"},
+		{"github.com:80", client, noon, ""},
+		{"192.168.1.1:443", client, noon, DirectAction},
+		{"www.google.com:443", client, noon, ""},
+		{"www.google.com:443", client, midnight, "night"},
+		// The first matching rule wins
+		{"github.com:443", client, midnight, "github"},
+	} {
+		rule := config.Routing.Match(context.Background(), tc.hostport, tc.client, tc.now)
+		if tc.expected == "" {
+			assert.Nil(t, rule, tc.hostport)
+			continue
+		}
+
+		require.NotNil(t, rule, tc.hostport)
+		assert.Equal(t, tc.expected, rule.Action, tc.hostport)
+	}
+}
+
+// withRouting routes requests and tunnels by rules.
+func withRouting(t *testing.T, routing Routing) func(config *Config) {
+	return func(config *Config) {
+		config.Routing = routing
+		require.NoError(t, config.ResolveRouting())
+	}
+}
+
+func TestProxy_https_routing(t *testing.T) {
+	directAddr := serveEcho(t, "127.0.0.1")
+	upstreamedAddr := serveEcho(t, "127.0.0.1")
+	defaultAddr := serveEcho(t, "127.0.0.1")
+
+	upstreamAddr, upstreamRequests := serveConnect(t, basicAuthorization("partner", "Partner123"))
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	_, directPort, err := net.SplitHostPort(directAddr)
+	require.NoError(t, err)
+
+	addr := newTestProxy(t, "http://"+downstreamAddr, withRouting(t, Routing{
+		UpstreamStrings: []string{"partner=http://" + upstreamAddr + ";user=partner;password=Partner123"},
+		RuleStrings: []string{
+			"domain=reject.evil.corp;action=REJECT",
+			"cidr=127.0.0.0/8;port=" + directPort + ";action=DIRECT",
+			"domain=127.0.0.1;client=127.0.0.1;port=" + upstreamedAddr[len("127.0.0.1:"):] + ";action=partner",
+		},
+	}))
+
+	connect := func(t *testing.T, hostport string) (*http.Response, net.Conn, *bufio.Reader) {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		req, err := http.NewRequest(http.MethodConnect, "http://"+hostport, nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+
+		return resp, conn, br
+	}
+
+	ping := func(t *testing.T, conn net.Conn, br *bufio.Reader) {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(br, b)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		resp, _, _ := connect(t, "reject.evil.corp:443")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		resp, conn, br := connect(t, directAddr)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		ping(t, conn, br)
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		resp, conn, br := connect(t, upstreamedAddr)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		ping(t, conn, br)
+
+		// Upstream is authenticated with own credentials on demand
+		assert.Equal(t, connectRequest{host: upstreamedAddr}, <-upstreamRequests)
+		assert.Equal(t, connectRequest{host: upstreamedAddr, authorization: basicAuthorization("partner", "Partner123")}, <-upstreamRequests)
+	})
+
+	t.Run("downstream proxy by default", func(t *testing.T) {
+		resp, conn, br := connect(t, defaultAddr)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		ping(t, conn, br)
+
+		// Only unmatched request reached downstream proxy, authenticated on demand
+		assert.Equal(t, connectRequest{host: defaultAddr}, <-downstreamRequests)
+		assert.Equal(t, connectRequest{host: defaultAddr, authorization: basicAuthorization("test_user", "test_password")}, <-downstreamRequests)
+		assert.Empty(t, downstreamRequests)
+		assert.Empty(t, upstreamRequests)
+	})
+}
+
+func TestProxy_http_routing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Request goes straight to destination, downstream proxy credentials must not leak
+		assert.Empty(t, r.Header.Get(HeaderProxyAuthorization))
+		// nolint:errcheck
+		w.Write([]byte("direct"))
+	}))
+	defer srv.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Upstream gets absolute URI with own credentials
+		assert.Equal(t, basicAuthorization("partner", "Partner123"), r.Header.Get(HeaderProxyAuthorization))
+		assert.Equal(t, "http://upstream.evil.corp/path", r.RequestURI)
+		// nolint:errcheck
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, basicAuthorization("test_user", "test_password"), r.Header.Get(HeaderProxyAuthorization))
+		// nolint:errcheck
+		w.Write([]byte("downstream"))
+	}))
+	defer downstream.Close()
+
+	addr := newTestProxy(t, downstream.URL, withRouting(t, Routing{
+		UpstreamStrings: []string{"partner=" + upstream.URL + ";user=partner;password=Partner123"},
+		RuleStrings: []string{
+			"domain=127.0.0.1;action=DIRECT",
+			"domain=*.evil.corp;port=80;action=partner",
+		},
+	}))
+
+	proxyURL, err := url.Parse("http://" + addr)
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for target, expected := range map[string]string{
+		srv.URL + "/path":                   "direct",
+		"http://upstream.evil.corp/path":    "upstream",
+		"http://downstream.google.com/path": "downstream",
+	} {
+		resp, err := httpClient.Get(target)
+		require.NoError(t, err)
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, target)
+		assert.Equal(t, expected, string(b), target)
+	}
+}
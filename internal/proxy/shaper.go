@@ -0,0 +1,213 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const kilobyte = 1024
+
+// shaper limits bandwidth globally, per client IP and per destination domain.
+type shaper struct {
+	mu      sync.Mutex
+	config  Bandwidth
+	global  *rate.Limiter
+	clients map[string]*clientLimiter
+	domains map[string]*rate.Limiter
+}
+
+// clientLimiter is shared by all active transfers of a client.
+type clientLimiter struct {
+	*rate.Limiter
+	refs int
+}
+
+func newShaper(config Bandwidth) *shaper {
+	burst := config.burst()
+
+	domains := make(map[string]*rate.Limiter, len(config.Domains))
+	for domain, limit := range config.Domains {
+		domains[domain] = rate.NewLimiter(bandwidthLimit(limit), burst)
+	}
+
+	return &shaper{
+		config:  config,
+		global:  rate.NewLimiter(bandwidthLimit(config.Global), burst),
+		clients: make(map[string]*clientLimiter),
+		domains: domains,
+	}
+}
+
+// burst returns burst allowance in bytes.
+func (b *Bandwidth) burst() int {
+	if b.Burst < 1 {
+		return kilobyte
+	}
+
+	return b.Burst * kilobyte
+}
+
+// bandwidthLimit converts KB/s into limit, zero means unlimited.
+func bandwidthLimit(kbps int) rate.Limit {
+	if kbps <= 0 {
+		return rate.Inf
+	}
+
+	return rate.Limit(kbps * kilobyte)
+}
+
+// get returns current limits.
+func (s *shaper) get() Bandwidth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config
+}
+
+// set replaces limits, active transfers are affected as well. Limiters of removed domains are kept by active
+// transfers, so they become unlimited.
+func (s *shaper) set(config Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	burst := config.burst()
+
+	s.config = config
+	s.global.SetLimit(bandwidthLimit(config.Global))
+	s.global.SetBurst(burst)
+
+	for _, c := range s.clients {
+		c.SetLimit(bandwidthLimit(config.Client))
+		c.SetBurst(burst)
+	}
+
+	domains := make(map[string]*rate.Limiter, len(config.Domains))
+	for domain, limit := range config.Domains {
+		l, ok := s.domains[domain]
+		if !ok {
+			l = rate.NewLimiter(bandwidthLimit(limit), burst)
+		} else {
+			l.SetLimit(bandwidthLimit(limit))
+			l.SetBurst(burst)
+		}
+		domains[domain] = l
+	}
+	for domain, l := range s.domains {
+		if _, ok := domains[domain]; !ok {
+			l.SetLimit(rate.Inf)
+		}
+	}
+	s.domains = domains
+}
+
+// acquire returns limiters which apply to transfer between client and host, release should be called when it's done.
+func (s *shaper) acquire(ip, host string) (limiters []*rate.Limiter, release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[ip]
+	if !ok {
+		c = &clientLimiter{Limiter: rate.NewLimiter(bandwidthLimit(s.config.Client), s.config.burst())}
+		s.clients[ip] = c
+	}
+	c.refs++
+
+	limiters = []*rate.Limiter{s.global, c.Limiter}
+
+	// The most specific domain limit applies
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for domain := host; domain != ""; {
+		if l, ok := s.domains[domain]; ok {
+			limiters = append(limiters, l)
+			break
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	var once sync.Once
+	return limiters, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			c.refs--
+			if c.refs == 0 {
+				delete(s.clients, ip)
+			}
+		})
+	}
+}
+
+// shapedReader waits for every limiter after reading.
+type shapedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+}
+
+func newShapedReader(ctx context.Context, r io.Reader, limiters []*rate.Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+
+	return &shapedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *shapedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if err := waitN(r.ctx, l, n); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, err
+}
+
+// shapedReadCloser releases limiters on close.
+type shapedReadCloser struct {
+	io.Reader
+	closer  io.Closer
+	release func()
+}
+
+func (rc *shapedReadCloser) Close() error {
+	rc.release()
+	return rc.closer.Close()
+}
+
+// waitN waits for n bytes, by chunks if n is bigger than burst.
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if l.Limit() != rate.Inf && l.Burst() < chunk {
+			chunk = l.Burst()
+		}
+
+		if err := l.WaitN(ctx, chunk); err != nil {
+			// Burst could be shrunk by new limits meanwhile, chunk is clamped again then
+			if ctx.Err() == nil && l.Limit() != rate.Inf && chunk > l.Burst() {
+				continue
+			}
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
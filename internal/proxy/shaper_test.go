@@ -0,0 +1,98 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidth_Resolve(t *testing.T) {
+	b := Bandwidth{
+		Burst:         256,
+		DomainStrings: []string{"Artifactory.Evil.Corp.=1024", "evil.corp=0"},
+	}
+	require.NoError(t, b.Resolve())
+	assert.Equal(t, map[string]int{"artifactory.evil.corp": 1024, "evil.corp": 0}, b.Domains)
+
+	for _, invalid := range []Bandwidth{
+		{Burst: 256, DomainStrings: []string{"evil.corp"}},
+		{Burst: 256, DomainStrings: []string{"evil.corp=fast"}},
+		{Burst: 256, Global: -1},
+		{Burst: 0},
+	} {
+		assert.Error(t, invalid.Resolve())
+	}
+}
+
+func Test_shaper(t *testing.T) {
+	config := Bandwidth{
+		Client:        512,
+		Burst:         64,
+		DomainStrings: []string{"evil.corp=1024", "artifactory.evil.corp=2048"},
+	}
+	require.NoError(t, config.Resolve())
+
+	s := newShaper(config)
+
+	limiters, release := s.acquire("10.0.0.1", "repo.artifactory.evil.corp")
+	require.Len(t, limiters, 3)
+	assert.Equal(t, rate.Inf, limiters[0].Limit())
+	assert.Equal(t, rate.Limit(512*kilobyte), limiters[1].Limit())
+	assert.Equal(t, rate.Limit(2048*kilobyte), limiters[2].Limit())
+
+	// Transfers of the same client share limiter
+	other, releaseOther := s.acquire("10.0.0.1", "www.google.com")
+	require.Len(t, other, 2)
+	assert.Same(t, limiters[1], other[1])
+
+	removed, releaseRemoved := s.acquire("10.0.0.2", "www.evil.corp")
+	require.Len(t, removed, 3)
+	assert.Equal(t, rate.Limit(1024*kilobyte), removed[2].Limit())
+
+	// Active transfers get new limits
+	config.Global = 4096
+	config.Client = 256
+	config.DomainStrings = []string{"artifactory.evil.corp=128"}
+	require.NoError(t, config.Resolve())
+	s.set(config)
+
+	assert.Equal(t, rate.Limit(4096*kilobyte), limiters[0].Limit())
+	assert.Equal(t, rate.Limit(256*kilobyte), limiters[1].Limit())
+	assert.Equal(t, rate.Limit(128*kilobyte), limiters[2].Limit())
+	assert.Equal(t, config, s.get())
+	// Limit of removed domain is lifted for active transfers
+	assert.Equal(t, rate.Inf, removed[2].Limit())
+	releaseRemoved()
+
+	release()
+	release()
+	assert.Len(t, s.clients, 1)
+	releaseOther()
+	assert.Empty(t, s.clients)
+}
+
+func Test_shapedReader(t *testing.T) {
+	// 100 KB/s with 1 KB burst, 50 KB should take about half a second
+	l := rate.NewLimiter(100*kilobyte, kilobyte)
+	data := bytes.Repeat([]byte{'x'}, 50*kilobyte)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, newShapedReader(context.Background(), bytes.NewReader(data), []*rate.Limiter{l}))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	// Without limiters reader is returned as is
+	r := bytes.NewReader(data)
+	assert.Same(t, r, newShapedReader(context.Background(), r, nil))
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// IsSOCKS returns true if downstream proxy is SOCKS5 one, socks5h resolves destination host by the proxy itself.
+func (c *Config) IsSOCKS() bool {
+	return c.DownstreamProxyURL != nil && (c.DownstreamProxyURL.Scheme == "socks5" || c.DownstreamProxyURL.Scheme == "socks5h")
+}
+
+// dialerFunc lets dial function be used as forward dialer of SOCKS5 one.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// socksAuth returns SOCKS5 credentials from URL, downstream proxy credentials are used otherwise.
+func (p *Proxy) socksAuth() *proxy.Auth {
+	if u := p.config.DownstreamProxyURL.User; u != nil {
+		password, _ := u.Password()
+		return &proxy.Auth{User: u.Username(), Password: password}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config.DownstreamProxyAuth.User == "" {
+		return nil
+	}
+
+	return &proxy.Auth{
+		User:     p.config.DownstreamProxyAuth.User,
+		Password: p.config.DownstreamProxyAuth.Password,
+	}
+}
+
+// dialSOCKS connects to destination address through SOCKS5 downstream proxy.
+func (p *Proxy) dialSOCKS(ctx context.Context, network, addr string) (net.Conn, error) {
+	// Destination host is resolved locally with socks5 scheme
+	if p.config.DownstreamProxyURL.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, fmt.Errorf("cannot resolve destination host: %w", err)
+			}
+			addr = net.JoinHostPort(ips[0].IP.String(), port)
+		}
+	}
+
+	d, err := proxy.SOCKS5("tcp", p.config.DownstreamProxyAddr(), p.socksAuth(), dialerFunc(p.dialContext))
+	if err != nil {
+		return nil, err
+	}
+
+	return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
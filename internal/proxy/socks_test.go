@@ -0,0 +1,242 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveSOCKS starts SOCKS5 proxy requiring username and password, requested destinations are sent to the channel.
+func serveSOCKS(t *testing.T, user, password string) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	destinations := make(chan string, 10)
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+
+		// Greeting, username and password method only
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(br, make([]byte, header[1])); err != nil {
+			return
+		}
+		// nolint:errcheck
+		conn.Write([]byte{5, 2})
+
+		// RFC 1929 authentication
+		readString := func() string {
+			n, _ := br.ReadByte()
+			b := make([]byte, n)
+			// nolint:errcheck
+			io.ReadFull(br, b)
+			return string(b)
+		}
+		// nolint:errcheck
+		br.ReadByte()
+		if readString() != user || readString() != password {
+			// nolint:errcheck
+			conn.Write([]byte{1, 1})
+			return
+		}
+		// nolint:errcheck
+		conn.Write([]byte{1, 0})
+
+		// CONNECT request
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(br, request); err != nil {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, net.IPv4len)
+			// nolint:errcheck
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case 3:
+			host = readString()
+		case 4:
+			ip := make([]byte, net.IPv6len)
+			// nolint:errcheck
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		// nolint:errcheck
+		io.ReadFull(br, port)
+
+		addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		destinations <- addr
+
+		backend, err := net.Dial("tcp", addr)
+		if err != nil {
+			// nolint:errcheck
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer backend.Close()
+		// nolint:errcheck
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+		go func() {
+			// nolint:errcheck
+			io.Copy(backend, br)
+		}()
+		// nolint:errcheck
+		io.Copy(conn, backend)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), destinations
+}
+
+// serveEcho starts TCP server on host which echoes data back.
+func serveEcho(t *testing.T, host string) string {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				// nolint:errcheck
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestProxy_https_socks(t *testing.T) {
+	socksAddr, destinations := serveSOCKS(t, "test_user", "test_password")
+
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), "localhost")
+	require.NoError(t, err)
+	echoAddr := serveEcho(t, ips[0].IP.String())
+	_, port, err := net.SplitHostPort(echoAddr)
+	require.NoError(t, err)
+
+	for scheme, expected := range map[string]string{
+		// Destination is resolved locally
+		"socks5": echoAddr,
+		// Destination is resolved by proxy
+		"socks5h": "localhost:" + port,
+	} {
+		t.Run(scheme, func(t *testing.T) {
+			// Credentials are taken from downstream proxy auth
+			addr := newTestProxy(t, scheme+"://"+socksAddr)
+
+			conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+			req, err := http.NewRequest(http.MethodConnect, "http://localhost:"+port, nil)
+			require.NoError(t, err)
+			require.NoError(t, req.Write(conn))
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, expected, <-destinations)
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			b := make([]byte, 4)
+			_, err = io.ReadFull(br, b)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(b))
+		})
+	}
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		addr := newTestProxy(t, "socks5h://test_user:wrong_password@"+socksAddr)
+
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodConnect, "http://localhost:"+port, nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
+
+func TestProxy_http_socks(t *testing.T) {
+	socksAddr, destinations := serveSOCKS(t, "socks_user", "socks_password")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Request goes straight to destination, downstream proxy credentials must not leak
+		assert.Empty(t, r.Header.Get(HeaderProxyAuthorization))
+		assert.Equal(t, "/path", r.URL.String())
+		// nolint:errcheck
+		w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	// Credentials from URL take precedence
+	addr := newTestProxy(t, "socks5h://socks_user:socks_password@"+socksAddr)
+
+	proxyURL, err := url.Parse("http://" + addr)
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := httpClient.Get(srv.URL + "/path")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "pong", string(b))
+	assert.Equal(t, srv.Listener.Addr().String(), <-destinations)
+}
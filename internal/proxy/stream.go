@@ -0,0 +1,154 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamHeaders are headers of HTTP/1.1 response which have no meaning in HTTP/2 one.
+var streamHeaders = []string{"Connection", "Content-Length", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// streamConn is HTTP/2 stream used as hijacked connection, so tunnels are served the same way over both protocols.
+// HTTP/1.1 response written into it is sent as stream headers, the rest is sent as stream data.
+type streamConn struct {
+	rw   http.ResponseWriter
+	req  *http.Request
+	body io.ReadCloser
+
+	// head collects response head until it's complete
+	head        bytes.Buffer
+	wroteHeader bool
+
+	mu     sync.Mutex
+	closed bool
+	// wmu is held while data is written, handler must not return before writing is done
+	wmu sync.Mutex
+}
+
+// newStreamConn takes request body over, so request itself could be sent further as CONNECT one.
+func newStreamConn(rw http.ResponseWriter, req *http.Request) *streamConn {
+	c := &streamConn{rw: rw, req: req, body: req.Body}
+	req.Body, req.ContentLength = http.NoBody, 0
+
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	// Body is closed by CloseWrite or Close, tunnel is over
+	if err != nil && c.isClosed() {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if c.wroteHeader {
+		return c.writeData(b)
+	}
+
+	c.head.Write(b)
+	i := bytes.Index(c.head.Bytes(), []byte("\r\n\r\n"))
+	if i < 0 {
+		return len(b), nil
+	}
+
+	head := c.head.Bytes()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head[:i+4])), c.req)
+	if err != nil {
+		return 0, err
+	}
+	for _, h := range streamHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vv := range resp.Header {
+		c.rw.Header()[k] = vv
+	}
+	c.rw.WriteHeader(resp.StatusCode)
+	c.wroteHeader = true
+
+	// Response could be written together with its body or the first data of tunnel
+	if _, err := c.writeData(head[i+4:]); err != nil {
+		return 0, err
+	}
+	c.head.Reset()
+
+	return len(b), nil
+}
+
+// writeData sends data to client immediately, since it's the tunnel one.
+func (c *streamConn) writeData(b []byte) (int, error) {
+	n, err := c.rw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if f, ok := c.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return n, nil
+}
+
+// CloseWrite stops reading the stream, so tunnel ends once backend is done, stream itself ends with the handler.
+func (c *streamConn) CloseWrite() error {
+	return c.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+
+	return c.body.Close()
+}
+
+// wait waits for data being written, stream can't be written once handler returns.
+func (c *streamConn) wait() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+}
+
+func (c *streamConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", c.req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	return addr
+}
+
+// Deadlines of stream are set by server timeouts
+func (c *streamConn) SetDeadline(time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,191 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// ListenerTLS configures TLS proxy listener, clients reach it as https:// proxy.
+type ListenerTLS struct {
+	AddrString string       `long:"addr" env:"ADDR" description:"TLS proxy address, clients use it as https:// proxy" value-name:"localhost:3130" json:"addr"`
+	Addr       *net.TCPAddr `no-flag:"yes" json:"-"`
+
+	CertString string `long:"cert" env:"CERT" description:"Server certificate chain in PEM format, self-signed one is generated and saved along with the key if neither file exists" value-name:"/etc/escobar/proxy.pem" json:"cert"`
+	KeyString  string `long:"key" env:"KEY" description:"Server private key in PEM format or reference (file:, env:, exec:)" value-name:"/etc/escobar/proxy.key" json:"key"`
+	// Certificate is server certificate itself, it's served by static server
+	Certificate *x509.Certificate `no-flag:"yes" json:"-"`
+
+	ClientCAString string `long:"client-ca" env:"CLIENT_CA" description:"PEM bundle with CA certificates to verify client certificates, clients must present one if set" value-name:"/etc/escobar/clients-ca.pem" json:"clientCA"`
+
+	HTTP2 bool `long:"http2" env:"HTTP2" description:"Negotiate HTTP/2 on TLS listener, CONNECT streams are multiplexed over one connection" json:"http2"`
+
+	Config *tls.Config `no-flag:"yes" json:"-"`
+}
+
+// Resolve parses TLS proxy address, loads server certificate or generates and saves self-signed one and loads client
+// CA bundle. TLS listener is disabled if address is empty.
+func (t *ListenerTLS) Resolve() error {
+	t.Addr, t.Certificate, t.Config = nil, nil, nil
+	if t.AddrString == "" {
+		return nil
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", t.AddrString)
+	if err != nil {
+		return fmt.Errorf("cannot resolve TLS proxy address: %w", err)
+	}
+	t.Addr = addr
+
+	// Generated certificate is saved, so clients trusting it keep working after restart
+	if t.CertString == "" || t.KeyString == "" {
+		return fmt.Errorf("both server certificate and private key are required")
+	}
+
+	cert, err := loadOrGenerateKeyPair(t.CertString, t.KeyString, func() (tls.Certificate, error) {
+		return newSelfSignedCertificate(addr)
+	})
+	if err != nil {
+		return fmt.Errorf("server certificate: %w", err)
+	}
+	t.Certificate, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("cannot parse server certificate: %w", err)
+	}
+
+	t.Config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.ClientCAString != "" {
+		b, err := os.ReadFile(t.ClientCAString)
+		if err != nil {
+			return fmt.Errorf("cannot read client CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in client CA bundle %q", t.ClientCAString)
+		}
+		t.Config.ClientCAs = pool
+		t.Config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
+
+// newSelfSignedCertificate generates certificate valid for a year for proxy address, loopback and host names.
+// Every local address is included if proxy listens on wildcard one.
+func newSelfSignedCertificate(addr *net.TCPAddr) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Escobar proxy"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	switch {
+	case addr.IP == nil || addr.IP.IsUnspecified():
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("cannot get interface addresses: %w", err)
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	case !addr.IP.IsLoopback():
+		template.IPAddresses = append(template.IPAddresses, addr.IP)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newSerialNumber returns random 128-bit certificate serial number.
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// isAddr returns true if TLS proxy listens on addr.
+func (t *ListenerTLS) isAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && t.Addr != nil && t.Addr.IP.Equal(tcpAddr.IP) && t.Addr.Port == tcpAddr.Port
+}
+
+// ListenTLS listens on TLS proxy address, TLS itself is served by Serve.
+func (p *Proxy) ListenTLS() (net.Listener, error) {
+	return p.ListenTCP(p.config.TLS.Addr)
+}
+
+// newTLSServer returns server for TLS listener, proxy has none if listener is disabled. HTTP/2 is negotiated only
+// if it's turned on.
+func (p *Proxy) newTLSServer() *http.Server {
+	server := &http.Server{
+		Handler: p,
+		// Disable HTTP/2 unless it's configured below
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		TLSConfig:    p.config.TLS.Config.Clone(),
+		// Timeouts
+		ReadTimeout:       p.config.Timeouts.Server.ReadTimeout,
+		ReadHeaderTimeout: p.config.Timeouts.Server.ReadHeaderTimeout,
+		WriteTimeout:      p.config.Timeouts.Server.WriteTimeout,
+		IdleTimeout:       p.config.Timeouts.Server.IdleTimeout,
+		ErrorLog:          zap.NewStdLog(p.logger),
+	}
+
+	if !p.config.TLS.HTTP2 {
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		return server
+	}
+
+	// Offers h2 first, HTTP/1.1 is kept for clients without HTTP/2 support
+	if err := http2.ConfigureServer(server, &http2.Server{IdleTimeout: p.config.Timeouts.Server.IdleTimeout}); err != nil {
+		p.logger.Error("Cannot configure HTTP/2, falling back to HTTP/1.1", zap.Error(err))
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		return server
+	}
+	// Tunnels live as long as their streams, so stream read and write timeouts would break them
+	server.ReadTimeout, server.WriteTimeout = 0, 0
+
+	return server
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// withTLS serves proxy with TLS listener only and self-signed certificate unless listener has own one, the
+// certificate is added to pool.
+func withTLS(t *testing.T, listener ListenerTLS, pool *x509.CertPool) func(config *Config) {
+	return func(config *Config) {
+		listener.AddrString = "127.0.0.1:0"
+		if listener.CertString == "" {
+			dir := t.TempDir()
+			listener.CertString, listener.KeyString = filepath.Join(dir, "proxy.pem"), filepath.Join(dir, "proxy.key")
+		}
+		config.TLS = listener
+		require.NoError(t, config.TLS.Resolve())
+
+		pool.AddCert(config.TLS.Certificate)
+	}
+}
+
+// connectTLS sends CONNECT to addr through TLS proxy, returns response and connection to continue.
+func connectTLS(t *testing.T, proxyAddr, addr string, config *tls.Config) (*http.Response, net.Conn, *bufio.Reader) {
+	conn, err := tls.Dial("tcp", proxyAddr, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	req, err := http.NewRequest(http.MethodConnect, "http://"+addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+
+	return resp, conn, br
+}
+
+// connectStream opens CONNECT stream to addr through HTTP/2 proxy, body is written into returned writer.
+func connectStream(t *testing.T, tr *http2.Transport, proxyAddr, addr string) (*http.Response, io.WriteCloser) {
+	pr, pw := io.Pipe()
+	t.Cleanup(func() {
+		pw.Close()
+	})
+
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: proxyAddr},
+		Host:   addr,
+		Header: make(http.Header),
+		Body:   pr,
+	})
+
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+
+	return resp, pw
+}
+
+func TestListenerTLS_Resolve(t *testing.T) {
+	cert := issueCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(1)}, nil)
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "proxy", cert)
+
+	l := ListenerTLS{CertString: certPath, KeyString: keyPath}
+	require.NoError(t, l.Resolve())
+	assert.Nil(t, l.Addr)
+	assert.Nil(t, l.Config)
+
+	l.AddrString = "127.0.0.1:3130"
+	require.NoError(t, l.Resolve())
+	assert.Equal(t, "127.0.0.1:3130", l.Addr.String())
+	assert.Len(t, l.Config.Certificates, 1)
+	assert.Equal(t, cert.Leaf.Raw, l.Certificate.Raw)
+	assert.Equal(t, tls.NoClientCert, l.Config.ClientAuth)
+	assert.True(t, l.isAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3130}))
+	assert.False(t, l.isAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3128}))
+
+	// Clients must present certificate issued by CA from bundle
+	l.ClientCAString = certPath
+	require.NoError(t, l.Resolve())
+	assert.Equal(t, tls.RequireAndVerifyClientCert, l.Config.ClientAuth)
+	assert.NotNil(t, l.Config.ClientCAs)
+
+	// Self-signed certificate is generated and saved once, then it's loaded
+	generatedPath, generatedKeyPath := filepath.Join(dir, "generated.pem"), filepath.Join(dir, "generated.key")
+	l = ListenerTLS{AddrString: "127.0.0.1:3130", CertString: generatedPath, KeyString: generatedKeyPath}
+	require.NoError(t, l.Resolve())
+	assert.NoError(t, l.Certificate.VerifyHostname("localhost"))
+	assert.NoError(t, l.Certificate.VerifyHostname("127.0.0.1"))
+	assert.Equal(t, l.Certificate.Raw, l.Config.Certificates[0].Certificate[0])
+	generated := l.Certificate.Raw
+
+	info, err := os.Stat(generatedKeyPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	require.NoError(t, l.Resolve())
+	assert.Equal(t, generated, l.Certificate.Raw)
+
+	// Lone certificate or key is never overwritten
+	certPEM, err := os.ReadFile(generatedPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(generatedPath))
+	assert.Error(t, l.Resolve())
+	assert.NoFileExists(t, generatedPath)
+
+	require.NoError(t, os.WriteFile(generatedPath, certPEM, 0644))
+	require.NoError(t, os.Remove(generatedKeyPath))
+	assert.Error(t, l.Resolve())
+	assert.NoFileExists(t, generatedKeyPath)
+
+	wildcardDir := t.TempDir()
+	l = ListenerTLS{
+		AddrString: "0.0.0.0:3130",
+		CertString: filepath.Join(wildcardDir, "proxy.pem"),
+		KeyString:  filepath.Join(wildcardDir, "proxy.key"),
+	}
+	require.NoError(t, l.Resolve())
+	assert.NoError(t, l.Certificate.VerifyHostname("::1"))
+
+	for _, invalid := range []ListenerTLS{
+		{AddrString: "127.0.0.1:3130"},
+		{AddrString: "127.0.0.1:3130", CertString: certPath},
+		{AddrString: "127.0.0.1:3130", KeyString: keyPath},
+		{AddrString: "127.0.0.1:3130", CertString: filepath.Join(dir, "missing.pem"), KeyString: keyPath},
+		{AddrString: "127.0.0.1:3130", CertString: keyPath, KeyString: keyPath},
+		{AddrString: "127.0.0.1:3130", ClientCAString: filepath.Join(dir, "missing.pem")},
+		{AddrString: "127.0.0.1:3130", ClientCAString: keyPath},
+	} {
+		assert.Error(t, invalid.Resolve())
+	}
+}
+
+func TestProxy_https_TLS(t *testing.T) {
+	echoAddr := serveEcho(t, "127.0.0.1")
+	downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	pool := x509.NewCertPool()
+	addr := newTestProxy(t, "http://"+downstreamAddr, withTLS(t, ListenerTLS{}, pool))
+
+	resp, conn, br := connectTLS(t, addr, echoAddr, &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// HTTP/1.1 is the default
+	assert.Equal(t, "http/1.1", conn.(*tls.Conn).ConnectionState().NegotiatedProtocol)
+
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	t.Run("client certificate", func(t *testing.T) {
+		ca := issueCertificate(t, &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Evil Corp Clients CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+		caPath, _ := writeCertificate(t, t.TempDir(), "ca", ca)
+		client := issueCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "ivanovii"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+
+		// Basic credentials are not needed with verified certificate
+		pool := x509.NewCertPool()
+		addr := newTestProxy(t, "http://"+downstreamAddr, withTLS(t, ListenerTLS{ClientCAString: caPath}, pool), func(config *Config) {
+			config.ClientAuth = ClientAuth{
+				Mode:     BasicClientAuth,
+				Htpasswd: map[string][]byte{},
+			}
+		})
+
+		resp, _, _ := connectTLS(t, addr, echoAddr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{client}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Connection without certificate is refused
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err == nil {
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+			// TLS 1.3 client learns about rejected certificate on read
+			_, err = conn.Read(make([]byte, 1))
+		}
+		assert.Error(t, err)
+	})
+}
+
+func TestProxy_https_HTTP2(t *testing.T) {
+	echoAddr := serveEcho(t, "127.0.0.1")
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	pool := x509.NewCertPool()
+	addr := newTestProxy(t, "http://"+downstreamAddr, withTLS(t, ListenerTLS{HTTP2: true}, pool))
+
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer tr.CloseIdleConnections()
+
+	// Streams are multiplexed over one connection, every one is a tunnel of its own
+	resp1, w1 := connectStream(t, tr, addr, echoAddr)
+	resp2, w2 := connectStream(t, tr, addr, echoAddr)
+	for _, resp := range []*http.Response{resp1, resp2} {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+	}
+
+	_, err := w2.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = w1.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(resp1.Body, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+	_, err = io.ReadFull(resp2.Body, b)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(b))
+
+	// Downstream proxy is authenticated as usual
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, echoAddr, (<-downstreamRequests).host)
+	}
+
+	// Stream ends once destination has closed connection
+	require.NoError(t, w1.Close())
+	_, err = io.ReadAll(resp1.Body)
+	require.NoError(t, err)
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/path", r.URL.String())
+			// nolint:errcheck
+			w.Write([]byte("pong"))
+		}))
+		defer srv.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "https://"+addr+"/path", nil)
+		require.NoError(t, err)
+		// Destination is passed in :authority
+		req.Host = srv.Listener.Addr().String()
+
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "pong", string(b))
+	})
+
+	t.Run("destination unreachable", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+
+		resp, _ := connectStream(t, tr, addr, l.Addr().String())
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("blocked destination", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		addr := newTestProxy(t, "http://"+downstreamAddr, withTLS(t, ListenerTLS{HTTP2: true}, pool), func(config *Config) {
+			config.Policy.ConnectPorts = []int{443}
+		})
+		tr := &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		defer tr.CloseIdleConnections()
+
+		// Stream is refused the same way as tunnel over HTTP/1.1
+		resp, _ := connectStream(t, tr, addr, echoAddr)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+	})
+}
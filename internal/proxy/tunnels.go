@@ -0,0 +1,87 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// tunnels tracks hijacked connections, http.Server doesn't do it, so they could be drained on shutdown.
+type tunnels struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]net.Conn
+	shutdown bool
+}
+
+func newTunnels() *tunnels {
+	return &tunnels{
+		conns: make(map[net.Conn]net.Conn),
+	}
+}
+
+// add tracks client connection, returns false if proxy is shutting down.
+func (t *tunnels) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shutdown {
+		return false
+	}
+
+	t.conns[conn] = nil
+	return true
+}
+
+// setBackend tracks downstream proxy connection of tunnel.
+func (t *tunnels) setBackend(conn, backend net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.conns[conn]; ok {
+		t.conns[conn] = backend
+	}
+}
+
+func (t *tunnels) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, conn)
+}
+
+// stop forbids new tunnels.
+func (t *tunnels) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.shutdown = true
+}
+
+func (t *tunnels) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// closeAll force-closes remaining tunnels and returns their count.
+func (t *tunnels) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(t.conns)
+	for conn, backend := range t.conns {
+		// nolint:errcheck
+		conn.Close()
+		if backend != nil {
+			// nolint:errcheck
+			backend.Close()
+		}
+		delete(t.conns, conn)
+	}
+
+	return n
+}
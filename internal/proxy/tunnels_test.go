@@ -0,0 +1,145 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// serveDownstream starts downstream proxy which establishes tunnels and echoes traffic back.
+func serveDownstream(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go acceptDownstream(l)
+
+	u, err := url.Parse("http://" + l.Addr().String())
+	require.NoError(t, err)
+
+	return u
+}
+
+// acceptDownstream establishes every CONNECT tunnel and echoes data back.
+func acceptDownstream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			// nolint:errcheck
+			newResponse(http.StatusOK, nil, req).Write(conn)
+			// nolint:errcheck
+			io.Copy(conn, br)
+		}()
+	}
+}
+
+func Test_tunnels(t *testing.T) {
+	tr := newTunnels()
+
+	client, server := net.Pipe()
+	backend, backendServer := net.Pipe()
+	defer server.Close()
+	defer backendServer.Close()
+
+	require.True(t, tr.add(client))
+	tr.setBackend(client, backend)
+	assert.Equal(t, 1, tr.count())
+
+	// No new tunnels after shutdown started
+	tr.stop()
+	other, _ := net.Pipe()
+	assert.False(t, tr.add(other))
+
+	assert.Equal(t, 1, tr.closeAll())
+	assert.Zero(t, tr.count())
+
+	_, err := client.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	_, err = backend.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestProxy_Shutdown_drain(t *testing.T) {
+	p := NewProxy(zap.NewNop(), &Config{
+		DownstreamProxyURL: serveDownstream(t),
+		Policy:             Policy{ConnectPorts: []int{0}},
+		Timeouts: Timeouts{
+			Server:          ServerTimeouts{DrainTimeout: 500 * time.Millisecond},
+			DownstreamProxy: DownstreamProxyTimeouts{DialTimeout: 10 * time.Second},
+		},
+	}, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 10*time.Second)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodConnect, "http://www.google.com:443", nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		return conn, br
+	}
+
+	finishing, _ := connect()
+	stuck, stuckReader := connect()
+	defer stuck.Close()
+
+	require.Eventually(t, func() bool {
+		return p.tunnels.count() == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// One tunnel finishes during grace period
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finishing.Close()
+	}()
+
+	start := time.Now()
+	require.NoError(t, p.Shutdown(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	assert.Zero(t, p.tunnels.count())
+
+	// The other one is force-closed
+	require.NoError(t, stuck.SetReadDeadline(time.Now().Add(10*time.Second)))
+	_, err = stuckReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
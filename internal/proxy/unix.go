@@ -0,0 +1,73 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// ListenUnix listens on unix socket with configured file mode and owner.
+func (p *Proxy) ListenUnix() (net.Listener, error) {
+	path := p.config.Unix.Path
+	p.logger.Info("Listening socket", zap.String("address", path))
+
+	if err := removeStaleSocket(path); err != nil {
+		p.logger.Error("Error while listening!", zap.Error(err))
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		p.logger.Error("Error while listening!", zap.Error(err))
+		return nil, err
+	}
+
+	if err := os.Chmod(path, p.config.Unix.Mode); err != nil {
+		//noinspection ALL
+		l.Close()
+		return nil, fmt.Errorf("cannot set unix socket mode: %w", err)
+	}
+	if p.config.Unix.Owner != "" {
+		if err := chownSocket(path, p.config.Unix.Owner); err != nil {
+			//noinspection ALL
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes socket file left by previous run, it fails if socket is still in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get unix socket stats: %w", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and it's not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		//noinspection ALL
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("cannot remove stale unix socket: %w", err)
+	}
+
+	return nil
+}
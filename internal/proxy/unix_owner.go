@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// chownSocket changes owner of socket file, owner is user name or id with optional group after colon.
+func chownSocket(path, owner string) error {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid := -1
+	if userName != "" {
+		var err error
+		uid, err = strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return fmt.Errorf("cannot find unix socket owner: %w", err)
+			}
+			// nolint:errcheck
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	gid := -1
+	if groupName != "" {
+		var err error
+		gid, err = strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return fmt.Errorf("cannot find unix socket group: %w", err)
+			}
+			// nolint:errcheck
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("cannot change unix socket owner: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import "errors"
+
+// chownSocket is not supported, Windows has different right management model.
+func chownSocket(_, _ string) error {
+	return errors.New("unix socket owner is not supported on Windows")
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUnixSocket_Resolve(t *testing.T) {
+	u := UnixSocket{ModeString: "0660"}
+	require.NoError(t, u.Resolve())
+	assert.Equal(t, os.FileMode(0660), u.Mode)
+
+	for _, invalid := range []string{"rw-rw----", "0999", "01777"} {
+		u := UnixSocket{ModeString: invalid}
+		assert.Error(t, u.Resolve(), invalid)
+	}
+}
+
+func TestProxy_ListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// Stale socket left by previous run
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	p := NewProxy(zap.NewNop(), &Config{
+		Unix: UnixSocket{
+			Path:  path,
+			Mode:  0600,
+			Owner: strconv.Itoa(os.Getuid()),
+		},
+	}, nil)
+
+	l, err := p.ListenUnix()
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Socket is in use now
+	_, err = p.ListenUnix()
+	assert.Error(t, err)
+
+	go func() {
+		// nolint:errcheck
+		p.Serve(l)
+	}()
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.DialTimeout("unix", path, 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "https://www.google.com/", nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func Test_removeStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, removeStaleSocket(filepath.Join(dir, "missing.sock")))
+
+	path := filepath.Join(dir, "file.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	assert.Error(t, removeStaleSocket(path))
+}
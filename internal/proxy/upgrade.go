@@ -0,0 +1,252 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgrade returns true if plain HTTP request asks to switch protocol, e.g. to WebSocket or h2c.
+func isUpgrade(req *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade") && req.Header.Get("Upgrade") != ""
+}
+
+// upgrade sends plain HTTP request switching protocol to the next hop and copies traffic between connections once
+// protocol is switched. Proxies are authenticated the same way as with CONNECT.
+func (p *Proxy) upgrade(rw http.ResponseWriter, req *http.Request) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	conn, brw, release, ok := p.hijackTunnel(rw, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	pconn, pbr, resp, err := p.roundTripUpgrade(upgradeRequest(req), false)
+	if err != nil {
+		if errors.Is(err, errDialsLimit) {
+			logger.Warn("Downstream proxy dials limit reached")
+			writeHijackedResponse(brw, req, http.StatusServiceUnavailable)
+			return
+		}
+		if code, ok := hopErrorCode(err); ok {
+			logger.Warn("Proxy refused to switch protocols", zap.Error(err))
+			writeHijackedResponse(brw, req, code)
+			return
+		}
+
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot switch protocols: %w", err))
+		return
+	}
+	defer func() {
+		if err := pconn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Cannot close connection", zap.Error(err))
+		}
+	}()
+	p.tunnels.setBackend(conn, pconn)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		logger.Warn("Protocol is NOT switched", zap.Int("resp_code", resp.StatusCode))
+		// nolint:errcheck
+		defer resp.Body.Close()
+
+		// Return this response to client, connection can't be reused since request has been hijacked
+		resp.Close = true
+		if err := resp.Write(brw); err != nil {
+			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write response into client connection: %w", err))
+			return
+		}
+		if err := brw.Flush(); err != nil {
+			httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot flush writer to commit response into client connection: %w", err))
+		}
+		return
+	}
+
+	// Set body to nil, otherwise we will get deadlock
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write response into client connection: %w", err))
+		return
+	}
+
+	// Both sides could have sent data of the new protocol already, it's buffered by readers
+	if err := copyBuffered(brw.Writer, pbr); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write buffered data into client connection: %w", err))
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot flush writer to commit response into client connection: %w", err))
+		return
+	}
+	if err := copyBuffered(pconn, brw.Reader); err != nil {
+		httpsErrorHijackedHandler(brw, req, fmt.Errorf("cannot write buffered data into backend connection: %w", err))
+		return
+	}
+
+	if err := p.setDownstreamDeadlines(pconn); err != nil {
+		httpsErrorHijackedHandler(brw, req, err)
+		return
+	}
+
+	p.copyTunnel(conn, pconn, brw, req)
+}
+
+// upgradeRequest returns request to send to the next hop. Connection and Upgrade headers are kept, so are headers
+// listed in Connection, e.g. HTTP2-Settings of h2c, since they are meant for destination.
+func upgradeRequest(req *http.Request) *http.Request {
+	outreq := req.Clone(req.Context())
+	outreq.RequestURI = ""
+	for _, h := range []string{"Keep-Alive", "Proxy-Connection", HeaderProxyAuthorization, "Te", "Trailer"} {
+		outreq.Header.Del(h)
+	}
+
+	return outreq
+}
+
+// upgradeHop returns proxy which upgrade request is sent to in absolute form, nil hop means downstream proxy.
+// Request is sent straight to destination if proxied is false.
+func (p *Proxy) upgradeHop(req *http.Request) (hop *Hop, proxied bool) {
+	rule, routed := req.Context().Value(routeCtx).(*Rule)
+	switch {
+	case routed && rule.Upstream != nil:
+		return rule.Upstream, true
+	case routed, p.config.IsSOCKS(), len(p.config.Chain) != 0:
+		// SOCKS5 proxy and proxy chain authenticate on connection
+		return nil, false
+	default:
+		return nil, true
+	}
+}
+
+// dialUpgrade connects to the next hop of upgrade request, returned context carries channel bindings of https
+// downstream proxy.
+func (p *Proxy) dialUpgrade(req *http.Request) (net.Conn, context.Context, error) {
+	ctx := req.Context()
+	addr := requestHostPort(req)
+
+	rule, routed := ctx.Value(routeCtx).(*Rule)
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case routed && rule.Upstream != nil:
+		conn, err = p.dialContext(ctx, "tcp", rule.Upstream.Addr())
+	case routed:
+		conn, err = p.dialContext(ctx, "tcp", addr)
+	case p.config.IsSOCKS():
+		conn, err = p.dialSOCKS(ctx, "tcp", addr)
+	case len(p.config.Chain) != 0:
+		conn, err = p.dialChain(ctx, "tcp", addr)
+	default:
+		return p.dialDownstream(ctx)
+	}
+
+	return conn, ctx, err
+}
+
+// roundTripUpgrade sends upgrade request to the next hop and reads its response. Proxy is authenticated if it
+// responds with 407, connection is established again only once if proxy drops it after that.
+func (p *Proxy) roundTripUpgrade(req *http.Request, reconnected bool) (net.Conn, *bufio.Reader, *http.Response, error) {
+	logger := req.Context().Value(LogEntryCtx).(*zap.Logger)
+
+	var (
+		pconn net.Conn
+		ctx   context.Context
+	)
+	err := p.dialRetrying(logger, func() (err error) {
+		pconn, ctx, err = p.dialUpgrade(req)
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req = req.WithContext(ctx)
+
+	hop, proxied := p.upgradeHop(req)
+	host := p.config.DownstreamProxyURL.Host
+	if hop != nil {
+		host = hop.URL.Host
+	}
+
+	if reconnected && proxied {
+		// Token could be bound to TLS session of the dropped connection, so it's generated again
+		if err := p.setHopAuthorizationHeader(req, hop); err != nil {
+			pconn.Close()
+			return nil, nil, nil, fmt.Errorf("cannot set authorization header: %w", err)
+		}
+	}
+
+	pbr := bufio.NewReader(pconn)
+	roundTrip := func() (*http.Response, error) {
+		write := req.Write
+		if proxied {
+			write = req.WriteProxy
+		}
+		if err := write(pconn); err != nil {
+			return nil, fmt.Errorf("cannot write request into backend connection: %w", err)
+		}
+
+		resp, err := http.ReadResponse(pbr, req)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read response from backend connection: %w", err)
+		}
+
+		return resp, nil
+	}
+
+	resp, err := roundTrip()
+	if err == nil && proxied && resp.StatusCode == http.StatusProxyAuthRequired && !reconnected {
+		// Close the body, no need to read it, there is only HTML template with Proxy warning
+		resp.Body.Close()
+
+		if err := p.setHopAuthorizationHeader(req, hop); err != nil {
+			pconn.Close()
+			return nil, nil, nil, fmt.Errorf("cannot set authorization header: %w", err)
+		}
+
+		resp, err = roundTrip()
+		if err != nil {
+			// Some proxies drop connection after responding 407
+			var target *net.OpError
+			if errors.As(err, &target) || errors.Is(err, io.ErrUnexpectedEOF) {
+				pconn.Close()
+				// Reconnection could be tried only once to prevent infinity loop
+				return p.roundTripUpgrade(req, true)
+			}
+		}
+	}
+	if err != nil {
+		pconn.Close()
+		return nil, nil, nil, err
+	}
+
+	if proxied && resp.StatusCode == http.StatusProxyAuthRequired {
+		resp.Body.Close()
+		pconn.Close()
+		return nil, nil, nil, &hopError{host: host, code: resp.StatusCode}
+	}
+
+	return pconn, pbr, resp, nil
+}
+
+// copyBuffered moves data buffered by reader into w.
+func copyBuffered(w io.Writer, r *bufio.Reader) error {
+	if r.Buffered() == 0 {
+		return nil
+	}
+
+	_, err := io.CopyN(w, r, int64(r.Buffered()))
+	return err
+}
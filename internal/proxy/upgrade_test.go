@@ -0,0 +1,158 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveUpgrade starts server which switches to echo protocol on upgrade request.
+func serveUpgrade(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade to echo is required", http.StatusBadRequest)
+			return
+		}
+		// Request goes to destination without credentials
+		assert.Empty(t, r.Header.Get(HeaderProxyAuthorization))
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// nolint:errcheck
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		// nolint:errcheck
+		brw.Flush()
+		// nolint:errcheck
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// upgradeThrough sends upgrade request to proxy and returns response with connection to continue.
+func upgradeThrough(t *testing.T, addr, rawURL, protocol string) (*http.Response, net.Conn, *bufio.Reader) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	require.NoError(t, req.WriteProxy(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+
+	return resp, conn, br
+}
+
+func assertEcho(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestIsUpgrade(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	assert.False(t, isUpgrade(req))
+
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.False(t, isUpgrade(req))
+
+	req.Header.Set("Upgrade", "websocket")
+	assert.True(t, isUpgrade(req))
+}
+
+func TestProxy_http_upgrade(t *testing.T) {
+	srv := serveUpgrade(t)
+	downstreamAddr, downstreamRequests := serveConnect(t, basicAuthorization("test_user", "test_password"))
+
+	addr := newTestProxy(t, "http://"+downstreamAddr)
+
+	resp, conn, br := upgradeThrough(t, addr, srv.URL+"/ws", "echo")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+
+	// Downstream proxy is authenticated on demand as with CONNECT
+	assert.Equal(t, connectRequest{host: srv.Listener.Addr().String()}, <-downstreamRequests)
+	assert.Equal(t, connectRequest{
+		host:          srv.Listener.Addr().String(),
+		authorization: basicAuthorization("test_user", "test_password"),
+	}, <-downstreamRequests)
+
+	assertEcho(t, conn, br)
+
+	t.Run("not switched", func(t *testing.T) {
+		resp, _, br := upgradeThrough(t, addr, srv.URL+"/ws", "websocket")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		b, err := io.ReadAll(br)
+		require.NoError(t, err)
+		assert.Equal(t, "upgrade to echo is required\n", string(b))
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		downstreamAddr, _ := serveConnect(t, basicAuthorization("test_user", "wrong"))
+		addr := newTestProxy(t, "http://"+downstreamAddr)
+
+		resp, _, _ := upgradeThrough(t, addr, srv.URL+"/ws", "echo")
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
+
+func TestProxy_http_upgrade_routing(t *testing.T) {
+	srv := serveUpgrade(t)
+	upstreamAddr, upstreamRequests := serveConnect(t, basicAuthorization("partner", "Partner123"))
+
+	addr := newTestProxy(t, "http://127.0.0.1:1", withRouting(t, Routing{
+		UpstreamStrings: []string{"partner=http://" + upstreamAddr + ";user=partner;password=Partner123"},
+		RuleStrings: []string{
+			"domain=localhost;action=partner",
+			"action=DIRECT",
+		},
+	}))
+
+	// Request goes straight to destination
+	resp, conn, br := upgradeThrough(t, addr, srv.URL+"/ws", "echo")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assertEcho(t, conn, br)
+
+	// Request goes through named upstream with own credentials
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	resp, conn, br = upgradeThrough(t, addr, "http://localhost:"+port+"/ws", "echo")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assertEcho(t, conn, br)
+
+	assert.Equal(t, connectRequest{host: "localhost:" + port}, <-upstreamRequests)
+	assert.Equal(t, connectRequest{
+		host:          "localhost:" + port,
+		authorization: basicAuthorization("partner", "Partner123"),
+	}, <-upstreamRequests)
+}
@@ -6,6 +6,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	"syscall"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 // newResponse builds new HTTP responses.
@@ -54,13 +56,20 @@ func newResponse(code int, body io.Reader, req *http.Request) *http.Response {
 type connectCopier struct {
 	logger          *zap.Logger
 	client, backend io.ReadWriter
+	// limiters shape traffic in both directions
+	limiters []*rate.Limiter
 }
 
 func (c connectCopier) copyFromBackend(errc chan<- error) {
-	_, err := io.Copy(c.client, c.backend)
+	_, err := io.Copy(c.client, newShapedReader(context.Background(), c.backend, c.limiters))
 
-	if _, ok := c.client.(*net.TCPConn); ok {
-		if err := c.client.(*net.TCPConn).CloseWrite(); err != nil {
+	// HTTP/2 stream can't be half-closed, tunnel ends with it
+	if sconn, ok := c.client.(*streamConn); ok {
+		// nolint:errcheck
+		sconn.CloseWrite()
+	}
+	if tconn, ok := tcpConn(c.client); ok {
+		if err := tconn.CloseWrite(); err != nil {
 			if err, ok := err.(*net.OpError).Err.(*os.SyscallError); ok {
 				if err.Err != syscall.ENOTCONN {
 					c.logger.Error("cannot close write", zap.Error(err))
@@ -70,8 +79,8 @@ func (c connectCopier) copyFromBackend(errc chan<- error) {
 			}
 		}
 	}
-	if _, ok := c.backend.(*net.TCPConn); ok {
-		if err := c.backend.(*net.TCPConn).CloseRead(); err != nil {
+	if tconn, ok := tcpConn(c.backend); ok {
+		if err := tconn.CloseRead(); err != nil {
 			if err, ok := err.(*net.OpError).Err.(*os.SyscallError); ok {
 				if err.Err != syscall.ENOTCONN {
 					c.logger.Error("cannot close read", zap.Error(err))
@@ -86,10 +95,10 @@ func (c connectCopier) copyFromBackend(errc chan<- error) {
 }
 
 func (c connectCopier) copyToBackend(errc chan<- error) {
-	_, err := io.Copy(c.backend, c.client)
+	_, err := io.Copy(c.backend, newShapedReader(context.Background(), c.client, c.limiters))
 
-	if _, ok := c.client.(*net.TCPConn); ok {
-		if err := c.client.(*net.TCPConn).CloseRead(); err != nil {
+	if tconn, ok := tcpConn(c.client); ok {
+		if err := tconn.CloseRead(); err != nil {
 			if err, ok := err.(*net.OpError).Err.(*os.SyscallError); ok {
 				if err.Err != syscall.ENOTCONN {
 					c.logger.Error("cannot close read", zap.Error(err))
@@ -99,8 +108,8 @@ func (c connectCopier) copyToBackend(errc chan<- error) {
 			}
 		}
 	}
-	if _, ok := c.backend.(*net.TCPConn); ok {
-		if err := c.backend.(*net.TCPConn).CloseWrite(); err != nil {
+	if tconn, ok := tcpConn(c.backend); ok {
+		if err := tconn.CloseWrite(); err != nil {
 			if err, ok := err.(*net.OpError).Err.(*os.SyscallError); ok {
 				if err.Err != syscall.ENOTCONN {
 					c.logger.Error("cannot close write", zap.Error(err))
@@ -0,0 +1,87 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	FilePrefix = "file:"
+	EnvPrefix  = "env:"
+	ExecPrefix = "exec:"
+)
+
+// ExecTimeout limits the time a secret command is allowed to run.
+var ExecTimeout = 30 * time.Second
+
+// IsReference reports whether value is a secret reference rather than a literal secret.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, FilePrefix) ||
+		strings.HasPrefix(value, EnvPrefix) ||
+		strings.HasPrefix(value, ExecPrefix)
+}
+
+// Resolve returns a secret referenced by value:
+//   - file:/run/secrets/pw returns the file contents;
+//   - env:VAR returns the environment variable value;
+//   - exec:/usr/bin/pass show corp returns the command standard output.
+//
+// Any other value is returned as is.
+func Resolve(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, FilePrefix):
+		b, err := os.ReadFile(strings.TrimPrefix(value, FilePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read secret file: %w", err)
+		}
+
+		return b, nil
+	case strings.HasPrefix(value, EnvPrefix):
+		name := strings.TrimPrefix(value, EnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return []byte(v), nil
+	case strings.HasPrefix(value, ExecPrefix):
+		args := strings.Fields(strings.TrimPrefix(value, ExecPrefix))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty secret command")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ExecTimeout)
+		defer cancel()
+
+		// nolint:gosec
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("cannot execute secret command: %w", err)
+		}
+
+		return b, nil
+	}
+
+	return []byte(value), nil
+}
+
+// ResolveString works like Resolve, but also trims a trailing newline
+// usually left by files and commands.
+func ResolveString(value string) (string, error) {
+	b, err := Resolve(value)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveString(t *testing.T) {
+	t.Run("literal", func(t *testing.T) {
+		actual, err := ResolveString("Qwerty123")
+		require.NoError(t, err)
+		assert.Equal(t, "Qwerty123", actual)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pw")
+		require.NoError(t, os.WriteFile(path, []byte("Qwerty123\n"), 0600))
+
+		actual, err := ResolveString("file:" + path)
+		require.NoError(t, err)
+		assert.Equal(t, "Qwerty123", actual)
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("ESCOBAR_TEST_PASSWORD", "Qwerty123")
+
+		actual, err := ResolveString("env:ESCOBAR_TEST_PASSWORD")
+		require.NoError(t, err)
+		assert.Equal(t, "Qwerty123", actual)
+
+		_, err = ResolveString("env:ESCOBAR_TEST_MISSING")
+		assert.Error(t, err)
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		actual, err := ResolveString("exec:echo Qwerty123")
+		require.NoError(t, err)
+		assert.Equal(t, "Qwerty123", actual)
+
+		_, err = ResolveString("exec:")
+		assert.Error(t, err)
+	})
+}
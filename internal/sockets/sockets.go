@@ -0,0 +1,20 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"errors"
+)
+
+const (
+	// EnvListeners holds comma-separated names of listeners passed by previous process,
+	// their file descriptors start from 3 in the same order.
+	EnvListeners = "ESCOBAR_LISTENERS"
+	// EnvReadyFD holds file descriptor to notify previous process that listeners are served.
+	EnvReadyFD = "ESCOBAR_READY_FD"
+)
+
+// ErrUnsupported is returned if listeners cannot be passed to new process on this platform.
+var ErrUnsupported = errors.New("listeners handoff is not supported on this platform")
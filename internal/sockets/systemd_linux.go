@@ -0,0 +1,152 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Activated returns listeners passed by systemd socket activation (LISTEN_FDS). Sockets are matched by
+// FileDescriptorName= first, remaining ones are matched in order of names.
+func Activated(names ...string) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return listeners, nil
+	}
+
+	var fdNames []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		fdNames = strings.Split(s, ":")
+	}
+
+	// Sockets are passed once, they shouldn't be interpreted by child processes
+	// nolint:errcheck
+	os.Unsetenv("LISTEN_PID")
+	// nolint:errcheck
+	os.Unsetenv("LISTEN_FDS")
+	// nolint:errcheck
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := strconv.Itoa(fd)
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				//noinspection ALL
+				f.Close()
+			}
+		}
+	}()
+
+	assigned := make(map[string]*os.File, len(names))
+	for _, name := range names {
+		for i, f := range files {
+			if f != nil && f.Name() == name {
+				assigned[name] = f
+				files[i] = nil
+				break
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := assigned[name]; ok {
+			continue
+		}
+
+		for i, f := range files {
+			if f != nil {
+				assigned[name] = f
+				files[i] = nil
+				break
+			}
+		}
+	}
+
+	for name, f := range assigned {
+		l, err := net.FileListener(f)
+		//noinspection ALL
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot use socket activated %s listener: %w", name, err)
+		}
+
+		listeners[name] = l
+	}
+
+	return listeners, nil
+}
+
+// Notify sends state to service manager (sd_notify), it does nothing if NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract namespace socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("cannot connect to notify socket: %w", err)
+	}
+	//noinspection ALL
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("cannot notify service manager: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns how often service manager expects WATCHDOG=1, zero if watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	usecString := os.Getenv("WATCHDOG_USEC")
+	if usecString == "" {
+		return 0, nil
+	}
+
+	if pidString := os.Getenv("WATCHDOG_PID"); pidString != "" {
+		pid, err := strconv.Atoi(pidString)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID: %w", err)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	usec, err := strconv.ParseInt(usecString, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usecString)
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestActivationHelperProcess is started like systemd does, it serves activated listeners once.
+func TestActivationHelperProcess(t *testing.T) {
+	if os.Getenv("ESCOBAR_HELPER_PROCESS") != "activation" {
+		t.Skip("helper process")
+	}
+
+	// systemd sets it to pid of started process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	listeners, err := Activated("proxy", "static")
+	if err != nil || len(listeners) != 2 {
+		os.Exit(1)
+	}
+
+	for _, name := range []string{"proxy", "static"} {
+		conn, err := listeners[name].Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		// nolint:errcheck
+		conn.Write([]byte(name))
+		conn.Close()
+	}
+	os.Exit(0)
+}
+
+func TestActivated(t *testing.T) {
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer proxy.Close()
+	static, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer static.Close()
+
+	proxyFile, err := proxy.(*net.TCPListener).File()
+	require.NoError(t, err)
+	staticFile, err := static.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	// Static socket goes first, but it's named
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		"ESCOBAR_HELPER_PROCESS=activation",
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=static:escobar.socket",
+	)
+	cmd.ExtraFiles = []*os.File{staticFile, proxyFile}
+	require.NoError(t, cmd.Start())
+	proxyFile.Close()
+	staticFile.Close()
+
+	// Close own listeners, sockets are served by helper process
+	proxy.Close()
+	static.Close()
+
+	for name, addr := range map[string]string{"proxy": proxy.Addr().String(), "static": static.Addr().String()} {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		require.NoError(t, err)
+
+		b, err := io.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		assert.Equal(t, name, string(b))
+	}
+
+	require.NoError(t, cmd.Wait())
+}
+
+func TestActivated_otherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := Activated("proxy")
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, Notify("READY=1\nSTATUS=Serving"))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1\nSTATUS=Serving", string(buf[:n]))
+
+	// Nothing to notify without service manager
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, Notify("READY=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	interval, err := WatchdogInterval()
+	require.NoError(t, err)
+	assert.Zero(t, interval)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, interval)
+
+	// Watchdog is meant for another process
+	t.Setenv("WATCHDOG_PID", "1")
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	assert.Zero(t, interval)
+
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "often")
+	_, err = WatchdogInterval()
+	assert.Error(t, err)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"net"
+	"time"
+)
+
+// Activated returns no listeners, there is no socket activation on this platform.
+func Activated(...string) (map[string]net.Listener, error) {
+	return make(map[string]net.Listener), nil
+}
+
+// Notify does nothing on this platform.
+func Notify(string) error {
+	return nil
+}
+
+// WatchdogInterval returns zero, there is no service manager watchdog on this platform.
+func WatchdogInterval() (time.Duration, error) {
+	return 0, nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Inherited returns listener with name passed by previous process, nil if there is no such listener.
+func Inherited(name string) (net.Listener, error) {
+	names := os.Getenv(EnvListeners)
+	if names == "" {
+		return nil, nil
+	}
+
+	for i, n := range strings.Split(names, ",") {
+		if n != name {
+			continue
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		if f == nil {
+			return nil, fmt.Errorf("invalid inherited file descriptor of %s listener", name)
+		}
+		//noinspection ALL
+		defer f.Close()
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot use inherited %s listener: %w", name, err)
+		}
+
+		return l, nil
+	}
+
+	return nil, nil
+}
+
+// Spawn starts new process with listeners passed as inherited file descriptors and waits until it's ready.
+// If new process doesn't become ready in time, it's killed.
+func Spawn(path string, args []string, listeners map[string]net.Listener, timeout time.Duration) (*os.Process, error) {
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names)+1)
+	defer func() {
+		for _, f := range files {
+			//noinspection ALL
+			f.Close()
+		}
+	}()
+
+	for _, name := range names {
+		l, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("%s listener cannot be passed to new process", name)
+		}
+
+		f, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get file of %s listener: %w", name, err)
+		}
+		files = append(files, f)
+	}
+
+	// New process closes its end of pipe after it starts serving
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create pipe: %w", err)
+	}
+	//noinspection ALL
+	defer r.Close()
+	files = append(files, w)
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		// Watchdog of service manager is meant for new process after it becomes main one
+		if strings.HasPrefix(kv, EnvListeners+"=") || strings.HasPrefix(kv, EnvReadyFD+"=") ||
+			strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		EnvListeners+"="+strings.Join(names, ","),
+		EnvReadyFD+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+
+	// nolint:gosec
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start new process: %w", err)
+	}
+
+	// Only new process should hold write end, otherwise we never get EOF
+	//noinspection ALL
+	w.Close()
+	files = files[:len(files)-1]
+
+	if err := r.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		// nolint:errcheck
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("cannot set pipe deadline: %w", err)
+	}
+
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil {
+		// nolint:errcheck
+		cmd.Process.Kill()
+		// nolint:errcheck
+		cmd.Wait()
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process is not ready in %s", timeout)
+		}
+		return nil, fmt.Errorf("new process exited before it was ready: %w", err)
+	}
+
+	return cmd.Process, nil
+}
+
+// Ready notifies previous process that inherited listeners are served.
+func Ready() error {
+	fdString := os.Getenv(EnvReadyFD)
+	if fdString == "" {
+		return nil
+	}
+
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", EnvReadyFD, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	if f == nil {
+		return fmt.Errorf("invalid %s", EnvReadyFD)
+	}
+	//noinspection ALL
+	defer f.Close()
+
+	if _, err := f.Write([]byte{1}); err != nil {
+		return fmt.Errorf("cannot notify previous process: %w", err)
+	}
+
+	// Don't pass these to processes spawned later
+	// nolint:errcheck
+	os.Unsetenv(EnvListeners)
+	// nolint:errcheck
+	os.Unsetenv(EnvReadyFD)
+
+	return nil
+}
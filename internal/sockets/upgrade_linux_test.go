@@ -0,0 +1,82 @@
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpgradeHelperProcess is new process started by Spawn, it serves inherited listener once.
+func TestUpgradeHelperProcess(t *testing.T) {
+	if os.Getenv("ESCOBAR_HELPER_PROCESS") != "upgrade" {
+		t.Skip("helper process")
+	}
+
+	l, err := Inherited("proxy")
+	if err != nil || l == nil {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(2)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	// nolint:errcheck
+	conn.Write([]byte("new"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestSpawn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Setenv("ESCOBAR_HELPER_PROCESS", "upgrade")
+	process, err := Spawn(os.Args[0], []string{"-test.run=^TestUpgradeHelperProcess$"}, map[string]net.Listener{"proxy": l}, 10*time.Second)
+	require.NoError(t, err)
+
+	// Old process stops listening, new one still accepts on the same address
+	require.NoError(t, l.Close())
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 10*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(b))
+
+	state, err := process.Wait()
+	require.NoError(t, err)
+	assert.True(t, state.Success())
+}
+
+func TestSpawn_notReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Process exits without notifying
+	_, err = Spawn("/bin/true", nil, map[string]net.Listener{"proxy": l}, 10*time.Second)
+	assert.Error(t, err)
+}
+
+func TestInherited_none(t *testing.T) {
+	t.Setenv(EnvListeners, "")
+
+	l, err := Inherited("proxy")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (c) 2026 Savely Krasovsky. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sockets
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// Inherited returns nil, listeners are never inherited on this platform.
+func Inherited(string) (net.Listener, error) {
+	return nil, nil
+}
+
+// Spawn is not supported on this platform.
+func Spawn(string, []string, map[string]net.Listener, time.Duration) (*os.Process, error) {
+	return nil, ErrUnsupported
+}
+
+// Ready does nothing on this platform.
+func Ready() error {
+	return nil
+}
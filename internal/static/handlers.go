@@ -8,13 +8,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"encoding/pem"
+	"expvar"
 	"fmt"
+	"net"
 	"net/http"
-	"net/url"
 	"time"
 
+	"github.com/L11R/escobar/internal/proxy"
 	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
 )
 
 const pacFile = `function FindProxyForURL(url, host) {
@@ -23,7 +27,7 @@ const pacFile = `function FindProxyForURL(url, host) {
     else if (isInNet(host, "172.16.0.0", "255.240.0.0")) return "DIRECT";
     else if (isInNet(host, "192.168.0.0", "255.255.0.0")) return "DIRECT";
 
-    return "PROXY %s; DIRECT";
+    return "%s %s; DIRECT";
 }`
 
 func (s *Static) newRouter() http.Handler {
@@ -31,18 +35,63 @@ func (s *Static) newRouter() http.Handler {
 
 	r.Get("/proxy.pac", s.pac)
 	r.Get("/ca.crt", s.ca)
+	r.Get("/proxy.crt", s.proxyCertificate)
+	r.Get("/mitm.crt", s.mitmCertificate)
+
+	r.Group(func(r chi.Router) {
+		r.Use(loopbackOnly)
+		r.Get("/debug/vars", debugVars)
+		r.Get("/bandwidth", s.getBandwidth)
+		r.Put("/bandwidth", s.setBandwidth)
+	})
 
 	return r
 }
 
-func (s *Static) pac(w http.ResponseWriter, _ *http.Request) {
+// metrics are expvar maps served by static server, default ones are skipped since cmdline could carry secrets
+var metrics = []string{"limits", "cache"}
+
+// debugVars serves escobar metrics in expvar format.
+func debugVars(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var b bytes.Buffer
+	b.WriteString("{\n")
+	for _, name := range metrics {
+		v := expvar.Get(name)
+		if v == nil {
+			continue
+		}
+		if b.Len() > 2 {
+			b.WriteString(",\n")
+		}
+		fmt.Fprintf(&b, "%q: %s", name, v.String())
+	}
+	b.WriteString("\n}\n")
+
+	// nolint:errcheck
+	w.Write(b.Bytes())
+}
+
+func (s *Static) pac(w http.ResponseWriter, r *http.Request) {
+	// Clients are sent to TLS listener if there is one, so credentials and destinations are not seen on the wire
+	directive, addr := "HTTPS", s.proxyConfig.TLSAddrFor(localIP(r))
+	if addr == nil {
+		directive, addr = "PROXY", s.proxyAddr(r)
+	}
+	if addr == nil {
+		http.Error(w, "proxy listens on unix socket only", http.StatusNotFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
 	if _, err := w.Write(
 		[]byte(
 			fmt.Sprintf(
 				pacFile,
-				s.proxyConfig.Addr.String(),
+				directive,
+				addr.String(),
 			),
 		),
 	); err != nil {
@@ -52,23 +101,21 @@ func (s *Static) pac(w http.ResponseWriter, _ *http.Request) {
 }
 
 // ca returns actual root CA certificate by doing request through our proxy
-func (s *Static) ca(w http.ResponseWriter, _ *http.Request) {
-	u, err := url.Parse("http://" + s.proxyConfig.Addr.String())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *Static) ca(w http.ResponseWriter, r *http.Request) {
+	addr := s.proxyAddr(r)
+	if addr == nil {
+		http.Error(w, "proxy listens on unix socket only", http.StatusNotFound)
 		return
 	}
 
-	// We need http client with custom transport
-	httpClient := http.DefaultClient
-
-	tr := http.DefaultTransport
-	// Pass our newly deployed local proxy
-	tr.(*http.Transport).Proxy = http.ProxyURL(u)
+	// Own transport is authenticated as the proxy itself, default one is shared by the whole process
+	tr := s.proxy.InternalTransport(addr)
+	defer tr.CloseIdleConnections()
 	// We check it against corporate proxy, so it usually use MITM
-	tr.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	// nolint:gosec
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
-	httpClient.Transport = tr
+	httpClient := &http.Client{Transport: tr}
 
 	req, err := http.NewRequest("GET", "https://www.google.com", nil)
 	if err != nil {
@@ -103,3 +150,86 @@ func (s *Static) ca(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 }
+
+// proxyCertificate returns certificate of TLS listener, e.g. self-signed one for clients to trust
+func (s *Static) proxyCertificate(w http.ResponseWriter, _ *http.Request) {
+	cert := s.proxyConfig.TLS.Certificate
+	if cert == nil {
+		http.Error(w, "proxy has no TLS listener", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.WriteHeader(http.StatusOK)
+	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		s.logger.Error("Cannot write proxy certificate", zap.Error(err))
+	}
+}
+
+// mitmCertificate returns root CA of TLS interception, clients must trust it to reach intercepted domains
+func (s *Static) mitmCertificate(w http.ResponseWriter, _ *http.Request) {
+	ca := s.proxyConfig.MITM.CA
+	if ca == nil {
+		http.Error(w, "TLS interception is disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.WriteHeader(http.StatusOK)
+	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw}); err != nil {
+		s.logger.Error("Cannot write root CA certificate", zap.Error(err))
+	}
+}
+
+// proxyAddr returns proxy address on the interface client connected to static server on.
+func (s *Static) proxyAddr(r *http.Request) *net.TCPAddr {
+	return s.proxyConfig.AddrFor(localIP(r))
+}
+
+// localIP returns IP client connected to static server on.
+func localIP(r *http.Request) net.IP {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
+
+// loopbackOnly rejects requests from non-loopback clients, static server could listen on any address.
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getBandwidth returns current proxy bandwidth limits
+func (s *Static) getBandwidth(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.proxy.Bandwidth()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// setBandwidth replaces proxy bandwidth limits
+func (s *Static) setBandwidth(w http.ResponseWriter, r *http.Request) {
+	var b proxy.Bandwidth
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.proxy.SetBandwidth(b); err != nil {
+		s.logger.Warn("Cannot change bandwidth limits", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
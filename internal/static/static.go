@@ -7,24 +7,39 @@ package static
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 
 	"github.com/L11R/escobar/internal/proxy"
 	"go.uber.org/zap"
 )
 
+// BandwidthController gets and sets proxy bandwidth limits at runtime.
+type BandwidthController interface {
+	Bandwidth() proxy.Bandwidth
+	SetBandwidth(b proxy.Bandwidth) error
+}
+
+// Proxy is the local proxy, static server controls it and sends own requests through it.
+type Proxy interface {
+	BandwidthController
+	InternalTransport(addr *net.TCPAddr) *http.Transport
+}
+
 type Static struct {
 	logger      *zap.Logger
 	config      *Config
 	proxyConfig *proxy.Config
+	proxy       Proxy
 	server      *http.Server
 }
 
-func NewStatic(logger *zap.Logger, config *Config, proxyConfig *proxy.Config) *Static {
+func NewStatic(logger *zap.Logger, config *Config, proxyConfig *proxy.Config, p Proxy) *Static {
 	s := &Static{
 		logger:      logger,
 		config:      config,
 		proxyConfig: proxyConfig,
+		proxy:       p,
 	}
 
 	s.server = &http.Server{
@@ -35,13 +50,27 @@ func NewStatic(logger *zap.Logger, config *Config, proxyConfig *proxy.Config) *S
 	return s
 }
 
-// ListenAndServe listens and serves HTTP requests.
-func (s *Static) ListenAndServe() error {
-	s.logger.Info("Listening and serving HTTP requests", zap.String("address", s.config.Addr.String()))
+// Listen listens static server socket.
+func (s *Static) Listen() (net.Listener, error) {
+	s.logger.Info("Listening socket", zap.String("address", s.config.Addr.String()))
+
+	l, err := net.Listen("tcp", s.config.Addr.String())
+	if err != nil {
+		s.logger.Error("Error while listening!", zap.Error(err))
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Serve serves HTTP requests, listener could be inherited from previous process.
+func (s *Static) Serve(l net.Listener) error {
+	s.logger.Info("Serving HTTP requests", zap.String("address", l.Addr().String()))
 
-	if err := s.server.ListenAndServe(); err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
-			s.logger.Error("Error listening and serving HTTP requests!", zap.Error(err))
+	if err := s.server.Serve(l); err != nil {
+		// Listener is closed on shutdown or when it's handed over to new process
+		if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("Error serving HTTP requests!", zap.Error(err))
 			return err
 		}
 	}